@@ -0,0 +1,88 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/thales-e-security/tendermint-hsm-validator/simulator"
+)
+
+// hsm-simulator runs the CodeSafe machine simulator, so that a validator can
+// be run without an nShield HSM. It must never be used to protect real keys.
+func main() {
+	laddr := flag.String("laddr", "127.0.0.1:49999", "address to listen on")
+	keyFile := flag.String("wrapping-key", "simulator-wrapping-key.hex",
+		"file holding the hex wrapping key, created if it does not exist")
+	wireVersion := flag.Int("wire-version", 0,
+		"newest wire protocol version to speak, to emulate an older CodeSafe machine (0 for the latest)")
+	flag.Parse()
+
+	wrappingKey, err := loadOrCreateWrappingKey(*keyFile)
+	if err != nil {
+		panic(err)
+	}
+
+	sim, err := simulator.New(wrappingKey)
+	if err != nil {
+		panic(err)
+	}
+	sim.WireVersion = int32(*wireVersion)
+
+	listener, err := net.Listen("tcp", *laddr)
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Printf("Simulating CodeSafe machine on %s\n", listener.Addr())
+	err = sim.Serve(listener)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// loadOrCreateWrappingKey reads the wrapping key from filePath, generating
+// and saving a new one if the file does not exist. Keeping the wrapping key
+// allows keys generated in one run to be loaded in the next.
+func loadOrCreateWrappingKey(filePath string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(filePath)
+	if err == nil {
+		return hex.DecodeString(strings.TrimSpace(string(contents)))
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key := make([]byte, 32)
+	_, err = rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ioutil.WriteFile(filePath, []byte(hex.EncodeToString(key)+"\n"), 0600)
+	return key, err
+}
@@ -22,37 +22,91 @@ package main
 
 import (
 	"fmt"
+	"os"
 
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 	tcrypto "github.com/tendermint/go-crypto"
 	"github.com/tendermint/tendermint/types"
+	"github.com/tendermint/tmlibs/cli"
+	cmn "github.com/tendermint/tmlibs/common"
+	"github.com/tendermint/tmlibs/log"
+
+	"github.com/thales-e-security/tendermint-hsm-validator/config"
 	"github.com/thales-e-security/tendermint-hsm-validator/module"
 	"github.com/thales-e-security/tendermint-hsm-validator/validator"
 )
 
-// These values are hard-coded for convenience. In a real
-// application they probably belong in a configuration file
-const (
-	host              = "127.0.0.1"
-	port              = 49999
-	privValidatorFile = "hsm-priv-validator.json"
-	genesisFile       = "genesis.json"
-)
-
+// hsm-validator-init generates a validator key in the HSM and writes the
+// private validator and genesis files to the home directory, along with a
+// default hsm.toml if there is none. An existing private validator file is
+// only replaced if --force is given.
 func main() {
+	rootCmd := &cobra.Command{
+		Use:   "hsm-validator-init",
+		Short: "Generate an HSM validator key and genesis file",
+		RunE:  initFiles,
+	}
+	rootCmd.Flags().Bool("force", false, "Replace an existing private validator file, and with it the validator's key")
+	config.AddFlags(rootCmd.Flags())
+
+	cmd := cli.PrepareBaseCmd(rootCmd, "TM", os.ExpandEnv("$HOME/.tendermint"))
+	if err := cmd.Execute(); err != nil {
+		os.Exit(1)
+	}
+}
+
+func initFiles(cmd *cobra.Command, args []string) error {
+	hsmConfig, err := config.Load(viper.GetString(cli.HomeFlag), cmd.Flags())
+	if err != nil {
+		return err
+	}
+
+	configFile, err := config.EnsureConfigFile(hsmConfig)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Using configuration file: %s\n", configFile)
 
-	hsm := module.ThalesHSM{
-		Port: port,
-		Host: host,
+	// The old file is only kept as a backup once replaced, and the sign
+	// state it goes with no longer matches the new key
+	privValidatorFile := hsmConfig.PrivValidatorFile()
+	force, _ := cmd.Flags().GetBool("force")
+	if cmn.FileExists(privValidatorFile) && !force {
+		return errors.Errorf("private validator file %s already exists; use --force to replace it with a new key",
+			privValidatorFile)
+	}
+
+	hsm, err := hsmConfig.NewHsm(log.NewTMLogger(log.NewSyncWriter(os.Stdout)).With("module", "hsm"),
+		module.NopMetrics())
+	if err != nil {
+		return err
 	}
+	defer hsm.Close()
 
-	privValidator, err := validator.NewHsmPrivValidator(hsm)
+	audit, err := hsmConfig.OpenAuditLog()
 	if err != nil {
-		panic(err)
+		return err
 	}
+	if audit != nil {
+		defer audit.Close()
+	}
+
+	privValidator, err := validator.NewHsmPrivValidatorWithAudit(hsm, audit)
+	if err != nil {
+		return err
+	}
+
+	privValidator.ChainID = hsmConfig.ChainID
+	privValidator.SecurityWorld = hsmConfig.SecurityWorld
+	privValidator.Backups = hsmConfig.PrivValidatorBackups
+	privValidator.AllowUncheckedKey = hsmConfig.AllowUncheckedKey
 
 	err = privValidator.SaveToFile(privValidatorFile)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	fmt.Printf("Wrote private validator file to: %s\n", privValidatorFile)
@@ -61,20 +115,22 @@ func main() {
 	copy(pk[:], privValidator.PublicKey)
 
 	genesisDoc := types.GenesisDoc{
-		ChainID: "chain-hsm-test",
+		ChainID: hsmConfig.ChainID,
 		Validators: []types.GenesisValidator{
 			{
-				PubKey: tcrypto.PubKey{tcrypto.PubKeyEd25519(pk)},
-				Power:  10,
+				PubKey: tcrypto.PubKey{PubKeyInner: tcrypto.PubKeyEd25519(pk)},
+				Power:  hsmConfig.Power,
 			},
 		},
 	}
 
+	genesisFile := hsmConfig.GenesisFile()
 	err = genesisDoc.SaveAs(genesisFile)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	fmt.Printf("Wrote genesis file to: %s\n", genesisFile)
 	fmt.Println("Done!")
+	return nil
 }
@@ -23,6 +23,8 @@ package main
 import (
 	"os"
 
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 	"github.com/tendermint/tmlibs/cli"
 	"github.com/tendermint/tmlibs/log"
 
@@ -30,23 +32,14 @@ import (
 	cfg "github.com/tendermint/tendermint/config"
 	"github.com/tendermint/tendermint/node"
 	"github.com/tendermint/tendermint/proxy"
-	"github.com/thales-e-security/tendermint-hsm-validator/module"
-	"github.com/thales-e-security/tendermint-hsm-validator/validator"
+	"github.com/tendermint/tendermint/types"
+	"github.com/thales-e-security/tendermint-hsm-validator/config"
 )
 
 var (
-	config = cfg.DefaultConfig()
 	logger = log.NewTMLogger(log.NewSyncWriter(os.Stdout)).With("module", "main")
 )
 
-// These values are hard-coded for convenience. In a real
-// application they probably belong in a configuration file
-const (
-	host              = "127.0.0.1"
-	port              = 49999
-	privValidatorFile = "hsm-priv-validator.json"
-)
-
 func main() {
 	rootCmd := tc.RootCmd
 	rootCmd.AddCommand(tc.GenValidatorCmd)
@@ -60,27 +53,50 @@ func main() {
 	rootCmd.AddCommand(tc.TestnetFilesCmd)
 	rootCmd.AddCommand(tc.VersionCmd)
 
-	pathToValidatorFile := os.ExpandEnv("$HOME/.tendermint/") + privValidatorFile
+	var hsmConfig *config.HsmConfig
 
-	privValidator, err := validator.LoadFromFile(pathToValidatorFile, module.ThalesHSM{
-		Host: host,
-		Port: port,
-	})
+	runNodeCmd := tc.NewRunNodeCmd(func(tmConfig *cfg.Config, logger log.Logger) (*node.Node, error) {
+		privValidator, err := loadPrivValidator(hsmConfig, logger)
+		if err != nil {
+			return nil, err
+		}
 
-	if err != nil {
-		panic(err)
-	}
-
-	rootCmd.AddCommand(tc.NewRunNodeCmd(func(config *cfg.Config, logger log.Logger) (*node.Node, error) {
 		return node.NewNode(
-			config,
+			tmConfig,
 			privValidator,
-			proxy.DefaultClientCreator(config.ProxyApp, config.ABCI, config.DBDir()),
-			node.DefaultGenesisDocProviderFunc(config),
+			proxy.DefaultClientCreator(tmConfig.ProxyApp, tmConfig.ABCI, tmConfig.DBDir()),
+			node.DefaultGenesisDocProviderFunc(tmConfig),
 			node.DefaultDBProvider,
 			logger)
-	}))
+	})
+	config.AddFlags(runNodeCmd.Flags())
+
+	// Load the HSM settings before the node starts, so that configuration
+	// errors are reported rather than surfacing as a failed node.
+	runNodeCmd.PreRunE = func(cmd *cobra.Command, args []string) (err error) {
+		hsmConfig, err = config.Load(viper.GetString(cli.HomeFlag), cmd.Flags())
+		return err
+	}
+	rootCmd.AddCommand(runNodeCmd)
 
 	cmd := cli.PrepareBaseCmd(rootCmd, "TM", os.ExpandEnv("$HOME/.tendermint"))
 	cmd.Execute()
 }
+
+// loadPrivValidator loads the HSM validator in this process.
+func loadPrivValidator(hsmConfig *config.HsmConfig, logger log.Logger) (types.PrivValidator, error) {
+	hsmMetrics, pvMetrics := hsmConfig.Metrics()
+	hsmConfig.ServeMetrics(logger)
+
+	hsm, err := hsmConfig.NewHsm(logger.With("module", "hsm"), hsmMetrics)
+	if err != nil {
+		return nil, err
+	}
+
+	pv, err := hsmConfig.LoadPrivValidator(hsm, logger.With("module", "privval"), pvMetrics)
+	if err != nil {
+		hsm.Close()
+		return nil, err
+	}
+	return pv, nil
+}
@@ -0,0 +1,545 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/tendermint/go-wire"
+	"github.com/tendermint/tendermint/types"
+	"github.com/tendermint/tmlibs/cli"
+	"github.com/tendermint/tmlibs/log"
+
+	"github.com/thales-e-security/tendermint-hsm-validator/config"
+	"github.com/thales-e-security/tendermint-hsm-validator/module"
+	"github.com/thales-e-security/tendermint-hsm-validator/validator"
+)
+
+// hsm-validator holds administrative commands for the HSM validator.
+func main() {
+	rootCmd := &cobra.Command{
+		Use:   "hsm-validator",
+		Short: "Manage the HSM validator",
+	}
+
+	statusCmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show the status of each configured CodeSafe machine",
+		RunE:  runStatus,
+	}
+	config.AddFlags(statusCmd.Flags())
+	rootCmd.AddCommand(statusCmd)
+
+	exportCmd := &cobra.Command{
+		Use:   "export-state <file>",
+		Short: "Write the state signed by the HSM to a file, for importing into another HSM",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runExportState,
+	}
+	config.AddFlags(exportCmd.Flags())
+	rootCmd.AddCommand(exportCmd)
+
+	importCmd := &cobra.Command{
+		Use:   "import-state [file]",
+		Short: "Seed each configured CodeSafe machine with an exported state and this validator's sign state, then bring the sign state up to date",
+		Args:  cobra.MaximumNArgs(1),
+		RunE:  runImportState,
+	}
+	config.AddFlags(importCmd.Flags())
+	rootCmd.AddCommand(importCmd)
+
+	auditCmd := &cobra.Command{
+		Use:   "audit [file]",
+		Short: "Search the audit log",
+		Args:  cobra.MaximumNArgs(1),
+		RunE:  runAuditQuery,
+	}
+	config.AddFlags(auditCmd.Flags())
+	auditCmd.Flags().Int64("min-height", 0, "Only show entries at or above this height")
+	auditCmd.Flags().Int64("max-height", 0, "Only show entries at or below this height (0 for no limit)")
+	auditCmd.Flags().String("chain-id", "", "Only show entries for this chain")
+	auditCmd.Flags().String("type", "", "Only show entries for this message type: prevote, precommit, proposal or heartbeat")
+	auditCmd.Flags().String("outcome", "", "Only show entries with this outcome: ok or error")
+	auditCmd.Flags().Bool("json", false, "Print the matching entries as they appear in the log")
+	rootCmd.AddCommand(auditCmd)
+
+	verifyCmd := &cobra.Command{
+		Use:   "verify [file]",
+		Short: "Check that the audit log has not been altered or truncated",
+		Args:  cobra.MaximumNArgs(1),
+		RunE:  runAuditVerify,
+	}
+	config.AddFlags(verifyCmd.Flags())
+	auditCmd.AddCommand(verifyCmd)
+
+	evidenceCmd := &cobra.Command{
+		Use:   "evidence <evidence-file> [file]",
+		Short: "Check whether the audit log shows this validator signed both votes of duplicate vote evidence",
+		Args:  cobra.RangeArgs(1, 2),
+		RunE:  runAuditEvidence,
+	}
+	config.AddFlags(evidenceCmd.Flags())
+	auditCmd.AddCommand(evidenceCmd)
+
+	cmd := cli.PrepareBaseCmd(rootCmd, "TM", os.ExpandEnv("$HOME/.tendermint"))
+	if err := cmd.Execute(); err != nil {
+		os.Exit(1)
+	}
+}
+
+func runStatus(cmd *cobra.Command, args []string) error {
+	hsmConfig, err := config.Load(viper.GetString(cli.HomeFlag), cmd.Flags())
+	if err != nil {
+		return err
+	}
+
+	modules, err := hsmConfig.Modules(module.NopMetrics())
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ENDPOINT\tWIRE\tVERSION\tKEY LOADED\tHEIGHT\tROUND\tSTEP")
+
+	failed := 0
+	for i, m := range modules {
+		protocol, status, err := moduleStatus(m, hsmConfig.Timeout)
+		if err != nil {
+			fmt.Fprintf(w, "%s\t%s\terror: %v\t\t\t\t\n", hsmConfig.Endpoints[i], wireVersion(protocol), err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%t\t%d\t%d\t%d\n", hsmConfig.Endpoints[i], protocol.Version,
+			status.Version, status.KeyLoaded, status.Height, status.Round, status.Step)
+	}
+
+	state, err := validator.LoadSignState(validator.SignStateFilePath(hsmConfig.PrivValidatorFile()))
+	if err != nil {
+		fmt.Fprintf(w, "sign state\t\terror: %v\t\t\t\t\n", err)
+		failed++
+	} else {
+		fmt.Fprintf(w, "sign state\t\t\t\t%d\t%d\t%d\n", state.Height, state.Round, state.Step)
+	}
+
+	w.Flush()
+
+	if failed > 0 {
+		return errors.Errorf("%d of %d status checks failed", failed, len(modules)+1)
+	}
+	return nil
+}
+
+func runExportState(cmd *cobra.Command, args []string) error {
+	hsmConfig, err := config.Load(viper.GetString(cli.HomeFlag), cmd.Flags())
+	if err != nil {
+		return err
+	}
+
+	logger := log.NewTMLogger(log.NewSyncWriter(os.Stderr))
+	hsm, err := hsmConfig.NewHsm(logger.With("module", "hsm"), module.NopMetrics())
+	if err != nil {
+		return err
+	}
+	defer hsm.Close()
+
+	pv, err := hsmConfig.LoadPrivValidator(hsm, logger.With("module", "privval"), validator.NopMetrics())
+	if err != nil {
+		return err
+	}
+	defer pv.Close()
+
+	state, err := pv.ExportState()
+	if err != nil {
+		return errors.WithMessage(err, "failed to export state")
+	}
+
+	bytes, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(args[0], bytes, 0600)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Exported height %d, round %d, step %d to %s\n", state.Height, state.Round, state.Step, args[0])
+	return nil
+}
+
+func runImportState(cmd *cobra.Command, args []string) error {
+	hsmConfig, err := config.Load(viper.GetString(cli.HomeFlag), cmd.Flags())
+	if err != nil {
+		return err
+	}
+
+	publicKey, err := validator.ReadPublicKey(hsmConfig.PrivValidatorFile())
+	if err != nil {
+		return err
+	}
+
+	// The modules are seeded with whichever is later: the exported state, or
+	// what this validator has signed
+	signState, err := validator.LoadSignState(validator.SignStateFilePath(hsmConfig.PrivValidatorFile()))
+	if err != nil {
+		return err
+	}
+	err = signState.CheckPublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+	state := validator.SignedState{Height: signState.Height, Round: signState.Round, Step: signState.Step}
+
+	if len(args) == 1 {
+		exported, err := readSignedState(args[0], publicKey)
+		if err != nil {
+			return err
+		}
+		if state.Position().Before(exported.Position()) {
+			state = exported
+		}
+	}
+
+	modules, err := hsmConfig.Modules(module.NopMetrics())
+	if err != nil {
+		return err
+	}
+
+	audit, err := hsmConfig.OpenAuditLog()
+	if err != nil {
+		return err
+	}
+	if audit != nil {
+		defer audit.Close()
+	}
+
+	fmt.Printf("Seeding height %d, round %d, step %d\n", state.Height, state.Round, state.Step)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ENDPOINT\tRESULT")
+
+	// The sign state is raised to whatever the modules have signed, so that
+	// the validator accepts a module that is ahead of it
+	adopt := state.Position()
+
+	failed := 0
+	for i, m := range modules {
+		status, err := seedState(m, state, hsmConfig.Timeout)
+		if audit != nil {
+			entry := validator.AuditEntry{Op: validator.AuditSeedState, Height: state.Height, Round: state.Round, Step: state.Step}
+			if err != nil {
+				entry.Error = hsmConfig.Endpoints[i] + ": " + err.Error()
+			}
+			if auditErr := audit.Append(entry); err == nil && auditErr != nil {
+				err = errors.WithMessage(auditErr, "seeded, but failed to write audit log")
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(w, "%s\terror: %v\n", hsmConfig.Endpoints[i], err)
+			failed++
+			continue
+		}
+		signed := validator.Position{Height: status.Height, Round: status.Round, Step: status.Step}
+		if adopt.Before(signed) {
+			adopt = signed
+		}
+		fmt.Fprintf(w, "%s\tok, signed %s\n", hsmConfig.Endpoints[i], signed)
+	}
+
+	w.Flush()
+
+	if failed > 0 {
+		return errors.Errorf("failed to seed %d of %d modules", failed, len(modules))
+	}
+
+	raised, err := validator.RaiseSignState(hsmConfig.PrivValidatorFile(), adopt)
+	if err != nil {
+		return errors.WithMessage(err, "seeded, but failed to update the sign state")
+	}
+	fmt.Printf("Sign state is height %d, round %d, step %d\n", raised.Height, raised.Round, raised.Step)
+	return nil
+}
+
+// readSignedState reads a state written by export-state, and checks that it
+// was signed by the key with the given public key.
+func readSignedState(filePath string, publicKey []byte) (validator.SignedState, error) {
+	var state validator.SignedState
+
+	bytes, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return state, err
+	}
+
+	err = json.Unmarshal(bytes, &state)
+	if err != nil {
+		return state, errors.WithMessage(err, "invalid state file "+filePath)
+	}
+
+	err = state.Verify(publicKey)
+	if err != nil {
+		return state, errors.WithMessage(err, "state file "+filePath+" is not for this validator")
+	}
+	return state, nil
+}
+
+// seedState seeds m with state, and returns its status afterwards, giving up
+// after timeout if it is not zero.
+func seedState(m *module.ThalesHSM, state validator.SignedState, timeout time.Duration) (module.Status, error) {
+	defer m.Close()
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	err := m.SeedStateContext(ctx, state.Height, state.Round, state.Step)
+	if err != nil {
+		return module.Status{}, err
+	}
+	return m.Status(ctx)
+}
+
+func runAuditVerify(cmd *cobra.Command, args []string) error {
+	filePath, key, err := auditLogFile(cmd, args)
+	if err != nil {
+		return err
+	}
+
+	head, err := validator.VerifyAuditLog(filePath, key)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: %d entries, last hash %X\n", filePath, head.Entries, []byte(head.Hash))
+	return nil
+}
+
+func runAuditQuery(cmd *cobra.Command, args []string) error {
+	filePath, key, err := auditLogFile(cmd, args)
+	if err != nil {
+		return err
+	}
+
+	flags := cmd.Flags()
+	var query validator.AuditQuery
+	query.MinHeight, _ = flags.GetInt64("min-height")
+	query.MaxHeight, _ = flags.GetInt64("max-height")
+	query.ChainID, _ = flags.GetString("chain-id")
+	query.Type, _ = flags.GetString("type")
+	query.Outcome, _ = flags.GetString("outcome")
+	asJSON, _ := flags.GetBool("json")
+
+	if query.Outcome != "" && query.Outcome != validator.AuditOutcomeOK &&
+		query.Outcome != validator.AuditOutcomeError {
+		return errors.Errorf("outcome must be %q or %q", validator.AuditOutcomeOK, validator.AuditOutcomeError)
+	}
+
+	// Nothing is printed unless the whole log verifies
+	var matches []validator.AuditEntry
+	_, err = validator.ReadAuditLog(filePath, key, func(entry validator.AuditEntry) error {
+		if query.Matches(entry) {
+			matches = append(matches, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		for _, entry := range matches {
+			line, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(line))
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SEQ\tTIME\tOP\tCHAIN ID\tTYPE\tHEIGHT\tROUND\tSTEP\tBLOCK ID\tOUTCOME")
+	for _, entry := range matches {
+		outcome := entry.Outcome()
+		if entry.Error != "" {
+			outcome += ": " + entry.Error
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%X\t%s\n", entry.Seq,
+			entry.Time.Format(time.RFC3339), entry.Op, entry.ChainID, entry.Type,
+			entry.Height, entry.Round, entry.Step, []byte(entry.BlockID), outcome)
+	}
+	w.Flush()
+
+	fmt.Printf("%d matching entries\n", len(matches))
+	return nil
+}
+
+func runAuditEvidence(cmd *cobra.Command, args []string) error {
+	hsmConfig, err := config.Load(viper.GetString(cli.HomeFlag), cmd.Flags())
+	if err != nil {
+		return err
+	}
+
+	filePath, key, err := auditLogFile(cmd, args[1:])
+	if err != nil {
+		return err
+	}
+
+	evidence, err := readEvidence(args[0])
+	if err != nil {
+		return err
+	}
+
+	publicKey, err := validator.ReadPublicKey(hsmConfig.PrivValidatorFile())
+	if err != nil {
+		return err
+	}
+
+	report, err := validator.CheckEvidence(filePath, key, publicKey, hsmConfig.ChainID, evidence)
+	if err != nil {
+		return err
+	}
+
+	if !report.OurKey {
+		pv := validator.HsmPrivValidator{PublicKey: publicKey}
+		fmt.Printf("The evidence is against validator %X, not this validator, %X\n",
+			[]byte(evidence.VoteA.ValidatorAddress), []byte(pv.GetAddress()))
+		return nil
+	}
+
+	for _, vote := range []struct {
+		name string
+		validator.EvidenceVote
+	}{{"A", report.VoteA}, {"B", report.VoteB}} {
+		switch {
+		case vote.Entry != nil:
+			fmt.Printf("Vote %s was signed by this validator at %s (audit entry %d)\n",
+				vote.name, vote.Entry.Time.Format(time.RFC3339), vote.Entry.Seq)
+		case vote.Valid:
+			fmt.Printf("Vote %s was signed with this validator's key, but not through this host; "+
+				"the key may be in use elsewhere\n", vote.name)
+		default:
+			fmt.Printf("Vote %s does not have a valid signature from this validator's key on chain %q\n",
+				vote.name, hsmConfig.ChainID)
+		}
+	}
+
+	if report.Produced() {
+		fmt.Println("This validator produced both conflicting votes")
+	} else {
+		fmt.Println("The audit log does not show this validator producing both conflicting votes")
+	}
+	return nil
+}
+
+// readEvidence reads DuplicateVoteEvidence from a JSON file, either as an
+// object or in the go-wire [type, evidence] encoding of a Tendermint Evidence.
+func readEvidence(filePath string) (*types.DuplicateVoteEvidence, error) {
+	contents, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	evidence := new(types.DuplicateVoteEvidence)
+	if bytes.HasPrefix(bytes.TrimSpace(contents), []byte("[")) {
+		var wrapped types.Evidence
+		wire.ReadJSONPtr(&wrapped, contents, &err)
+		if err == nil {
+			var ok bool
+			evidence, ok = wrapped.(*types.DuplicateVoteEvidence)
+			if !ok {
+				err = errors.Errorf("expected duplicate vote evidence, found %T", wrapped)
+			}
+		}
+	} else {
+		err = json.Unmarshal(contents, evidence)
+	}
+	if err != nil {
+		return nil, errors.WithMessage(err, "invalid evidence in "+filePath)
+	}
+	if evidence.VoteA == nil || evidence.VoteB == nil {
+		return nil, errors.Errorf("invalid evidence in %s: two votes are required", filePath)
+	}
+	return evidence, nil
+}
+
+// auditLogFile returns the audit log named in args, if any, or else the one
+// configured, and the configured key for the log, if any.
+func auditLogFile(cmd *cobra.Command, args []string) (string, []byte, error) {
+	hsmConfig, err := config.Load(viper.GetString(cli.HomeFlag), cmd.Flags())
+	if err != nil {
+		return "", nil, err
+	}
+
+	key, err := hsmConfig.AuditKey()
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(args) > 0 {
+		return args[0], key, nil
+	}
+	if hsmConfig.AuditLog == "" {
+		return "", nil, errors.New("no audit log is configured")
+	}
+	return hsmConfig.AuditLogFile(), key, nil
+}
+
+// moduleStatus agrees a wire protocol with m and runs the status job, giving
+// up after timeout if it is not zero.
+func moduleStatus(m *module.ThalesHSM, timeout time.Duration) (module.Protocol, module.Status, error) {
+	defer m.Close()
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	protocol, err := m.Protocol(ctx)
+	if err != nil {
+		return protocol, module.Status{}, err
+	}
+
+	status, err := m.Status(ctx)
+	return protocol, status, err
+}
+
+// wireVersion formats the version of protocol, or is empty if none was agreed.
+func wireVersion(protocol module.Protocol) string {
+	if protocol.Version == 0 {
+		return ""
+	}
+	return strconv.Itoa(int(protocol.Version))
+}
@@ -0,0 +1,514 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+// Package config holds the settings shared by the hsm-validator commands:
+// where the CodeSafe machine is, how to talk to it securely, and where the
+// validator files live. Settings are read from hsm.toml in the Tendermint
+// home directory and may be overridden by TM_HSM_ environment variables and
+// by --hsm. command line flags, in increasing order of precedence.
+package config
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	cmn "github.com/tendermint/tmlibs/common"
+	"github.com/tendermint/tmlibs/log"
+
+	"github.com/thales-e-security/tendermint-hsm-validator/module"
+	"github.com/thales-e-security/tendermint-hsm-validator/validator"
+)
+
+const (
+	// FileName is the name of the configuration file within the home directory.
+	FileName = "hsm.toml"
+
+	// EnvPrefix is prepended, along with an underscore, to the upper-cased
+	// setting name to form the environment variable that overrides it.
+	EnvPrefix = "TM_HSM"
+
+	// FlagPrefix is prepended to the setting name to form the flag that
+	// overrides it.
+	FlagPrefix = "hsm."
+
+	// MetricsNamespace is the Prometheus namespace for the commands' metrics.
+	MetricsNamespace = "tendermint"
+)
+
+// HsmConfig holds the settings for connecting to the HSM and for the files
+// written by hsm-validator-init and read by the other commands.
+type HsmConfig struct {
+	// RootDir is the Tendermint home directory. Relative paths are resolved
+	// against it.
+	RootDir string `mapstructure:"-"`
+
+	// Endpoints lists the CodeSafe machines, as host:port, in order of
+	// preference. If there is more than one, signing fails over between them.
+	Endpoints []string `mapstructure:"endpoints"`
+
+	// HealthCheckInterval is how often each machine is checked when there
+	// is more than one.
+	HealthCheckInterval time.Duration `mapstructure:"health_check_interval"`
+
+	// MaxConnections bounds the connections held open to each machine.
+	MaxConnections int `mapstructure:"max_connections"`
+
+	// MinWireVersion is the oldest wire protocol version accepted from each
+	// machine. Machines speaking version 1 cannot report their loaded key
+	// or signed state, so are refused unless this is set to 1.
+	MinWireVersion int32 `mapstructure:"min_wire_version"`
+
+	// AllowUncheckedKey lets the validator use a machine that cannot report
+	// the key it has loaded, such as one speaking version 1, without
+	// binding that key to the public key in the private validator file.
+	AllowUncheckedKey bool `mapstructure:"allow_unchecked_key"`
+
+	// Timeout bounds each HSM operation. Zero means no limit.
+	Timeout time.Duration `mapstructure:"timeout"`
+
+	// TLS material. If TLSCertFile is empty, plain TCP is used.
+	TLSCertFile    string   `mapstructure:"tls_cert_file"`
+	TLSKeyFile     string   `mapstructure:"tls_key_file"`
+	TLSCAFile      string   `mapstructure:"tls_ca_file"`
+	TLSServerName  string   `mapstructure:"tls_server_name"`
+	TLSPinnedCerts []string `mapstructure:"tls_pinned_certs"`
+
+	// PrivValidator and Genesis name the files written by hsm-validator-init.
+	PrivValidator string `mapstructure:"priv_validator_file"`
+	Genesis       string `mapstructure:"genesis_file"`
+
+	// PrivValidatorBackups is the number of previous private validator
+	// files kept when the file is rewritten.
+	PrivValidatorBackups int `mapstructure:"priv_validator_backups"`
+
+	// AuditLog names the file recording every signature and key operation,
+	// relative to the home directory. Nothing is recorded if it is empty.
+	AuditLog string `mapstructure:"audit_log_file"`
+
+	// AuditKeyFile, if set, names the file holding the key for the audit
+	// log's hashes, relative to the home directory. It must not be in the
+	// same directory as the log.
+	AuditKeyFile string `mapstructure:"audit_key_file"`
+
+	// ChainID and Power are used when creating the genesis file. The
+	// private validator file is bound to ChainID.
+	ChainID string `mapstructure:"chain_id"`
+	Power   int64  `mapstructure:"power"`
+
+	// SecurityWorld identifies the Security World of the HSMs. It is
+	// recorded in the private validator file, and if set when the file is
+	// loaded, must match the value recorded.
+	SecurityWorld string `mapstructure:"security_world"`
+
+	// MetricsListenAddr, if set, is where Prometheus metrics are served,
+	// under /metrics.
+	MetricsListenAddr string `mapstructure:"metrics_laddr"`
+}
+
+// DefaultHsmConfig returns the settings used when nothing else is configured.
+func DefaultHsmConfig() *HsmConfig {
+	return &HsmConfig{
+		Endpoints:            []string{"127.0.0.1:49999"},
+		HealthCheckInterval:  10 * time.Second,
+		MaxConnections:       4,
+		MinWireVersion:       module.DefaultMinWireVersion,
+		Timeout:              5 * time.Second,
+		PrivValidator:        "hsm-priv-validator.json",
+		PrivValidatorBackups: 1,
+		AuditLog:             "hsm-validator-audit.jsonl",
+		Genesis:              "genesis.json",
+		ChainID:              "chain-hsm-test",
+		Power:                10,
+	}
+}
+
+// AddFlags registers a --hsm. flag for each setting.
+func AddFlags(flags *pflag.FlagSet) {
+	def := DefaultHsmConfig()
+
+	flags.StringSlice(FlagPrefix+"endpoints", def.Endpoints, "CodeSafe machine addresses, as host:port, in order of preference")
+	flags.Duration(FlagPrefix+"health_check_interval", def.HealthCheckInterval, "How often to check each CodeSafe machine, if there are several")
+	flags.Int(FlagPrefix+"max_connections", def.MaxConnections, "Maximum connections to each CodeSafe machine")
+	flags.Int32(FlagPrefix+"min_wire_version", def.MinWireVersion, "Oldest wire protocol version accepted from a CodeSafe machine")
+	flags.Bool(FlagPrefix+"allow_unchecked_key", def.AllowUncheckedKey, "Use CodeSafe machines that cannot report their loaded key, without checking it")
+	flags.Duration(FlagPrefix+"timeout", def.Timeout, "Time limit for each HSM operation (0 for none)")
+	flags.String(FlagPrefix+"tls_cert_file", def.TLSCertFile, "PEM client certificate presented to the CodeSafe machine")
+	flags.String(FlagPrefix+"tls_key_file", def.TLSKeyFile, "PEM private key for the client certificate")
+	flags.String(FlagPrefix+"tls_ca_file", def.TLSCAFile, "PEM CA certificates trusted to issue the CodeSafe machine's certificate")
+	flags.String(FlagPrefix+"tls_server_name", def.TLSServerName, "Name expected in the CodeSafe machine's certificate")
+	flags.StringSlice(FlagPrefix+"tls_pinned_certs", def.TLSPinnedCerts, "Hex SHA-256 fingerprints of accepted CodeSafe machine certificates")
+	flags.String(FlagPrefix+"priv_validator_file", def.PrivValidator, "Private validator file, relative to the home directory")
+	flags.String(FlagPrefix+"genesis_file", def.Genesis, "Genesis file, relative to the home directory")
+	flags.Int(FlagPrefix+"priv_validator_backups", def.PrivValidatorBackups, "Previous private validator files kept when the file is rewritten")
+	flags.String(FlagPrefix+"audit_log_file", def.AuditLog, "Audit log of signatures and key operations, relative to the home directory (disabled if empty)")
+	flags.String(FlagPrefix+"audit_key_file", def.AuditKeyFile, "Key for the audit log's hashes, kept outside the log's directory (unkeyed if empty)")
+	flags.String(FlagPrefix+"chain_id", def.ChainID, "Chain ID written to the genesis file")
+	flags.Int64(FlagPrefix+"power", def.Power, "Validator power written to the genesis file")
+	flags.String(FlagPrefix+"security_world", def.SecurityWorld, "Identifier of the HSMs' Security World, recorded in the private validator file")
+	flags.String(FlagPrefix+"metrics_laddr", def.MetricsListenAddr, "Address to serve Prometheus metrics on, e.g. :26660 (disabled if empty)")
+}
+
+// Load reads the settings for the given home directory. Values come from, in
+// increasing order of precedence: the defaults, hsm.toml in the home
+// directory (if present), TM_HSM_ environment variables and any flags in
+// flags that were set. flags may be nil.
+func Load(home string, flags *pflag.FlagSet) (*HsmConfig, error) {
+	v := viper.New()
+
+	def := DefaultHsmConfig()
+	v.SetDefault("endpoints", def.Endpoints)
+	v.SetDefault("health_check_interval", def.HealthCheckInterval)
+	v.SetDefault("max_connections", def.MaxConnections)
+	v.SetDefault("min_wire_version", def.MinWireVersion)
+	v.SetDefault("allow_unchecked_key", def.AllowUncheckedKey)
+	v.SetDefault("timeout", def.Timeout)
+	v.SetDefault("tls_cert_file", def.TLSCertFile)
+	v.SetDefault("tls_key_file", def.TLSKeyFile)
+	v.SetDefault("tls_ca_file", def.TLSCAFile)
+	v.SetDefault("tls_server_name", def.TLSServerName)
+	v.SetDefault("tls_pinned_certs", def.TLSPinnedCerts)
+	v.SetDefault("priv_validator_file", def.PrivValidator)
+	v.SetDefault("priv_validator_backups", def.PrivValidatorBackups)
+	v.SetDefault("audit_log_file", def.AuditLog)
+	v.SetDefault("audit_key_file", def.AuditKeyFile)
+	v.SetDefault("genesis_file", def.Genesis)
+	v.SetDefault("chain_id", def.ChainID)
+	v.SetDefault("power", def.Power)
+	v.SetDefault("security_world", def.SecurityWorld)
+	v.SetDefault("metrics_laddr", def.MetricsListenAddr)
+
+	v.SetEnvPrefix(EnvPrefix)
+	v.AutomaticEnv()
+
+	if flags != nil {
+		for _, key := range v.AllKeys() {
+			if flag := flags.Lookup(FlagPrefix + key); flag != nil {
+				if err := v.BindPFlag(key, flag); err != nil {
+					return nil, errors.WithMessage(err, "failed to bind flag")
+				}
+			}
+		}
+	}
+
+	configFile := filepath.Join(home, FileName)
+	if cmn.FileExists(configFile) {
+		v.SetConfigFile(configFile)
+		if err := v.ReadInConfig(); err != nil {
+			return nil, errors.WithMessage(err, "failed to read "+configFile)
+		}
+	}
+
+	config := new(HsmConfig)
+	if err := v.Unmarshal(config); err != nil {
+		return nil, errors.WithMessage(err, "failed to parse configuration")
+	}
+
+	config.RootDir = home
+
+	// Lists given in environment variables arrive as a single string
+	config.Endpoints = splitList(config.Endpoints)
+	config.TLSPinnedCerts = splitList(config.TLSPinnedCerts)
+
+	if err := config.ValidateBasic(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// ValidateBasic performs checks that do not require contacting the HSM.
+func (c *HsmConfig) ValidateBasic() error {
+	if len(c.Endpoints) == 0 {
+		return errors.New("at least one HSM endpoint is required")
+	}
+
+	for _, endpoint := range c.Endpoints {
+		if _, _, err := splitEndpoint(endpoint); err != nil {
+			return err
+		}
+	}
+
+	if c.MaxConnections < 0 {
+		return errors.New("max_connections cannot be negative")
+	}
+
+	if c.MinWireVersion < module.MinWireVersion || c.MinWireVersion > module.MaxWireVersion {
+		return errors.Errorf("min_wire_version must be from %d to %d", module.MinWireVersion, module.MaxWireVersion)
+	}
+
+	if c.PrivValidatorBackups < 0 {
+		return errors.New("priv_validator_backups cannot be negative")
+	}
+
+	if c.Timeout < 0 || c.HealthCheckInterval < 0 {
+		return errors.New("timeouts cannot be negative")
+	}
+
+	if c.AuditLog != "" && c.AuditKeyFile != "" &&
+		filepath.Dir(c.AuditKeyFilePath()) == filepath.Dir(c.AuditLogFile()) {
+		return errors.New("audit_key_file must not be in the same directory as the audit log, " +
+			"or whoever can rewrite the log can read the key")
+	}
+
+	if c.Power <= 0 {
+		return errors.New("validator power must be positive")
+	}
+
+	if c.ChainID == "" {
+		return errors.New("a chain ID is required")
+	}
+
+	return nil
+}
+
+// PrivValidatorFile returns the full path to the private validator file.
+func (c *HsmConfig) PrivValidatorFile() string {
+	return rootify(c.PrivValidator, c.RootDir)
+}
+
+// AuditLogFile returns the full path to the audit log, or an empty string if
+// auditing is disabled.
+func (c *HsmConfig) AuditLogFile() string {
+	if c.AuditLog == "" {
+		return ""
+	}
+	return rootify(c.AuditLog, c.RootDir)
+}
+
+// AuditKeyFilePath returns the full path to the audit log's key, or an empty
+// string if the log has no key.
+func (c *HsmConfig) AuditKeyFilePath() string {
+	return rootify(c.AuditKeyFile, c.RootDir)
+}
+
+// AuditKey reads the audit log's key, or returns nil if the log has no key.
+func (c *HsmConfig) AuditKey() ([]byte, error) {
+	if c.AuditKeyFile == "" {
+		return nil, nil
+	}
+	return validator.ReadAuditKey(c.AuditKeyFilePath())
+}
+
+// OpenAuditLog opens the audit log, with its key if one is configured, or
+// returns nil if auditing is disabled.
+func (c *HsmConfig) OpenAuditLog() (*validator.AuditLog, error) {
+	if c.AuditLog == "" {
+		return nil, nil
+	}
+
+	key, err := c.AuditKey()
+	if err != nil {
+		return nil, err
+	}
+	return validator.OpenAuditLog(c.AuditLogFile(), key)
+}
+
+// GenesisFile returns the full path to the genesis file.
+func (c *HsmConfig) GenesisFile() string {
+	return rootify(c.Genesis, c.RootDir)
+}
+
+// TLSOptions returns the TLS settings, with relative paths resolved against
+// the home directory.
+func (c *HsmConfig) TLSOptions() module.TLSOptions {
+	return module.TLSOptions{
+		CertFile:    rootify(c.TLSCertFile, c.RootDir),
+		KeyFile:     rootify(c.TLSKeyFile, c.RootDir),
+		CAFile:      rootify(c.TLSCAFile, c.RootDir),
+		ServerName:  c.TLSServerName,
+		PinnedCerts: c.TLSPinnedCerts,
+	}
+}
+
+// Hsm is an HSM connection that must be closed after use.
+type Hsm interface {
+	validator.ContextHsm
+	Close() error
+}
+
+// Metrics returns the metrics for the HSM and the private validator. If
+// MetricsListenAddr is set, these are registered with the default Prometheus
+// registry, so Metrics must only be called once. Otherwise they discard all
+// observations.
+func (c *HsmConfig) Metrics() (*module.Metrics, *validator.Metrics) {
+	if c.MetricsListenAddr == "" {
+		return module.NopMetrics(), validator.NopMetrics()
+	}
+	return module.PrometheusMetrics(MetricsNamespace), validator.PrometheusMetrics(MetricsNamespace)
+}
+
+// ServeMetrics serves the metrics registered by Metrics under /metrics on
+// MetricsListenAddr, in the background, reporting to logger when the server
+// starts and stops. It does nothing if MetricsListenAddr is empty.
+func (c *HsmConfig) ServeMetrics(logger log.Logger) {
+	if c.MetricsListenAddr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	go func() {
+		logger.Info("Serving metrics", "addr", c.MetricsListenAddr)
+		err := http.ListenAndServe(c.MetricsListenAddr, mux)
+		logger.Error("Metrics server stopped", "err", err)
+	}()
+}
+
+// NewHsm returns a connection to the configured CodeSafe machines. If more
+// than one is configured, the result is a module.FailoverHSM, which reports
+// failovers and health changes to logger. The caller should Close the
+// result when finished.
+func (c *HsmConfig) NewHsm(logger log.Logger, metrics *module.Metrics) (Hsm, error) {
+	modules, err := c.Modules(metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range modules {
+		m.Logger = logger
+	}
+
+	if len(modules) == 1 {
+		return modules[0], nil
+	}
+
+	hsm, err := module.NewFailoverHSM(modules...)
+	if err != nil {
+		return nil, err
+	}
+
+	hsm.SetLogger(logger)
+	hsm.SetMetrics(metrics)
+	if c.HealthCheckInterval > 0 {
+		hsm.StartHealthChecks(c.HealthCheckInterval)
+	}
+
+	return hsm, nil
+}
+
+// Modules returns a ThalesHSM for each configured endpoint, in order.
+func (c *HsmConfig) Modules(metrics *module.Metrics) ([]*module.ThalesHSM, error) {
+	var tlsConfig *tls.Config
+	if c.TLSCertFile != "" {
+		var err error
+		tlsConfig, err = c.TLSOptions().ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	modules := make([]*module.ThalesHSM, len(c.Endpoints))
+	for i, endpoint := range c.Endpoints {
+		host, port, err := splitEndpoint(endpoint)
+		if err != nil {
+			return nil, err
+		}
+
+		modules[i] = &module.ThalesHSM{
+			Host:           host,
+			Port:           port,
+			MaxConnections: c.MaxConnections,
+			MinVersion:     c.MinWireVersion,
+			TLS:            tlsConfig,
+			Metrics:        metrics,
+		}
+	}
+
+	return modules, nil
+}
+
+// LoadPrivValidator loads the private validator file, using hsm for signing
+// and applying the configured timeout, including to the HSM operations made
+// while loading. A file for a Security World other than the one configured
+// is refused before hsm is used. Recovery from HSM failures is reported to logger.
+// Operations are recorded in the audit log, if it is enabled, which is closed
+// along with the result.
+func (c *HsmConfig) LoadPrivValidator(hsm validator.Hsm, logger log.Logger,
+	metrics *validator.Metrics) (*validator.HsmPrivValidator, error) {
+	audit, err := c.OpenAuditLog()
+	if err != nil {
+		return nil, err
+	}
+	if audit != nil && c.AuditKeyFile == "" {
+		logger.Info("Audit log has no key, so it only detects accidental damage; set audit_key_file to protect it",
+			"file", c.AuditLogFile())
+	}
+
+	pv, err := validator.LoadFromFileWithOptions(c.PrivValidatorFile(), hsm, validator.LoadOptions{
+		Audit:         audit,
+		Backups:       c.PrivValidatorBackups,
+		Timeout:       c.Timeout,
+		Metrics:       metrics,
+		SecurityWorld: c.SecurityWorld,
+		Logger:        logger,
+
+		AllowUncheckedKey: c.AllowUncheckedKey,
+	})
+	if err != nil {
+		if audit != nil {
+			audit.Close()
+		}
+		return nil, err
+	}
+
+	return pv, nil
+}
+
+func splitEndpoint(endpoint string) (string, int, error) {
+	host, portString, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return "", 0, errors.WithMessage(err, "invalid HSM endpoint")
+	}
+
+	port, err := strconv.Atoi(portString)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, errors.Errorf("invalid port in HSM endpoint %q", endpoint)
+	}
+
+	return host, port, nil
+}
+
+func splitList(values []string) []string {
+	var result []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				result = append(result, item)
+			}
+		}
+	}
+	return result
+}
+
+func rootify(path, root string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(root, path)
+}
@@ -0,0 +1,213 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package config_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/require"
+	"github.com/tendermint/tmlibs/log"
+
+	"github.com/thales-e-security/tendermint-hsm-validator/config"
+	"github.com/thales-e-security/tendermint-hsm-validator/module"
+)
+
+func tempHome(t *testing.T) string {
+	home, err := ioutil.TempDir("", "hsm-config")
+	require.NoError(t, err)
+	return home
+}
+
+func writeConfig(t *testing.T, home, contents string) {
+	err := ioutil.WriteFile(filepath.Join(home, config.FileName), []byte(contents), 0644)
+	require.NoError(t, err)
+}
+
+func TestLoadDefaults(t *testing.T) {
+	home := tempHome(t)
+	defer os.RemoveAll(home)
+
+	c, err := config.Load(home, nil)
+	require.NoError(t, err)
+
+	expected := config.DefaultHsmConfig()
+	expected.RootDir = home
+	require.Equal(t, expected, c)
+	require.Equal(t, filepath.Join(home, "hsm-priv-validator.json"), c.PrivValidatorFile())
+	require.Equal(t, filepath.Join(home, "genesis.json"), c.GenesisFile())
+}
+
+func TestLoadFile(t *testing.T) {
+	home := tempHome(t)
+	defer os.RemoveAll(home)
+
+	writeConfig(t, home, `
+endpoints = ["10.0.0.5:9004"]
+timeout = "750ms"
+tls_cert_file = "tls/client.pem"
+priv_validator_file = "/etc/validator.json"
+chain_id = "my-chain"
+power = 42
+`)
+
+	c, err := config.Load(home, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"10.0.0.5:9004"}, c.Endpoints)
+	require.Equal(t, 750*time.Millisecond, c.Timeout)
+	require.Equal(t, "my-chain", c.ChainID)
+	require.Equal(t, int64(42), c.Power)
+	require.Equal(t, "/etc/validator.json", c.PrivValidatorFile())
+	require.Equal(t, filepath.Join(home, "tls/client.pem"), c.TLSOptions().CertFile)
+
+	hsm, err := c.NewHsm(log.NewNopLogger(), module.NopMetrics())
+	require.Error(t, err, "the TLS material does not exist")
+	require.Nil(t, hsm)
+}
+
+func TestEnvAndFlagsOverrideFile(t *testing.T) {
+	home := tempHome(t)
+	defer os.RemoveAll(home)
+
+	writeConfig(t, home, `
+chain_id = "from-file"
+power = 1
+timeout = "1s"
+`)
+
+	os.Setenv("TM_HSM_CHAIN_ID", "from-env")
+	os.Setenv("TM_HSM_POWER", "2")
+	defer os.Unsetenv("TM_HSM_CHAIN_ID")
+	defer os.Unsetenv("TM_HSM_POWER")
+
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	config.AddFlags(flags)
+	require.NoError(t, flags.Parse([]string{"--hsm.power", "3"}))
+
+	c, err := config.Load(home, flags)
+	require.NoError(t, err)
+	require.Equal(t, "from-env", c.ChainID)
+	require.Equal(t, int64(3), c.Power)
+	require.Equal(t, time.Second, c.Timeout, "unset flags must not override the file")
+}
+
+func TestEndpointsFromEnv(t *testing.T) {
+	home := tempHome(t)
+	defer os.RemoveAll(home)
+
+	os.Setenv("TM_HSM_ENDPOINTS", "10.0.0.5:9004")
+	defer os.Unsetenv("TM_HSM_ENDPOINTS")
+
+	c, err := config.Load(home, nil)
+	require.NoError(t, err)
+
+	hsm, err := c.NewHsm(log.NewNopLogger(), module.NopMetrics())
+	require.NoError(t, err)
+	defer hsm.Close()
+
+	thalesHsm, ok := hsm.(*module.ThalesHSM)
+	require.True(t, ok)
+	require.Equal(t, "10.0.0.5", thalesHsm.Host)
+	require.Equal(t, 9004, thalesHsm.Port)
+}
+
+func TestMultipleEndpoints(t *testing.T) {
+	home := tempHome(t)
+	defer os.RemoveAll(home)
+
+	writeConfig(t, home, `
+endpoints = ["10.0.0.5:9004", "10.0.0.6:9004"]
+health_check_interval = "0s"
+`)
+
+	c, err := config.Load(home, nil)
+	require.NoError(t, err)
+
+	hsm, err := c.NewHsm(log.NewNopLogger(), module.NopMetrics())
+	require.NoError(t, err)
+	defer hsm.Close()
+
+	failover, ok := hsm.(*module.FailoverHSM)
+	require.True(t, ok)
+	require.Equal(t, "10.0.0.5:9004", failover.Active())
+	require.Len(t, failover.Endpoints(), 2)
+}
+
+func TestInvalidConfig(t *testing.T) {
+	testCases := []string{
+		`endpoints = []`,
+		`endpoints = ["10.0.0.5"]`,
+		`endpoints = ["10.0.0.5:http"]`,
+		`power = 0`,
+		`chain_id = ""`,
+		`timeout = "-1s"`,
+		`priv_validator_backups = -1`,
+		`audit_key_file = "audit.key"`,
+	}
+
+	for _, tc := range testCases {
+		home := tempHome(t)
+		writeConfig(t, home, tc)
+
+		_, err := config.Load(home, nil)
+		require.Error(t, err, tc)
+
+		os.RemoveAll(home)
+	}
+}
+
+func TestWriteConfigFileRoundTrip(t *testing.T) {
+	home := tempHome(t)
+	defer os.RemoveAll(home)
+
+	c := config.DefaultHsmConfig()
+	c.RootDir = home
+	c.Endpoints = []string{"10.0.0.5:9004"}
+	c.TLSPinnedCerts = []string{"ab:cd", "ef01"}
+	c.ChainID = "round-trip"
+	c.SecurityWorld = "world-1"
+	c.PrivValidatorBackups = 3
+	c.AuditLog = "audit/hsm-validator.jsonl"
+	c.AuditKeyFile = "/etc/hsm/audit.key"
+	c.MinWireVersion = 1
+	c.AllowUncheckedKey = true
+
+	path, err := config.EnsureConfigFile(c)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(home, config.FileName), path)
+
+	loaded, err := config.Load(home, nil)
+	require.NoError(t, err)
+	require.Equal(t, c, loaded)
+
+	// An existing file is left alone
+	other := config.DefaultHsmConfig()
+	other.RootDir = home
+	_, err = config.EnsureConfigFile(other)
+	require.NoError(t, err)
+
+	loaded, err = config.Load(home, nil)
+	require.NoError(t, err)
+	require.Equal(t, "round-trip", loaded.ChainID)
+}
@@ -0,0 +1,125 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package config
+
+import (
+	"bytes"
+	"path/filepath"
+	"text/template"
+
+	"github.com/pkg/errors"
+	cmn "github.com/tendermint/tmlibs/common"
+)
+
+var configTemplate = template.Must(template.New("hsm.toml").Parse(`# This is a TOML config file for the hsm-validator commands.
+# For more information, see https://github.com/toml-lang/toml
+#
+# Every setting may be overridden by an environment variable, such as
+# TM_HSM_CHAIN_ID, or a flag, such as --hsm.chain_id.
+
+# CodeSafe machine addresses, as host:port, in order of preference. If
+# more than one is given, signing fails over between them.
+endpoints = [{{range $i, $e := .Endpoints}}{{if $i}}, {{end}}"{{$e}}"{{end}}]
+
+# How often to check that each CodeSafe machine is reachable, if there are
+# several, or "0s" to only switch machine when a job fails
+health_check_interval = "{{.HealthCheckInterval}}"
+
+# Maximum connections held open to each CodeSafe machine
+max_connections = {{.MaxConnections}}
+
+# Oldest wire protocol version accepted from a CodeSafe machine. Machines
+# speaking version 1 cannot report their loaded key or signed state, so are
+# refused unless this is 1 and allow_unchecked_key is set
+min_wire_version = {{.MinWireVersion}}
+
+# Use CodeSafe machines that cannot report their loaded key, without binding
+# it to the public key in the private validator file. An error is logged
+# each time the check is skipped
+allow_unchecked_key = {{.AllowUncheckedKey}}
+
+# Time limit for each HSM operation, or "0s" for none
+timeout = "{{.Timeout}}"
+
+# TLS material, relative to the home directory. Leave tls_cert_file empty
+# to connect without TLS. Either tls_ca_file or tls_pinned_certs (hex
+# SHA-256 fingerprints) must be set to authenticate the CodeSafe machine.
+tls_cert_file = "{{.TLSCertFile}}"
+tls_key_file = "{{.TLSKeyFile}}"
+tls_ca_file = "{{.TLSCAFile}}"
+tls_server_name = "{{.TLSServerName}}"
+tls_pinned_certs = [{{range $i, $e := .TLSPinnedCerts}}{{if $i}}, {{end}}"{{$e}}"{{end}}]
+
+# Files written by hsm-validator-init, relative to the home directory
+priv_validator_file = "{{.PrivValidator}}"
+genesis_file = "{{.Genesis}}"
+
+# Number of previous private validator files kept, as <file>.1, <file>.2, ...
+# when the file is rewritten
+priv_validator_backups = {{.PrivValidatorBackups}}
+
+# Audit log recording every signature requested and every key loaded or
+# generated, relative to the home directory. Leave empty to disable.
+audit_log_file = "{{.AuditLog}}"
+
+# File holding at least 32 random bytes, e.g. from "head -c 32 /dev/urandom",
+# used to key the audit log's hashes so that it cannot be rewritten without
+# the key. It must not be in the same directory as the log, and should not be
+# writable by the validator. Leave empty to leave the log unkeyed, which only
+# detects accidental damage
+audit_key_file = "{{.AuditKeyFile}}"
+
+# Genesis settings used by hsm-validator-init
+chain_id = "{{.ChainID}}"
+power = {{.Power}}
+
+# Identifier of the HSMs' Security World, recorded in the private validator
+# file by hsm-validator-init and checked when it is loaded, if set
+security_world = "{{.SecurityWorld}}"
+
+# Address to serve Prometheus metrics on, under /metrics, e.g. ":26660".
+# Metrics are disabled if empty.
+metrics_laddr = "{{.MetricsListenAddr}}"
+`))
+
+// WriteConfigFile writes config to path in TOML format.
+func WriteConfigFile(path string, config *HsmConfig) error {
+	var buffer bytes.Buffer
+	if err := configTemplate.Execute(&buffer, config); err != nil {
+		return errors.WithMessage(err, "failed to render configuration")
+	}
+
+	return cmn.WriteFile(path, buffer.Bytes(), 0644)
+}
+
+// EnsureConfigFile writes config to hsm.toml in its home directory, unless
+// the file already exists. It returns the path to the file.
+func EnsureConfigFile(config *HsmConfig) (string, error) {
+	if err := cmn.EnsureDir(config.RootDir, 0700); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(config.RootDir, FileName)
+	if cmn.FileExists(path) {
+		return path, nil
+	}
+
+	return path, WriteConfigFile(path, config)
+}
@@ -1,5 +1,5 @@
 // Code generated by MockGen. DO NOT EDIT.
-// Source: github.com/thales-e-security/tendermint-hsm-validator/validator (interfaces: Hsm)
+// Source: github.com/thales-e-security/tendermint-hsm-validator/mocks (interfaces: Hsm)
 
 // Package mocks is a generated GoMock package.
 package mocks
@@ -36,6 +36,19 @@ func (m *MockHsm) EXPECT() *MockHsmMockRecorder {
 	return m.recorder
 }
 
+// ExportState mocks base method
+func (m *MockHsm) ExportState() (validator.SignedState, error) {
+	ret := m.ctrl.Call(m, "ExportState")
+	ret0, _ := ret[0].(validator.SignedState)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ExportState indicates an expected call of ExportState
+func (mr *MockHsmMockRecorder) ExportState() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ExportState", reflect.TypeOf((*MockHsm)(nil).ExportState))
+}
+
 // GenerateKey mocks base method
 func (m *MockHsm) GenerateKey() (validator.Ed25519KeyPair, error) {
 	ret := m.ctrl.Call(m, "GenerateKey")
@@ -61,6 +74,31 @@ func (mr *MockHsmMockRecorder) LoadKeys(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LoadKeys", reflect.TypeOf((*MockHsm)(nil).LoadKeys), arg0)
 }
 
+// PublicKey mocks base method
+func (m *MockHsm) PublicKey() (validator.LoadedKey, error) {
+	ret := m.ctrl.Call(m, "PublicKey")
+	ret0, _ := ret[0].(validator.LoadedKey)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// PublicKey indicates an expected call of PublicKey
+func (mr *MockHsmMockRecorder) PublicKey() *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "PublicKey", reflect.TypeOf((*MockHsm)(nil).PublicKey))
+}
+
+// SeedState mocks base method
+func (m *MockHsm) SeedState(arg0 int64, arg1 int, arg2 int8) error {
+	ret := m.ctrl.Call(m, "SeedState", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SeedState indicates an expected call of SeedState
+func (mr *MockHsmMockRecorder) SeedState(arg0, arg1, arg2 interface{}) *gomock.Call {
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SeedState", reflect.TypeOf((*MockHsm)(nil).SeedState), arg0, arg1, arg2)
+}
+
 // SignHeartbeat mocks base method
 func (m *MockHsm) SignHeartbeat(arg0 string, arg1 *types.Heartbeat) ([]byte, error) {
 	ret := m.ctrl.Call(m, "SignHeartbeat", arg0, arg1)
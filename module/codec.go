@@ -0,0 +1,417 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package module
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// The codec encodes the request and response of each job from a Go struct,
+// using the primitives in marshall.go, such as marshallBytes and
+// marshallString. Each field to be encoded has a tag giving its position in
+// the job, counting from 1, and optionally its width and whether it is
+// optional:
+//
+//	type statusResponse struct {
+//		Version string `wire:"1"`
+//		Height  int64  `wire:"2"`
+//		Round   int    `wire:"3,32"`
+//		Uptime  int64  `wire:"4,optional"`
+//	}
+//
+// Fields are encoded in order of position, whatever their order in the
+// struct. Every exported field must be tagged; a tag of "-" leaves it out.
+//
+//   - Integers, of any signed type or uint8, are 32-bit words unless a width
+//     of 64 is given. int64 defaults to 64 bits. Values that do not fit in
+//     the width are refused, rather than truncated.
+//   - bool is a 32-bit word, 0 or 1.
+//   - string is a NUL-terminated byte string.
+//   - []byte, and [N]byte, are a length word followed by the bytes, padded
+//     to a whole number of words. A [N]byte must arrive with N bytes.
+//   - Other fixed arrays are their N elements in turn, with no length.
+//   - Nested structs are their fields in turn.
+//
+// An optional field may be missing from the end of a response, e.g. because
+// the module predates it, and is then left as its zero value. Optional fields
+// must follow all the others, and cannot appear in nested structs.
+
+// wireField describes how one struct field is encoded.
+type wireField struct {
+	index    int
+	name     string
+	position int
+	width    int
+	optional bool
+}
+
+// structCodec lists the fields of a struct in the order they are encoded.
+type structCodec struct {
+	fields []wireField
+}
+
+// codecs caches a *structCodec for each struct type used.
+var codecs sync.Map
+
+// marshallStruct encodes v, a struct or a pointer to one, as described above.
+func marshallStruct(v interface{}) (io.Reader, error) {
+	value := reflect.Indirect(reflect.ValueOf(v))
+	if value.Kind() != reflect.Struct {
+		return nil, errors.Errorf("cannot marshall %T, expected a struct", v)
+	}
+
+	buffer := new(bytes.Buffer)
+	err := marshallStructValue(value, buffer)
+	return buffer, err
+}
+
+// unmarshallStruct decodes data into v, a pointer to a struct. All of data
+// must be consumed.
+func unmarshallStruct(data []byte, v interface{}) error {
+	ptr := reflect.ValueOf(v)
+	if ptr.Kind() != reflect.Ptr || ptr.Elem().Kind() != reflect.Struct {
+		return errors.Errorf("cannot unmarshall into %T, expected a pointer to a struct", v)
+	}
+
+	in := bytes.NewReader(data)
+	err := unmarshallStructValue(ptr.Elem(), in)
+	if err != nil {
+		return err
+	}
+
+	if in.Len() > 0 {
+		return errors.Errorf("%d unexpected bytes after %s", in.Len(), ptr.Elem().Type())
+	}
+	return nil
+}
+
+func marshallStructValue(value reflect.Value, out *bytes.Buffer) error {
+	codec, err := codecFor(value.Type())
+	if err != nil {
+		return err
+	}
+
+	for _, field := range codec.fields {
+		err = marshallValue(value.Field(field.index), field.width, out)
+		if err != nil {
+			return errors.WithMessage(err, "failed to marshall "+value.Type().String()+"."+field.name)
+		}
+	}
+	return nil
+}
+
+func unmarshallStructValue(value reflect.Value, in *bytes.Reader) error {
+	codec, err := codecFor(value.Type())
+	if err != nil {
+		return err
+	}
+
+	for _, field := range codec.fields {
+		if field.optional && in.Len() == 0 {
+			return nil
+		}
+
+		err = unmarshallValue(value.Field(field.index), field.width, in)
+		if err != nil {
+			return errors.WithMessage(err, "failed to unmarshall "+value.Type().String()+"."+field.name)
+		}
+	}
+	return nil
+}
+
+func marshallValue(value reflect.Value, width int, out *bytes.Buffer) error {
+	switch value.Kind() {
+	case reflect.Bool:
+		var word int32
+		if value.Bool() {
+			word = 1
+		}
+		return marshallInt(word, out)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return marshallInteger(value.Int(), width, out)
+
+	case reflect.Uint8:
+		return marshallInteger(int64(value.Uint()), width, out)
+
+	case reflect.String:
+		return marshallString(value.String(), out)
+
+	case reflect.Slice:
+		return marshallBytes(value.Bytes(), out)
+
+	case reflect.Array:
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			return marshallBytes(arrayBytes(value), out)
+		}
+		for i := 0; i < value.Len(); i++ {
+			err := marshallValue(value.Index(i), width, out)
+			if err != nil {
+				return errors.WithMessage(err, "element "+strconv.Itoa(i))
+			}
+		}
+		return nil
+
+	case reflect.Struct:
+		return marshallStructValue(value, out)
+	}
+
+	return errors.Errorf("unsupported type %s", value.Type())
+}
+
+func unmarshallValue(value reflect.Value, width int, in *bytes.Reader) error {
+	switch value.Kind() {
+	case reflect.Bool:
+		word, err := unmarshallInt(in)
+		if err != nil {
+			return err
+		}
+		if word != 0 && word != 1 {
+			return errors.Errorf("invalid bool %d", word)
+		}
+		value.SetBool(word == 1)
+		return nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := unmarshallInteger(width, in)
+		if err != nil {
+			return err
+		}
+		if value.OverflowInt(i) {
+			return errors.Errorf("%d does not fit in %s", i, value.Type())
+		}
+		value.SetInt(i)
+		return nil
+
+	case reflect.Uint8:
+		i, err := unmarshallInteger(width, in)
+		if err != nil {
+			return err
+		}
+		if i < 0 || value.OverflowUint(uint64(i)) {
+			return errors.Errorf("%d does not fit in %s", i, value.Type())
+		}
+		value.SetUint(uint64(i))
+		return nil
+
+	case reflect.String:
+		s, err := unmarshallString(in)
+		if err != nil {
+			return err
+		}
+		value.SetString(s)
+		return nil
+
+	case reflect.Slice:
+		b, err := unmarshallBytes(in)
+		if err != nil {
+			return err
+		}
+		value.SetBytes(b)
+		return nil
+
+	case reflect.Array:
+		if value.Type().Elem().Kind() == reflect.Uint8 {
+			b, err := unmarshallBytes(in)
+			if err != nil {
+				return err
+			}
+			if len(b) != value.Len() {
+				return errors.Errorf("expected %d bytes, found %d", value.Len(), len(b))
+			}
+			reflect.Copy(value, reflect.ValueOf(b))
+			return nil
+		}
+		for i := 0; i < value.Len(); i++ {
+			err := unmarshallValue(value.Index(i), width, in)
+			if err != nil {
+				return errors.WithMessage(err, "element "+strconv.Itoa(i))
+			}
+		}
+		return nil
+
+	case reflect.Struct:
+		return unmarshallStructValue(value, in)
+	}
+
+	return errors.Errorf("unsupported type %s", value.Type())
+}
+
+// marshallInteger writes i as a word of the given width in bits.
+func marshallInteger(i int64, width int, out io.Writer) error {
+	if width == 64 {
+		return marshallInt64(i, out)
+	}
+	if i < math.MinInt32 || i > math.MaxInt32 {
+		return errors.Errorf("%d does not fit in 32 bits", i)
+	}
+	return marshallInt(int32(i), out)
+}
+
+// unmarshallInteger reads a word of the given width in bits.
+func unmarshallInteger(width int, in io.Reader) (int64, error) {
+	if width == 64 {
+		return unmarshallInt64(in)
+	}
+	i, err := unmarshallInt(in)
+	return int64(i), err
+}
+
+// arrayBytes returns the contents of a byte array, which may not be
+// addressable.
+func arrayBytes(array reflect.Value) []byte {
+	b := make([]byte, array.Len())
+	reflect.Copy(reflect.ValueOf(b), array)
+	return b
+}
+
+// codecFor returns the codec for the struct type t, building it from the
+// field tags on first use.
+func codecFor(t reflect.Type) (*structCodec, error) {
+	if codec, ok := codecs.Load(t); ok {
+		return codec.(*structCodec), nil
+	}
+
+	codec, err := newStructCodec(t)
+	if err != nil {
+		return nil, err
+	}
+
+	codecs.Store(t, codec)
+	return codec, nil
+}
+
+// newStructCodec parses the field tags of the struct type t, and checks that
+// each field can be encoded.
+func newStructCodec(t reflect.Type) (*structCodec, error) {
+	codec := &structCodec{}
+	positions := make(map[int]string)
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, tagged := f.Tag.Lookup("wire")
+		if tag == "-" || (f.PkgPath != "" && !tagged) {
+			continue
+		}
+		if !tagged {
+			return nil, errors.Errorf("%s.%s has no wire tag", t, f.Name)
+		}
+
+		field, err := parseWireTag(tag, f)
+		if err != nil {
+			return nil, errors.WithMessage(err, "invalid wire tag on "+t.String()+"."+f.Name)
+		}
+		field.index = i
+
+		if other, ok := positions[field.position]; ok {
+			return nil, errors.Errorf("%s.%s and %s.%s are both at position %d",
+				t, other, t, f.Name, field.position)
+		}
+		positions[field.position] = f.Name
+
+		err = checkWireType(f.Type)
+		if err != nil {
+			return nil, errors.WithMessage(err, "cannot encode "+t.String()+"."+f.Name)
+		}
+
+		codec.fields = append(codec.fields, field)
+	}
+
+	sort.Slice(codec.fields, func(i, j int) bool {
+		return codec.fields[i].position < codec.fields[j].position
+	})
+
+	for i := 1; i < len(codec.fields); i++ {
+		if codec.fields[i-1].optional && !codec.fields[i].optional {
+			return nil, errors.Errorf("%s.%s must be optional, as it follows optional %s.%s",
+				t, codec.fields[i].name, t, codec.fields[i-1].name)
+		}
+	}
+
+	return codec, nil
+}
+
+// parseWireTag parses the tag "position[,32|,64][,optional]" on f.
+func parseWireTag(tag string, f reflect.StructField) (wireField, error) {
+	field := wireField{name: f.Name, width: 32}
+	if f.Type.Kind() == reflect.Int64 {
+		field.width = 64
+	}
+
+	options := strings.Split(tag, ",")
+	position, err := strconv.Atoi(options[0])
+	if err != nil || position < 1 {
+		return field, errors.Errorf("position %q is not a positive number", options[0])
+	}
+	field.position = position
+
+	for _, option := range options[1:] {
+		switch option {
+		case "32", "64":
+			field.width, _ = strconv.Atoi(option)
+		case "optional":
+			field.optional = true
+		default:
+			return field, errors.Errorf("unknown option %q", option)
+		}
+	}
+
+	return field, nil
+}
+
+// checkWireType returns an error if fields of type t cannot be encoded. The
+// codecs of nested structs are built, so that their tags are checked too, and
+// must have no optional fields. This is checked here rather than when the
+// codec is built, as the same struct may also be used on its own.
+func checkWireType(t reflect.Type) error {
+	switch t.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint8:
+		return nil
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return nil
+		}
+	case reflect.Array:
+		return checkWireType(t.Elem())
+	case reflect.Struct:
+		codec, err := codecFor(t)
+		if err != nil {
+			return err
+		}
+		for _, field := range codec.fields {
+			if field.optional {
+				return errors.Errorf("%s.%s is optional, but %s is nested in another struct", t, field.name, t)
+			}
+		}
+		return nil
+	}
+	return errors.Errorf("unsupported type %s", t)
+}
@@ -0,0 +1,345 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package module
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// jobVectors are the encodings of each job, as the CodeSafe machine expects
+// them. Integers are little-endian, and byte strings are preceded by their
+// length and padded to a multiple of four bytes.
+var jobVectors = []struct {
+	name   string
+	value  interface{}
+	golden string
+}{
+	{
+		name:   "key load request",
+		value:  &keyLoadRequest{WrappedKey: []byte{1, 2, 3, 4, 5}},
+		golden: "05000000" + "0102030405" + "000000",
+	},
+	{
+		name: "key gen response",
+		value: &keyGenResponse{
+			PublicKey:  fill32(0xaa),
+			WrappedKey: fill64(0xbb),
+		},
+		golden: "20000000" + strings.Repeat("aa", 32) +
+			"40000000" + strings.Repeat("bb", 64),
+	},
+	{
+		name: "status response",
+		value: &statusResponse{
+			Version:   "1.2",
+			KeyLoaded: true,
+			Height:    10,
+			Round:     2,
+			Step:      3,
+		},
+		golden: "04000000" + "312e3200" + // version
+			"01000000" + // key loaded
+			"0a00000000000000" + // height
+			"02000000" + // round
+			"03000000", // step
+	},
+	{
+		name:  "public key response",
+		value: &publicKeyResponse{PublicKey: fill32(0xaa), KeyID: []byte("key1")},
+		golden: "20000000" + strings.Repeat("aa", 32) +
+			"04000000" + "6b657931",
+	},
+	{
+		name: "export state response",
+		value: &exportStateResponse{
+			Height:    10,
+			Round:     2,
+			Step:      3,
+			PublicKey: bytes.Repeat([]byte{0xaa}, 32),
+			Signature: bytes.Repeat([]byte{0xcc}, 64),
+		},
+		golden: "0a00000000000000" + "02000000" + "03000000" +
+			"20000000" + strings.Repeat("aa", 32) +
+			"40000000" + strings.Repeat("cc", 64),
+	},
+	{
+		name:   "seed state request",
+		value:  &seedStateRequest{Height: 10, Round: 2, Step: 3},
+		golden: "0a00000000000000" + "02000000" + "03000000",
+	},
+	{
+		name: "sign vote request",
+		value: &signVoteRequest{
+			ChainID: "test-chain",
+			BlockID: blockID{
+				Hash:  bytes.Repeat([]byte{0x11}, 20),
+				Parts: partSetHeader{Hash: bytes.Repeat([]byte{0x22}, 20), Total: 1},
+			},
+			Height:    10,
+			Round:     2,
+			Timestamp: "2018-02-01T12:00:00.000Z",
+			Type:      1,
+		},
+		golden: "0b000000" + "746573742d636861696e00" + "00" + // chain ID
+			"14000000" + strings.Repeat("11", 20) + // block hash
+			"14000000" + strings.Repeat("22", 20) + // parts hash
+			"01000000" + // parts total
+			"0a00000000000000" + // height
+			"02000000" + // round
+			"19000000" + "323031382d30322d30315431323a30303a30302e3030305a00" + "000000" + // timestamp
+			"01000000", // type
+	},
+	{
+		name: "sign proposal request",
+		value: &signProposalRequest{
+			ChainID:    "test-chain",
+			BlockParts: partSetHeader{Hash: bytes.Repeat([]byte{0x22}, 20), Total: 1},
+			Height:     10,
+			POL:        blockID{Hash: []byte{}, Parts: partSetHeader{Hash: []byte{}}},
+			POLRound:   -1,
+			Round:      2,
+			Timestamp:  "2018-02-01T12:00:00.000Z",
+		},
+		golden: "0b000000" + "746573742d636861696e00" + "00" + // chain ID
+			"14000000" + strings.Repeat("22", 20) + // parts hash
+			"01000000" + // parts total
+			"0a00000000000000" + // height
+			"00000000" + "00000000" + "00000000" + // POL block ID
+			"ffffffff" + // POL round
+			"02000000" + // round
+			"19000000" + "323031382d30322d30315431323a30303a30302e3030305a00" + "000000", // timestamp
+	},
+	{
+		name: "sign heartbeat request",
+		value: &signHeartbeatRequest{
+			ChainID:          "test-chain",
+			Height:           10,
+			Round:            2,
+			Sequence:         7,
+			ValidatorAddress: bytes.Repeat([]byte{0x33}, 20),
+			ValidatorIndex:   4,
+		},
+		golden: "0b000000" + "746573742d636861696e00" + "00" + // chain ID
+			"0a00000000000000" + // height
+			"02000000" + // round
+			"07000000" + // sequence
+			"14000000" + strings.Repeat("33", 20) + // validator address
+			"04000000", // validator index
+	},
+	{
+		name:   "sign response",
+		value:  &signResponse{Signature: fill64(0xdd)},
+		golden: "40000000" + strings.Repeat("dd", 64),
+	},
+	{
+		name:   "hello request",
+		value:  &helloRequest{MinVersion: 1, MaxVersion: 3},
+		golden: "01000000" + "03000000",
+	},
+	{
+		name:   "hello response",
+		value:  &helloResponse{Version: 3, Jobs: []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}},
+		golden: "03000000" + "0a000000" + "00010203040506070809" + "0000",
+	},
+}
+
+func fill32(b byte) (a [32]byte) {
+	for i := range a {
+		a[i] = b
+	}
+	return
+}
+
+func fill64(b byte) (a [64]byte) {
+	for i := range a {
+		a[i] = b
+	}
+	return
+}
+
+func TestJobVectors(t *testing.T) {
+	for _, vector := range jobVectors {
+		t.Run(vector.name, func(t *testing.T) {
+			golden, err := hex.DecodeString(vector.golden)
+			require.NoError(t, err)
+
+			buffer, err := marshallStruct(vector.value)
+			require.NoError(t, err)
+			data, err := ioutil.ReadAll(buffer)
+			require.NoError(t, err)
+			require.Equal(t, vector.golden, hex.EncodeToString(data))
+
+			decoded := reflect.New(reflect.TypeOf(vector.value).Elem()).Interface()
+			err = unmarshallStruct(golden, decoded)
+			require.NoError(t, err)
+			require.Equal(t, vector.value, decoded)
+		})
+	}
+}
+
+func TestCodecRejectsBadStructs(t *testing.T) {
+	for name, value := range map[string]interface{}{
+		"untagged field": &struct {
+			A int `wire:"1"`
+			B int
+		}{},
+		"duplicate position": &struct {
+			A int `wire:"1"`
+			B int `wire:"1"`
+		}{},
+		"bad position": &struct {
+			A int `wire:"first"`
+		}{},
+		"unknown option": &struct {
+			A int `wire:"1,16"`
+		}{},
+		"unsupported type": &struct {
+			A float64 `wire:"1"`
+		}{},
+		"optional not last": &struct {
+			A int `wire:"1,optional"`
+			B int `wire:"2"`
+		}{},
+		"nested optional": &struct {
+			A struct {
+				B int `wire:"1,optional"`
+			} `wire:"1"`
+		}{},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := marshallStruct(value)
+			require.Error(t, err)
+
+			err = unmarshallStruct(nil, value)
+			require.Error(t, err)
+		})
+	}
+}
+
+// optionalInner has an optional field, so may be used on its own but not
+// nested in another struct.
+type optionalInner struct {
+	A int32 `wire:"1"`
+	B int32 `wire:"2,optional"`
+}
+
+type optionalOuter struct {
+	Inner optionalInner `wire:"1"`
+}
+
+// optionalInnerFirst and optionalOuterFirst are the same as optionalInner and
+// optionalOuter, so that the codecs can be built in the other order.
+type optionalInnerFirst optionalInner
+
+type optionalOuterFirst struct {
+	Inner optionalInnerFirst `wire:"1"`
+}
+
+func TestCodecNestedOptionalInEitherOrder(t *testing.T) {
+	// The inner struct is used on its own first
+	_, err := marshallStruct(&optionalInnerFirst{A: 1})
+	require.NoError(t, err)
+	_, err = marshallStruct(&optionalOuterFirst{})
+	require.Error(t, err)
+
+	// The outer struct is used first
+	_, err = marshallStruct(&optionalOuter{})
+	require.Error(t, err)
+	_, err = marshallStruct(&optionalInner{A: 1})
+	require.NoError(t, err)
+	_, err = marshallStruct(&optionalOuter{})
+	require.Error(t, err)
+}
+
+func TestCodecFieldOrderAndWidth(t *testing.T) {
+	value := struct {
+		Skipped string   `wire:"-"`
+		Second  int      `wire:"2,64"`
+		First   int64    `wire:"1,32"`
+		Words   [2]int16 `wire:"3"`
+		Flag    bool     `wire:"4"`
+		private int
+	}{Skipped: "x", Second: 2, First: 1, Words: [2]int16{3, -4}, Flag: true}
+
+	buffer, err := marshallStruct(value)
+	require.NoError(t, err)
+	data, err := ioutil.ReadAll(buffer)
+	require.NoError(t, err)
+	require.Equal(t, "01000000"+"0200000000000000"+"03000000"+"fcffffff"+"01000000",
+		hex.EncodeToString(data))
+}
+
+func TestCodecRefusesOverflow(t *testing.T) {
+	_, err := marshallStruct(seedStateRequest{Round: math.MaxInt32 + 1})
+	require.Error(t, err)
+
+	// The step is 300, which does not fit in an int8
+	data, _ := hex.DecodeString("0a00000000000000" + "02000000" + "2c010000")
+	err = unmarshallStruct(data, &seedStateRequest{})
+	require.Error(t, err)
+
+	// A bool must be 0 or 1
+	data, _ = hex.DecodeString("04000000" + "312e3200" + "02000000" + "0a00000000000000" + "02000000" + "03000000")
+	err = unmarshallStruct(data, &statusResponse{})
+	require.Error(t, err)
+}
+
+func TestCodecChecksFixedArrayLength(t *testing.T) {
+	data, _ := hex.DecodeString("1f000000" + strings.Repeat("aa", 31) + "00")
+	err := unmarshallStruct(data, &publicKeyResponse{})
+	require.Error(t, err)
+}
+
+func TestCodecRejectsTrailingData(t *testing.T) {
+	data, _ := hex.DecodeString("01000000" + "03000000" + "00000000")
+	err := unmarshallStruct(data, &helloRequest{})
+	require.Error(t, err)
+}
+
+func TestCodecOptionalFields(t *testing.T) {
+	type response struct {
+		Height int64  `wire:"1"`
+		Uptime int64  `wire:"2,optional"`
+		Name   string `wire:"3,optional"`
+	}
+
+	var r response
+	data, _ := hex.DecodeString("0a00000000000000")
+	require.NoError(t, unmarshallStruct(data, &r))
+	require.Equal(t, response{Height: 10}, r)
+
+	r = response{}
+	data, _ = hex.DecodeString("0a00000000000000" + "0500000000000000")
+	require.NoError(t, unmarshallStruct(data, &r))
+	require.Equal(t, response{Height: 10, Uptime: 5}, r)
+
+	// Required fields may not be missing
+	data, _ = hex.DecodeString("")
+	require.Error(t, unmarshallStruct(data, &r))
+}
@@ -22,16 +22,94 @@ package module
 
 import (
 	"bytes"
-	"fmt"
+	"context"
+	"crypto/tls"
 	"io"
 	"net"
+	"os"
+	"syscall"
+	"time"
 )
 
-// sendJobToModule sends job data to the module. If the module responds with an error message, this is returned
-// in `error`, otherwise the job response is returned as a byte slice. Generally this response requires further
-/// unmarshalling (e.g. if it contains binary data)
-func sendJobToModule(jobNumber int32, marshalledData io.Reader, ipAddress string, portnumber int) ([]byte, error) {
+// aLongTimeAgo is a deadline in the past, used to interrupt blocked reads and writes.
+var aLongTimeAgo = time.Unix(1, 0)
 
+// sendJobToModule sends job data to the module, using a connection from pool. If the module responds
+// with an error message, this is returned in `error`, otherwise the job response is returned as a byte
+// slice. Generally this response requires further unmarshalling (e.g. if it contains binary data). If
+// ctx expires before the module responds, the context error is returned. If the
+// module did not list the job when the connection was opened, an
+// *UnsupportedJobError is returned without sending it.
+func sendJobToModule(ctx context.Context, jobNumber int32, marshalledData io.Reader, pool *connPool) ([]byte, error) {
+	request, err := jobFrame(jobNumber, marshalledData)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		conn, reused, err := pool.get(ctx)
+		if err != nil {
+			if err == errPoolClosed || ctx.Err() != nil {
+				return nil, err
+			}
+			return nil, &connectionError{err: err}
+		}
+
+		if mc, ok := conn.(*moduleConn); ok && !mc.protocol.supports(jobNumber) {
+			pool.put(conn)
+			return nil, &UnsupportedJobError{Job: jobName(jobNumber), Version: mc.protocol.Version}
+		}
+
+		// A job written to a connection the module has already closed may be
+		// accepted by the network and then lost, so check before sending.
+		if reused && idleConnClosed(conn) {
+			pool.discard(conn)
+			continue
+		}
+
+		response, sent, err := exchangeFrames(ctx, conn, request)
+		if err != nil {
+			pool.discard(conn)
+
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+
+			// The connection deadline can fire fractionally before the context
+			// notices that it has expired.
+			if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+				return nil, context.DeadlineExceeded
+			}
+
+			// The module may have dropped an idle connection. If writing the job
+			// failed, the module cannot have received all of it, so it is safe to
+			// send again on a fresh connection. Once it has been written, the
+			// module may have processed it before the connection dropped, and a
+			// second copy of a signing job would be rejected as a regression.
+			if reused && !sent && isStaleConnection(err) {
+				continue
+			}
+			return nil, &connectionError{err: err, sent: sent}
+		}
+
+		if mc, ok := conn.(*moduleConn); ok && mc.protocol.Version == WireVersion1 {
+			// Modules that predate the hello job close each connection after
+			// replying, so it cannot be reused.
+			pool.discard(conn)
+		} else {
+			pool.put(conn)
+		}
+		result, err := unmarshallModuleReponse(response)
+		if _, ok := err.(*ModuleError); err != nil && !ok {
+			return nil, &responseError{err: err}
+		}
+		return result, err
+	}
+}
+
+// jobFrame builds the contents of the request frame for a job: the job number,
+// followed by its marshalled data.
+func jobFrame(jobNumber int32, marshalledData io.Reader) ([]byte, error) {
 	buffer := new(bytes.Buffer)
 	err := marshallInt(jobNumber, buffer)
 	if err != nil {
@@ -43,36 +121,115 @@ func sendJobToModule(jobNumber int32, marshalledData io.Reader, ipAddress string
 		return nil, err
 	}
 
-	// Note: this is not aligned to four bytes, as a marshalled byte array would be
-	bufferWithLength := new(bytes.Buffer)
-	err = marshallInt(int32(buffer.Len()), bufferWithLength)
+	return buffer.Bytes(), nil
+}
+
+// connectionError reports a failure to exchange a job with the module, as
+// opposed to an error returned by the module itself. If sent is false, the
+// job is known not to have reached the module.
+type connectionError struct {
+	err  error
+	sent bool
+}
+
+func (e *connectionError) Error() string {
+	return e.err.Error()
+}
+
+// Cause returns the underlying network error.
+func (e *connectionError) Cause() error {
+	return e.err
+}
+
+// responseError reports a response from the module that could not be
+// decoded. The module was reached, and may have processed the job.
+type responseError struct {
+	err error
+}
+
+func (e *responseError) Error() string {
+	return e.err.Error()
+}
+
+// exchangeFrames writes a request frame to conn and reads back the contents of a
+// single response frame. The exchange is bounded by the deadline of ctx and
+// abandoned if ctx is cancelled. The sent result reports whether the request
+// was written in full, and so may have been processed by the module.
+func exchangeFrames(ctx context.Context, conn net.Conn, request []byte) (response []byte, sent bool, err error) {
+	deadline, _ := ctx.Deadline()
+	err = conn.SetDeadline(deadline)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
-	_, err = buffer.WriteTo(bufferWithLength)
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(aLongTimeAgo)
+		case <-stop:
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-stopped
+	}()
+
+	err = NewFrameWriter(conn).WriteFrame(request)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
-	address := fmt.Sprintf("%s:%d", ipAddress, portnumber)
+	response, err = NewFrameReader(conn).ReadFrame()
+	return response, true, err
+}
 
-	conn, err := net.Dial("tcp", address)
-	if err != nil {
-		return nil, err
+// idleConnClosed reports whether the module has closed the idle connection
+// conn. No reply is outstanding on an idle connection, so anything waiting to
+// be read from it also means that it cannot be used.
+func idleConnClosed(conn net.Conn) bool {
+	for {
+		switch c := conn.(type) {
+		case *moduleConn:
+			conn = c.Conn
+			continue
+		case *tls.Conn:
+			conn = c.NetConn()
+			continue
+		}
+		break
 	}
-	defer conn.Close()
 
-	_, err = bufferWithLength.WriteTo(conn)
-	if err != nil {
-		return nil, err
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return false
 	}
 
-	result := new(bytes.Buffer)
-	_, err = result.ReadFrom(conn)
+	raw, err := sc.SyscallConn()
 	if err != nil {
-		return nil, err
+		return true
+	}
+	return peerClosed(raw)
+}
+
+// isStaleConnection reports whether err indicates that the peer closed the
+// connection before any part of the response was received.
+func isStaleConnection(err error) bool {
+	if err == io.EOF {
+		return true
+	}
+
+	opErr, ok := err.(*net.OpError)
+	if !ok {
+		return false
+	}
+
+	sysErr, ok := opErr.Err.(*os.SyscallError)
+	if !ok {
+		return false
 	}
 
-	return unmarshallModuleReponse(result)
+	return sysErr.Err == syscall.ECONNRESET || sysErr.Err == syscall.EPIPE
 }
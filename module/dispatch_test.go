@@ -0,0 +1,391 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package module
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"github.com/tendermint/tendermint/types"
+)
+
+// testModule is a minimal stand-in for the CodeSafe machine, which answers
+// every job with handler.
+type testModule struct {
+	listener net.Listener
+	// handler answers each job other than hello. If it returns nil, the
+	// module hangs up without replying.
+	handler  func(job int32, body io.Reader) []byte
+	accepted int32
+
+	// hangUp makes the module close each connection after replying, as older
+	// CodeSafe machines do.
+	hangUp bool
+
+	// helloResponse, if set, is sent in response to the hello job in place
+	// of agreeing MaxWireVersion.
+	helloResponse []byte
+}
+
+// newTestModule starts a testModule listening on a local port.
+func newTestModule(t *testing.T, handler func(job int32, body io.Reader) []byte) *testModule {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	return serveTestModule(listener, handler)
+}
+
+// serveTestModule starts a testModule accepting connections from listener.
+func serveTestModule(listener net.Listener, handler func(job int32, body io.Reader) []byte) *testModule {
+	m := &testModule{listener: listener, handler: handler}
+	go m.serve()
+	return m
+}
+
+func (m *testModule) serve() {
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&m.accepted, 1)
+		go m.serveConn(conn)
+	}
+}
+
+func (m *testModule) serveConn(conn net.Conn) {
+	defer conn.Close()
+	frames := NewFrameReader(conn)
+	for {
+		frame, err := frames.ReadFrame()
+		if err != nil {
+			return
+		}
+
+		body := bytes.NewReader(frame)
+		job, err := unmarshallInt(body)
+		if err != nil {
+			return
+		}
+
+		var response []byte
+		if job == seeJobHello && m.helloResponse != nil {
+			response = m.helloResponse
+		} else if job == seeJobHello {
+			response = agreeHello(MaxWireVersion)
+		} else {
+			response = m.handler(job, body)
+			if response == nil {
+				return
+			}
+		}
+
+		_, err = conn.Write(response)
+		if err != nil || m.hangUp {
+			return
+		}
+	}
+}
+
+// agreeHello answers the hello job with version, accepting every job this
+// package knows.
+func agreeHello(version int32) []byte {
+	var jobs []byte
+	for job := range jobNames {
+		jobs = append(jobs, byte(job))
+	}
+
+	payload := new(bytes.Buffer)
+	marshallInt(version, payload)
+	marshallBytes(jobs, payload)
+	return okResponse(payload.Bytes())
+}
+
+func (m *testModule) hsm() *ThalesHSM {
+	addr := m.listener.Addr().(*net.TCPAddr)
+	return &ThalesHSM{Host: addr.IP.String(), Port: addr.Port}
+}
+
+func (m *testModule) close() {
+	m.listener.Close()
+}
+
+// okResponse builds a complete response frame carrying payload.
+func okResponse(payload []byte) []byte {
+	body := new(bytes.Buffer)
+	marshallInt(seeJobResponse_OK, body)
+	marshallBytes(payload, body)
+
+	frame := new(bytes.Buffer)
+	marshallInt(int32(body.Len()), frame)
+	body.WriteTo(frame)
+	return frame.Bytes()
+}
+
+// errorResponse builds a complete error response frame carrying message.
+func errorResponse(message string) []byte {
+	body := new(bytes.Buffer)
+	marshallInt(seeJobResponse_Error, body)
+	marshallString(message, body)
+
+	frame := new(bytes.Buffer)
+	marshallInt(int32(body.Len()), frame)
+	body.WriteTo(frame)
+	return frame.Bytes()
+}
+
+// processingErrorResponse builds a complete processing error response frame.
+func processingErrorResponse(message string, code int32) []byte {
+	body := new(bytes.Buffer)
+	marshallInt(seeJobResponse_ProcessingError, body)
+	marshallString(message, body)
+	marshallInt(code, body)
+
+	frame := new(bytes.Buffer)
+	marshallInt(int32(body.Len()), frame)
+	body.WriteTo(frame)
+	return frame.Bytes()
+}
+
+// echoHandler replies with the job number, marshalled as the response payload.
+func echoHandler(job int32, body io.Reader) []byte {
+	payload := new(bytes.Buffer)
+	marshallInt(job, payload)
+	return okResponse(payload.Bytes())
+}
+
+func TestSendJobReusesConnection(t *testing.T) {
+	m := newTestModule(t, echoHandler)
+	defer m.close()
+
+	hsm := m.hsm()
+	defer hsm.Close()
+
+	for i := int32(0); i < seeJobHello; i++ {
+		result, err := sendJobToModule(context.Background(), i, new(bytes.Buffer), hsm.connections())
+		require.NoError(t, err)
+
+		job, err := unmarshallInt(bytes.NewReader(result))
+		require.NoError(t, err)
+		require.Equal(t, i, job)
+	}
+
+	require.Equal(t, int32(1), atomic.LoadInt32(&m.accepted))
+}
+
+func TestSendJobReconnectsAfterModuleDropsConnection(t *testing.T) {
+	m := newTestModule(t, echoHandler)
+	m.hangUp = true
+	m.helloResponse = errorResponse("unknown job")
+	defer m.close()
+
+	hsm := m.hsm()
+	hsm.MinVersion = WireVersion1
+	defer hsm.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := sendJobToModule(context.Background(), seeJobSignVote, new(bytes.Buffer), hsm.connections())
+		require.NoError(t, err)
+	}
+
+	// One connection is used to find that the module rejects the hello job
+	require.Equal(t, int32(4), atomic.LoadInt32(&m.accepted))
+}
+
+func TestSendJobNotRepeatedAfterModuleDropsConnection(t *testing.T) {
+	var calls int32
+	m := newTestModule(t, func(job int32, body io.Reader) []byte {
+		if atomic.AddInt32(&calls, 1) == 2 {
+			// The module processes the job, but drops the connection before replying
+			return nil
+		}
+		return echoHandler(job, body)
+	})
+	defer m.close()
+
+	hsm := m.hsm()
+	defer hsm.Close()
+
+	_, err := sendJobToModule(context.Background(), seeJobSignVote, new(bytes.Buffer), hsm.connections())
+	require.NoError(t, err)
+
+	_, err = sendJobToModule(context.Background(), seeJobSignVote, new(bytes.Buffer), hsm.connections())
+	require.Error(t, err)
+	require.True(t, mayHaveReachedModule(err))
+	require.Equal(t, int32(2), atomic.LoadInt32(&calls), "the job must not be sent again")
+}
+
+func TestSendJobConcurrently(t *testing.T) {
+	m := newTestModule(t, echoHandler)
+	defer m.close()
+
+	hsm := m.hsm()
+	hsm.MaxConnections = 2
+	defer hsm.Close()
+
+	var wg sync.WaitGroup
+	for i := int32(0); i < 20; i++ {
+		wg.Add(1)
+		go func(i int32) {
+			defer wg.Done()
+			result, err := sendJobToModule(context.Background(), i%seeJobHello, new(bytes.Buffer), hsm.connections())
+			require.NoError(t, err)
+
+			job, err := unmarshallInt(bytes.NewReader(result))
+			require.NoError(t, err)
+			require.Equal(t, i%seeJobHello, job)
+		}(i)
+	}
+	wg.Wait()
+
+	require.True(t, atomic.LoadInt32(&m.accepted) <= 2)
+}
+
+func TestSendJobAfterClose(t *testing.T) {
+	m := newTestModule(t, echoHandler)
+	defer m.close()
+
+	hsm := m.hsm()
+	require.NoError(t, hsm.Close())
+
+	_, err := sendJobToModule(context.Background(), seeJobSignVote, new(bytes.Buffer), hsm.connections())
+	require.Equal(t, errPoolClosed, err)
+}
+
+func TestSendJobDeadline(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	m := newTestModule(t, func(job int32, body io.Reader) []byte {
+		<-release
+		return echoHandler(job, body)
+	})
+	defer m.close()
+
+	hsm := m.hsm()
+	defer hsm.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := sendJobToModule(ctx, seeJobSignVote, new(bytes.Buffer), hsm.connections())
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.True(t, time.Since(start) < time.Second)
+}
+
+func TestSendJobCancelled(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	m := newTestModule(t, func(job int32, body io.Reader) []byte {
+		<-release
+		return echoHandler(job, body)
+	})
+	defer m.close()
+
+	hsm := m.hsm()
+	defer hsm.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	_, err := sendJobToModule(ctx, seeJobSignVote, new(bytes.Buffer), hsm.connections())
+	require.Equal(t, context.Canceled, err)
+}
+
+func TestSendJobCountsUndecodableResponse(t *testing.T) {
+	// The module answers with a signature that is too short
+	m := newTestModule(t, func(job int32, body io.Reader) []byte {
+		return okResponse([]byte{0, 0, 0, 1, 0xff})
+	})
+	defer m.close()
+
+	hsm := m.hsm()
+	hsm.Metrics = PrometheusMetrics("dispatch_test")
+	defer hsm.Close()
+
+	_, err := hsm.SignVote("chain", &types.Vote{Height: 1, Type: types.VoteTypePrevote})
+	require.IsType(t, &responseError{}, err)
+	require.True(t, mayHaveReachedModule(err))
+	require.False(t, isModuleFailure(err))
+
+	families, err := stdprometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+
+	values := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			labels := family.GetName()
+			for _, pair := range metric.Label {
+				labels += " " + pair.GetName() + "=" + pair.GetValue()
+			}
+			values[labels] = metric.GetCounter().GetValue() + metric.GetGauge().GetValue()
+		}
+	}
+
+	require.Equal(t, 1.0, values["dispatch_test_hsm_job_errors_total class=response job=sign_vote"])
+	require.Equal(t, 1.0, values["dispatch_test_hsm_up addr="+hsm.address()])
+}
+
+func TestStatusOnlyAskedForUnknownRefusals(t *testing.T) {
+	var code, statusJobs int32
+	m := newTestModule(t, func(job int32, body io.Reader) []byte {
+		if job == seeJobStatus {
+			atomic.AddInt32(&statusJobs, 1)
+			payload, err := marshallStruct(&statusResponse{KeyLoaded: false})
+			require.NoError(t, err)
+			data := new(bytes.Buffer)
+			data.ReadFrom(payload)
+			return okResponse(data.Bytes())
+		}
+		return processingErrorResponse("refused", atomic.LoadInt32(&code))
+	})
+	defer m.close()
+
+	hsm := m.hsm()
+	defer hsm.Close()
+	vote := &types.Vote{Height: 1, Type: types.VoteTypePrevote}
+
+	// The code gives the reason, so the status job is not needed
+	for _, c := range []int32{CodeHeightRegression, CodeKeyNotLoaded, CodeBadSignatureInput} {
+		atomic.StoreInt32(&code, c)
+		_, err := hsm.SignVote("chain", vote)
+		require.Error(t, err)
+		require.Equal(t, c == CodeKeyNotLoaded, IsKeyNotLoaded(err))
+	}
+	require.Equal(t, int32(0), atomic.LoadInt32(&statusJobs))
+
+	// An unknown code is checked against the module's status
+	atomic.StoreInt32(&code, 99)
+	_, err := hsm.SignVote("chain", vote)
+	require.True(t, IsKeyNotLoaded(err))
+	require.False(t, IsHeightRegression(err))
+	require.Equal(t, int32(1), atomic.LoadInt32(&statusJobs))
+}
@@ -0,0 +1,147 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package module
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// ResponseClass identifies the kind of error response sent by the module.
+type ResponseClass int32
+
+const (
+	// ClassError is sent when the module could not understand or perform a
+	// job, e.g. because it was malformed or of an unknown type.
+	ClassError ResponseClass = seeJobResponse_Error
+
+	// ClassProcessing is sent when the module understood a job but refused
+	// to carry it out. The response includes a code giving the reason.
+	ClassProcessing ResponseClass = seeJobResponse_ProcessingError
+)
+
+func (c ResponseClass) String() string {
+	switch c {
+	case ClassError:
+		return "error"
+	case ClassProcessing:
+		return "processing error"
+	default:
+		return fmt.Sprintf("response class %d", int32(c))
+	}
+}
+
+// Codes sent with ClassProcessing responses, giving the reason the module
+// refused a job. Modules may send other codes, or zero; those are reported
+// but not interpreted.
+const (
+	// CodeHeightRegression means the job would sign at a height, round or
+	// step before the last one signed, or sign different data at the same
+	// height, round and step.
+	CodeHeightRegression int32 = 1
+
+	// CodeKeyNotLoaded means the job needs a key, but none is loaded, e.g.
+	// because the module restarted.
+	CodeKeyNotLoaded int32 = 2
+
+	// CodeBadSignatureInput means the data to be signed was malformed.
+	CodeBadSignatureInput int32 = 3
+)
+
+// ModuleError is an error reported by the module in response to a job. Use
+// IsHeightRegression, IsKeyNotLoaded and IsBadSignatureInput to tell the
+// reasons for a refusal apart.
+type ModuleError struct {
+	Class ResponseClass
+
+	// Code gives the reason for a ClassProcessing error, and is zero
+	// otherwise.
+	Code int32
+
+	// Message is the description sent by the module.
+	Message string
+
+	// keyNotLoaded is set when the module refused a job needing the key
+	// with a code not listed above, and then reported in a status job that
+	// it holds no key.
+	keyNotLoaded bool
+}
+
+func (e *ModuleError) Error() string {
+	if e.Class == ClassProcessing {
+		return fmt.Sprintf("Error from module (code=%d): %s", e.Code, e.Message)
+	}
+	return "Error from module: " + e.Message
+}
+
+// KeyNotLoaded reports whether the module refused a job because it holds no
+// key, either with CodeKeyNotLoaded or, for an unknown code, as confirmed by
+// the status job. It allows validator.HsmPrivValidator to reload the key.
+func (e *ModuleError) KeyNotLoaded() bool {
+	return e.hasCode(CodeKeyNotLoaded) || e.keyNotLoaded
+}
+
+// hasCode reports whether e is a ClassProcessing error with code.
+func (e *ModuleError) hasCode(code int32) bool {
+	return e.Class == ClassProcessing && e.Code == code
+}
+
+// ambiguous reports whether e is a ClassProcessing error whose code does not
+// say why the module refused the job.
+func (e *ModuleError) ambiguous() bool {
+	if e.Class != ClassProcessing {
+		return false
+	}
+	switch e.Code {
+	case CodeHeightRegression, CodeKeyNotLoaded, CodeBadSignatureInput:
+		return false
+	default:
+		return true
+	}
+}
+
+// AsModuleError returns the ModuleError underlying err, if there is one.
+func AsModuleError(err error) (*ModuleError, bool) {
+	e, ok := errors.Cause(err).(*ModuleError)
+	return e, ok
+}
+
+// IsHeightRegression reports whether err, or the error it wraps, is the
+// module refusing to sign before, or differently at, the last height, round
+// and step it signed.
+func IsHeightRegression(err error) bool {
+	e, ok := AsModuleError(err)
+	return ok && e.hasCode(CodeHeightRegression)
+}
+
+// IsKeyNotLoaded reports whether err, or the error it wraps, is the module
+// refusing a job because it holds no key.
+func IsKeyNotLoaded(err error) bool {
+	e, ok := AsModuleError(err)
+	return ok && e.KeyNotLoaded()
+}
+
+// IsBadSignatureInput reports whether err, or the error it wraps, is the
+// module refusing to sign malformed data.
+func IsBadSignatureInput(err error) bool {
+	e, ok := AsModuleError(err)
+	return ok && e.hasCode(CodeBadSignatureInput)
+}
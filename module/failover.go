@@ -0,0 +1,641 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package module
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tendermint/tendermint/types"
+	"github.com/tendermint/tmlibs/log"
+	"github.com/thales-e-security/tendermint-hsm-validator/validator"
+)
+
+// FailoverEvent describes a switch from one module to another.
+type FailoverEvent struct {
+	// From and To are the addresses of the old and new active modules.
+	From string
+	To   string
+
+	// Reason is the error that caused the switch.
+	Reason error
+}
+
+// EndpointStatus describes one of the modules behind a FailoverHSM.
+type EndpointStatus struct {
+	Address   string
+	Active    bool
+	Healthy   bool
+	KeyLoaded bool
+}
+
+// FailoverHSM implements validator.Hsm over an ordered list of CodeSafe
+// machines. Jobs are sent to the active module, initially the first. If
+// the active module cannot be reached, or fails to answer before the
+// deadline, FailoverHSM switches to the next healthy module in the list.
+// All modules must be able to load keys generated by any of them (i.e.
+// share a Security World).
+//
+// The key is not loaded into the new module behind the caller's back. Until
+// LoadKeys is called again, jobs needing the key fail with an error whose
+// KeyNotLoaded method returns true, as if the module had lost its key. This
+// makes validator.HsmPrivValidator reload the key, and check the public key
+// and signed state of the new module, before it signs with it.
+//
+// To avoid conflicting signatures, a vote or proposal that may have reached
+// a failed module is never retried elsewhere. No other module will sign at
+// or below the height, round and step of any job sent to a module, so a
+// module that signed before failing cannot be contradicted by its
+// replacement. This protection lasts for the lifetime of the FailoverHSM.
+//
+// Failovers are logged, counted, and reported to any callback registered
+// with OnFailover. A FailoverHSM is safe for concurrent use; jobs are
+// processed one at a time.
+type FailoverHSM struct {
+	modules []*ThalesHSM
+
+	// jobMtx serialises jobs, so that each sees a consistent view of the
+	// active module and of the slots sent to other modules.
+	jobMtx sync.Mutex
+
+	mtx        sync.Mutex
+	active     int
+	healthy    []bool
+	keyLoaded  []bool
+	sent       []*validator.Position
+	wrappedKey []byte
+	failovers  int
+	logger     log.Logger
+	metrics    *Metrics
+	onFailover func(FailoverEvent)
+
+	quit      chan struct{}
+	closeOnce sync.Once
+}
+
+var (
+	_ validator.ContextHsm          = (*FailoverHSM)(nil)
+	_ validator.ContextPublicKeyHsm = (*FailoverHSM)(nil)
+	_ validator.ContextStateHsm     = (*FailoverHSM)(nil)
+)
+
+// NewFailoverHSM creates a FailoverHSM over modules, in order of preference.
+// The FailoverHSM takes ownership of the modules and closes them when it is
+// closed.
+func NewFailoverHSM(modules ...*ThalesHSM) (*FailoverHSM, error) {
+	if len(modules) == 0 {
+		return nil, errors.New("at least one module is required")
+	}
+
+	healthy := make([]bool, len(modules))
+	for i := range healthy {
+		healthy[i] = true
+	}
+
+	return &FailoverHSM{
+		modules:   modules,
+		healthy:   healthy,
+		keyLoaded: make([]bool, len(modules)),
+		sent:      make([]*validator.Position, len(modules)),
+		logger:    log.NewNopLogger(),
+		metrics:   NopMetrics(),
+		quit:      make(chan struct{}),
+	}, nil
+}
+
+// SetLogger sets the logger used to report failovers and health changes.
+func (f *FailoverHSM) SetLogger(logger log.Logger) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.logger = logger
+}
+
+// SetMetrics sets the metrics used to report the active module and failovers.
+// Metrics for jobs are recorded by each ThalesHSM, according to its Metrics
+// field.
+func (f *FailoverHSM) SetMetrics(metrics *Metrics) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	f.metrics = metrics
+	f.reportActive()
+}
+
+// OnFailover registers a function to be called after each switch to a new
+// module. It must not call back into the FailoverHSM's jobs.
+func (f *FailoverHSM) OnFailover(fn func(FailoverEvent)) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.onFailover = fn
+}
+
+// Active returns the address of the module that jobs are sent to.
+func (f *FailoverHSM) Active() string {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.modules[f.active].address()
+}
+
+// Failovers returns the number of times the active module has changed.
+func (f *FailoverHSM) Failovers() int {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	return f.failovers
+}
+
+// Endpoints returns the status of each module, in order of preference.
+func (f *FailoverHSM) Endpoints() []EndpointStatus {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	status := make([]EndpointStatus, len(f.modules))
+	for i, m := range f.modules {
+		status[i] = EndpointStatus{
+			Address:   m.address(),
+			Active:    i == f.active,
+			Healthy:   f.healthy[i],
+			KeyLoaded: f.keyLoaded[i],
+		}
+	}
+	return status
+}
+
+// StartHealthChecks calls CheckHealth every interval, each check limited to
+// interval, until the FailoverHSM is closed.
+func (f *FailoverHSM) StartHealthChecks(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), interval)
+				f.CheckHealth(ctx)
+				cancel()
+			case <-f.quit:
+				return
+			}
+		}
+	}()
+}
+
+// CheckHealth asks each module for its status and records which respond. A
+// module that reports no key loaded refuses jobs needing the key until it is
+// loaded again. If the active module does not respond, the first module in the list that
+// does becomes active.
+func (f *FailoverHSM) CheckHealth(ctx context.Context) {
+	results := make([]error, len(f.modules))
+	keyLost := make([]bool, len(f.modules))
+	for i, m := range f.modules {
+		status, err := m.Status(ctx)
+		if _, ok := err.(*UnsupportedJobError); ok {
+			// The module was reached, but predates the status job
+			err = nil
+		} else if _, ok := AsModuleError(err); ok {
+			// The module responded, but does not support the status job
+			err = nil
+		} else if err == nil {
+			keyLost[i] = !status.KeyLoaded
+		}
+		results[i] = err
+	}
+
+	f.mtx.Lock()
+	logger := f.logger
+	for i, err := range results {
+		if keyLost[i] {
+			f.keyLoaded[i] = false
+		}
+
+		healthy := err == nil
+		if healthy == f.healthy[i] {
+			continue
+		}
+
+		f.healthy[i] = healthy
+		if healthy {
+			// The module may have restarted and lost its key
+			f.keyLoaded[i] = false
+			logger.Info("HSM is reachable", "addr", f.modules[i].address())
+		} else {
+			logger.Error("HSM is unreachable", "addr", f.modules[i].address(), "err", err)
+		}
+	}
+
+	from := f.active
+	if f.healthy[from] {
+		f.mtx.Unlock()
+		return
+	}
+
+	for i := range f.modules {
+		if f.healthy[i] {
+			event := f.switchTo(from, i, results[from])
+			f.mtx.Unlock()
+			f.notify(event)
+			return
+		}
+	}
+	f.mtx.Unlock()
+}
+
+// Close stops health checks and closes the connections to every module.
+func (f *FailoverHSM) Close() error {
+	var err error
+	f.closeOnce.Do(func() {
+		close(f.quit)
+		for _, m := range f.modules {
+			if closeErr := m.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
+	})
+	return err
+}
+
+// LoadKeys implements Hsm.LoadKeys by loading the key into the active module.
+// The key is remembered, and loaded into other modules on failover.
+func (f *FailoverHSM) LoadKeys(wrappedPrivKey []byte) error {
+	return f.LoadKeysContext(context.Background(), wrappedPrivKey)
+}
+
+// LoadKeysContext implements ContextHsm.LoadKeysContext.
+func (f *FailoverHSM) LoadKeysContext(ctx context.Context, wrappedPrivKey []byte) error {
+	f.mtx.Lock()
+	f.wrappedKey = append([]byte(nil), wrappedPrivKey...)
+	for i := range f.keyLoaded {
+		f.keyLoaded[i] = false
+	}
+	f.mtx.Unlock()
+
+	return f.run(ctx, nil, loadKey, func(h *ThalesHSM) error {
+		// run loads the key before calling us
+		return nil
+	})
+}
+
+// GenerateKey implements Hsm.GenerateKey by creating a key in the active module.
+func (f *FailoverHSM) GenerateKey() (validator.Ed25519KeyPair, error) {
+	return f.GenerateKeyContext(context.Background())
+}
+
+// GenerateKeyContext implements ContextHsm.GenerateKeyContext.
+func (f *FailoverHSM) GenerateKeyContext(ctx context.Context) (pair validator.Ed25519KeyPair, err error) {
+	err = f.run(ctx, nil, keyNotNeeded, func(h *ThalesHSM) (err error) {
+		pair, err = h.GenerateKeyContext(ctx)
+		return err
+	})
+	return pair, err
+}
+
+// PublicKey implements PublicKeyHsm.PublicKey, asking the active module,
+// which loads the key first if needed.
+func (f *FailoverHSM) PublicKey() (validator.LoadedKey, error) {
+	return f.PublicKeyContext(context.Background())
+}
+
+// PublicKeyContext implements ContextPublicKeyHsm.PublicKeyContext.
+func (f *FailoverHSM) PublicKeyContext(ctx context.Context) (key validator.LoadedKey, err error) {
+	err = f.run(ctx, nil, keyNeeded, func(h *ThalesHSM) (err error) {
+		key, err = h.PublicKeyContext(ctx)
+		return err
+	})
+	return key, err
+}
+
+// ExportState implements StateHsm.ExportState, asking the active module, which
+// loads the key first if needed.
+func (f *FailoverHSM) ExportState() (validator.SignedState, error) {
+	return f.ExportStateContext(context.Background())
+}
+
+// ExportStateContext implements ContextStateHsm.ExportStateContext.
+func (f *FailoverHSM) ExportStateContext(ctx context.Context) (state validator.SignedState, err error) {
+	err = f.run(ctx, nil, keyNeeded, func(h *ThalesHSM) (err error) {
+		state, err = h.ExportStateContext(ctx)
+		return err
+	})
+	return state, err
+}
+
+// SeedState implements StateHsm.SeedState by seeding every module, since any
+// of them may become active.
+func (f *FailoverHSM) SeedState(height int64, round int, step int8) error {
+	return f.SeedStateContext(context.Background(), height, round, step)
+}
+
+// SeedStateContext implements ContextStateHsm.SeedStateContext. Every module
+// is seeded, but only a failure to seed the active module is returned.
+// Another module that could not be seeded is logged, and is seeded again by
+// the validator if it is still behind once it becomes active.
+func (f *FailoverHSM) SeedStateContext(ctx context.Context, height int64, round int, step int8) error {
+	f.mtx.Lock()
+	active, logger := f.active, f.logger
+	f.mtx.Unlock()
+
+	var result error
+	for i, m := range f.modules {
+		err := m.SeedStateContext(ctx, height, round, step)
+		if err != nil && i == active {
+			result = errors.WithMessage(err, "failed to seed "+m.address())
+		} else if err != nil {
+			logger.Error("Failed to seed HSM", "addr", m.address(), "err", err)
+		}
+	}
+	return result
+}
+
+// SignVote implements Hsm.SignVote using the active module.
+func (f *FailoverHSM) SignVote(chainId string, vote *types.Vote) ([]byte, error) {
+	return f.SignVoteContext(context.Background(), chainId, vote)
+}
+
+// SignVoteContext implements ContextHsm.SignVoteContext.
+func (f *FailoverHSM) SignVoteContext(ctx context.Context, chainId string, vote *types.Vote) (sig []byte, err error) {
+	step, err := validator.VoteStep(vote)
+	if err != nil {
+		return nil, err
+	}
+	slot := validator.Position{Height: vote.Height, Round: vote.Round, Step: step}
+
+	err = f.run(ctx, &slot, keyNeeded, func(h *ThalesHSM) (err error) {
+		sig, err = h.SignVoteContext(ctx, chainId, vote)
+		return err
+	})
+	return sig, err
+}
+
+// SignProposal implements Hsm.SignProposal using the active module.
+func (f *FailoverHSM) SignProposal(chainId string, proposal *types.Proposal) ([]byte, error) {
+	return f.SignProposalContext(context.Background(), chainId, proposal)
+}
+
+// SignProposalContext implements ContextHsm.SignProposalContext.
+func (f *FailoverHSM) SignProposalContext(ctx context.Context, chainId string,
+	proposal *types.Proposal) (sig []byte, err error) {
+	slot := validator.Position{Height: proposal.Height, Round: proposal.Round, Step: validator.StepPropose}
+
+	err = f.run(ctx, &slot, keyNeeded, func(h *ThalesHSM) (err error) {
+		sig, err = h.SignProposalContext(ctx, chainId, proposal)
+		return err
+	})
+	return sig, err
+}
+
+// SignHeartbeat implements Hsm.SignHeartbeat using the active module.
+func (f *FailoverHSM) SignHeartbeat(chainId string, hb *types.Heartbeat) ([]byte, error) {
+	return f.SignHeartbeatContext(context.Background(), chainId, hb)
+}
+
+// SignHeartbeatContext implements ContextHsm.SignHeartbeatContext. Heartbeats
+// carry no double-signing risk, so are retried on the next module regardless
+// of whether they reached a failed one.
+func (f *FailoverHSM) SignHeartbeatContext(ctx context.Context, chainId string,
+	hb *types.Heartbeat) (sig []byte, err error) {
+	err = f.run(ctx, nil, keyNeeded, func(h *ThalesHSM) (err error) {
+		sig, err = h.SignHeartbeatContext(ctx, chainId, hb)
+		return err
+	})
+	return sig, err
+}
+
+// keyUse says what run does about the key before a job.
+type keyUse int
+
+const (
+	// keyNotNeeded jobs are sent whether or not the module holds the key.
+	keyNotNeeded keyUse = iota
+
+	// keyNeeded jobs fail with a *keyNotLoadedError if the module has not
+	// had the key loaded since it became active.
+	keyNeeded
+
+	// loadKey jobs load the key into the module first.
+	loadKey
+)
+
+// keyNotLoadedError is returned for a job needing the key when the active
+// module has not had it loaded, e.g. because it has just become active.
+type keyNotLoadedError struct {
+	addr string
+}
+
+func (e *keyNotLoadedError) Error() string {
+	return "key not loaded into " + e.addr + "; it must be loaded again"
+}
+
+// KeyNotLoaded returns true. It allows validator.HsmPrivValidator to reload
+// the key.
+func (e *keyNotLoadedError) KeyNotLoaded() bool {
+	return true
+}
+
+// run performs job on the active module, and fails over to the next module if
+// the active one cannot be reached. use says whether the module must hold the
+// key, or have it loaded first. If slot is not nil, job signs at that height,
+// round and step, and is not attempted on any module other than one it may
+// already have reached.
+func (f *FailoverHSM) run(ctx context.Context, slot *validator.Position, use keyUse,
+	job func(h *ThalesHSM) error) error {
+	f.jobMtx.Lock()
+	defer f.jobMtx.Unlock()
+
+	var err error
+	for attempt := 0; attempt < len(f.modules); attempt++ {
+		if attempt > 0 && ctx.Err() != nil {
+			return err
+		}
+
+		index, h, wrappedKey := f.current()
+
+		if slot != nil {
+			if conflict := f.checkSlot(index, *slot); conflict != nil {
+				if err != nil {
+					return errors.WithMessage(err, conflict.Error())
+				}
+				return conflict
+			}
+		}
+
+		if wrappedKey != nil && use == keyNeeded {
+			if err != nil {
+				return errors.WithMessage(&keyNotLoadedError{h.address()}, err.Error())
+			}
+			return &keyNotLoadedError{h.address()}
+		}
+
+		if wrappedKey != nil && use == loadKey {
+			err = h.LoadKeysContext(ctx, wrappedKey)
+			if err != nil {
+				if !isModuleFailure(err) {
+					return err
+				}
+				f.failover(index, err)
+				continue
+			}
+			f.setKeyLoaded(index)
+		}
+
+		err = job(h)
+
+		if slot != nil && mayHaveReachedModule(err) {
+			f.recordSent(index, *slot)
+		}
+
+		if err == nil || !isModuleFailure(err) {
+			return err
+		}
+
+		f.failover(index, err)
+	}
+
+	return err
+}
+
+// current returns the active module, and the key to load into it if it does
+// not yet hold it.
+func (f *FailoverHSM) current() (int, *ThalesHSM, []byte) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if f.keyLoaded[f.active] {
+		return f.active, f.modules[f.active], nil
+	}
+	return f.active, f.modules[f.active], f.wrappedKey
+}
+
+// checkSlot returns an error if a job at slot, or a later one, was sent to a
+// module other than index.
+func (f *FailoverHSM) checkSlot(index int, slot validator.Position) error {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	for i, sent := range f.sent {
+		if i != index && sent != nil && !sent.Before(slot) {
+			return errors.Errorf("refusing to sign %s on %s: %s may already have signed %s",
+				slot, f.modules[index].address(), f.modules[i].address(), *sent)
+		}
+	}
+	return nil
+}
+
+func (f *FailoverHSM) recordSent(index int, slot validator.Position) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	if f.sent[index] == nil || f.sent[index].Before(slot) {
+		f.sent[index] = &slot
+	}
+}
+
+func (f *FailoverHSM) setKeyLoaded(index int) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.keyLoaded[index] = true
+}
+
+// failover marks the module at index as failed and, if it is still active,
+// switches to the next healthy module.
+func (f *FailoverHSM) failover(index int, reason error) {
+	f.mtx.Lock()
+
+	f.healthy[index] = false
+	f.keyLoaded[index] = false
+
+	if f.active != index || len(f.modules) == 1 {
+		f.mtx.Unlock()
+		return
+	}
+
+	next := (index + 1) % len(f.modules)
+	for i := 1; i < len(f.modules); i++ {
+		candidate := (index + i) % len(f.modules)
+		if f.healthy[candidate] {
+			next = candidate
+			break
+		}
+	}
+
+	event := f.switchTo(index, next, reason)
+	f.mtx.Unlock()
+	f.notify(event)
+}
+
+// switchTo makes the module at to active. It must be called with mtx held.
+func (f *FailoverHSM) switchTo(from, to int, reason error) FailoverEvent {
+	f.active = to
+	f.failovers++
+	f.metrics.Failovers.Add(1)
+	f.reportActive()
+
+	event := FailoverEvent{
+		From:   f.modules[from].address(),
+		To:     f.modules[to].address(),
+		Reason: reason,
+	}
+
+	f.logger.Error("Failing over to another HSM", "from", event.From, "to", event.To, "err", reason)
+	return event
+}
+
+// reportActive updates the Active metric. It must be called with mtx held.
+func (f *FailoverHSM) reportActive() {
+	for i, m := range f.modules {
+		active := 0.0
+		if i == f.active {
+			active = 1
+		}
+		f.metrics.Active.With("addr", m.address()).Set(active)
+	}
+}
+
+func (f *FailoverHSM) notify(event FailoverEvent) {
+	f.mtx.Lock()
+	fn := f.onFailover
+	f.mtx.Unlock()
+
+	if fn != nil {
+		fn(event)
+	}
+}
+
+// isModuleFailure reports whether err indicates a problem reaching the module,
+// as opposed to the module refusing the job.
+func isModuleFailure(err error) bool {
+	if _, ok := err.(*connectionError); ok {
+		return true
+	}
+	return errors.Cause(err) == context.DeadlineExceeded
+}
+
+// mayHaveReachedModule reports whether a job that returned err could have been
+// processed by the module.
+func mayHaveReachedModule(err error) bool {
+	switch e := err.(type) {
+	case *connectionError:
+		return e.sent
+	case *UnsupportedJobError:
+		return false
+	}
+	return true
+}
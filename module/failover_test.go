@@ -0,0 +1,302 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package module_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/tendermint/tendermint/types"
+	"github.com/thales-e-security/tendermint-hsm-validator/module"
+	"github.com/thales-e-security/tendermint-hsm-validator/simulator"
+	"github.com/thales-e-security/tendermint-hsm-validator/validator"
+)
+
+// startModules runs n simulators sharing a wrapping key, and returns a
+// FailoverHSM over them with a key loaded.
+func startModules(t *testing.T, n int) (*module.FailoverHSM, []*killableListener, validator.Ed25519KeyPair) {
+	wrappingKey := make([]byte, 32)
+	rand.Read(wrappingKey)
+
+	var modules []*module.ThalesHSM
+	var listeners []*killableListener
+
+	for i := 0; i < n; i++ {
+		_, listener := serveSimulator(t, wrappingKey, "127.0.0.1:0")
+		listeners = append(listeners, listener)
+
+		addr := listener.Addr().(*net.TCPAddr)
+		modules = append(modules, &module.ThalesHSM{Host: addr.IP.String(), Port: addr.Port})
+	}
+
+	hsm, err := module.NewFailoverHSM(modules...)
+	require.NoError(t, err)
+
+	pair, err := hsm.GenerateKey()
+	require.NoError(t, err)
+	require.NoError(t, hsm.LoadKeys(pair.WrappedPrivateKey[:]))
+
+	return hsm, listeners, pair
+}
+
+// answerHello reads a hello job from conn and agrees MaxWireVersion, listing
+// every job up to and including hello.
+func answerHello(conn net.Conn) {
+	var length int32
+	binary.Read(conn, binary.LittleEndian, &length)
+	io.ReadFull(conn, make([]byte, length))
+
+	jobs := []byte{0, 1, 2, 3, 4, 5, 6, 7}
+	for _, word := range []int32{16 + int32(len(jobs)), 0, 8 + int32(len(jobs)), module.MaxWireVersion,
+		int32(len(jobs))} {
+		binary.Write(conn, binary.LittleEndian, word)
+	}
+	conn.Write(jobs)
+}
+
+func prevote(height int64) *types.Vote {
+	return &types.Vote{Height: height, Type: types.VoteTypePrevote}
+}
+
+func TestFailoverOnConnectionError(t *testing.T) {
+	hsm, listeners, pair := startModules(t, 2)
+	defer hsm.Close()
+
+	var events []module.FailoverEvent
+	hsm.OnFailover(func(e module.FailoverEvent) {
+		events = append(events, e)
+	})
+
+	primary := hsm.Active()
+
+	_, err := hsm.SignVote(chainID, prevote(1))
+	require.NoError(t, err)
+
+	listeners[0].kill()
+
+	// The pooled connection is found to be dead and a new one cannot be
+	// made, so the vote never reached the primary. The secondary does not
+	// sign it until the key has been loaded into it again.
+	vote := prevote(2)
+	_, err = hsm.SignVote(chainID, vote)
+	require.Error(t, err)
+	requireKeyNotLoaded(t, err)
+
+	require.NoError(t, hsm.LoadKeys(pair.WrappedPrivateKey[:]))
+	sig, err := hsm.SignVote(chainID, vote)
+	require.NoError(t, err)
+	require.True(t, ed25519.Verify(pair.PublicKey[:], types.SignBytes(chainID, vote), sig))
+
+	require.NotEqual(t, primary, hsm.Active())
+	require.Equal(t, 1, hsm.Failovers())
+	require.Len(t, events, 1)
+	require.Equal(t, primary, events[0].From)
+	require.Equal(t, hsm.Active(), events[0].To)
+
+	// The primary signed at height 1, so the secondary must not
+	_, err = hsm.SignVote(chainID, prevote(1))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "may already have signed")
+
+	status := hsm.Endpoints()
+	require.False(t, status[0].Active)
+	require.False(t, status[0].Healthy)
+	require.True(t, status[1].Active)
+	require.True(t, status[1].KeyLoaded)
+}
+
+// requireKeyNotLoaded checks that err asks for the key to be loaded again.
+func requireKeyNotLoaded(t *testing.T, err error) {
+	e, ok := errors.Cause(err).(interface {
+		KeyNotLoaded() bool
+	})
+	require.True(t, ok && e.KeyNotLoaded(), "expected a key not loaded error, got %v", err)
+}
+
+// failoverPrivValidator returns a private validator signing with hsm, using
+// the key in pair.
+func failoverPrivValidator(hsm validator.Hsm, pair validator.Ed25519KeyPair) *validator.HsmPrivValidator {
+	return &validator.HsmPrivValidator{
+		Hsm:              hsm,
+		EncryptedPrivKey: pair.WrappedPrivateKey[:],
+		PublicKey:        pair.PublicKey[:],
+	}
+}
+
+func TestFailoverRetriesUnsentJobs(t *testing.T) {
+	hsm, listeners, pair := startModules(t, 2)
+	defer hsm.Close()
+	pv := failoverPrivValidator(hsm, pair)
+
+	// The validator reloads the key into the secondary, checks it, and
+	// retries
+	listeners[0].kill()
+	require.NoError(t, pv.SignHeartbeat(chainID, &types.Heartbeat{}))
+	require.Equal(t, 1, hsm.Failovers())
+
+	vote := prevote(1)
+	require.NoError(t, pv.SignVote(chainID, vote))
+	require.True(t, pv.GetPubKey().VerifyBytes(types.SignBytes(chainID, vote), vote.Signature))
+}
+
+func TestFailoverChecksStandbyState(t *testing.T) {
+	hsm, listeners, pair := startModules(t, 2)
+	defer hsm.Close()
+	pv := failoverPrivValidator(hsm, pair)
+
+	require.NoError(t, pv.SignVote(chainID, prevote(1)))
+
+	// The secondary has signed nothing, so is behind the validator, and is
+	// seeded with its state before it signs
+	listeners[0].kill()
+	require.NoError(t, pv.SignVote(chainID, prevote(2)))
+	require.Equal(t, 1, hsm.Failovers())
+
+	state, err := hsm.ExportState()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), state.Height)
+}
+
+func TestFailoverDoesNotResendInDoubtJob(t *testing.T) {
+	// The primary agrees a protocol, then reads each request and hangs up
+	// without answering
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			answerHello(conn)
+			io.ReadFull(conn, make([]byte, 8))
+			conn.Close()
+		}
+	}()
+
+	wrappingKey := make([]byte, 32)
+	rand.Read(wrappingKey)
+	sim, err := simulator.New(wrappingKey)
+	require.NoError(t, err)
+	defer sim.Close()
+
+	secondaryListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go sim.Serve(secondaryListener)
+
+	primaryAddr := listener.Addr().(*net.TCPAddr)
+	secondaryAddr := secondaryListener.Addr().(*net.TCPAddr)
+
+	hsm, err := module.NewFailoverHSM(
+		&module.ThalesHSM{Host: primaryAddr.IP.String(), Port: primaryAddr.Port},
+		&module.ThalesHSM{Host: secondaryAddr.IP.String(), Port: secondaryAddr.Port})
+	require.NoError(t, err)
+	defer hsm.Close()
+
+	proposal := &types.Proposal{Height: 5, Round: 1, POLRound: -1}
+	_, err = hsm.SignProposal(chainID, proposal)
+	require.Error(t, err)
+	require.Equal(t, 1, hsm.Failovers())
+
+	_, err = hsm.SignProposal(chainID, proposal)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "may already have signed")
+
+	// The secondary has no key, but it has not been asked to sign anything
+	// conflicting either: later slots are allowed through to it
+	_, err = hsm.SignVote(chainID, &types.Vote{Height: 5, Round: 1, Type: types.VoteTypePrevote})
+	require.Error(t, err)
+	require.NotContains(t, err.Error(), "may already have signed")
+}
+
+func TestFailoverHealthCheck(t *testing.T) {
+	hsm, listeners, _ := startModules(t, 3)
+	defer hsm.Close()
+
+	listeners[0].kill()
+	listeners[1].kill()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	hsm.CheckHealth(ctx)
+
+	status := hsm.Endpoints()
+	require.False(t, status[0].Healthy)
+	require.False(t, status[1].Healthy)
+	require.True(t, status[2].Healthy)
+	require.True(t, status[2].Active)
+	require.Equal(t, 1, hsm.Failovers())
+
+	_, err := hsm.SignVote(chainID, prevote(1))
+	requireKeyNotLoaded(t, err)
+}
+
+func TestFailoverHealthCheckReloadsLostKey(t *testing.T) {
+	wrappingKey := make([]byte, 32)
+	rand.Read(wrappingKey)
+
+	sim, listener := serveSimulator(t, wrappingKey, "127.0.0.1:0")
+	addr := listener.Addr().(*net.TCPAddr)
+
+	hsm, err := module.NewFailoverHSM(&module.ThalesHSM{Host: addr.IP.String(), Port: addr.Port})
+	require.NoError(t, err)
+	defer hsm.Close()
+
+	pair, err := hsm.GenerateKey()
+	require.NoError(t, err)
+	require.NoError(t, hsm.LoadKeys(pair.WrappedPrivateKey[:]))
+	_, err = hsm.SignVote(chainID, prevote(1))
+	require.NoError(t, err)
+
+	// The module restarts between health checks, so is never seen to be
+	// down, but reports that it has no key
+	sim.Close()
+	listener.kill()
+	sim, _ = serveSimulator(t, wrappingKey, addr.String())
+	defer sim.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	hsm.CheckHealth(ctx)
+	require.True(t, hsm.Endpoints()[0].Healthy)
+	require.False(t, hsm.Endpoints()[0].KeyLoaded)
+
+	_, err = hsm.SignVote(chainID, prevote(2))
+	requireKeyNotLoaded(t, err)
+
+	require.NoError(t, hsm.LoadKeys(pair.WrappedPrivateKey[:]))
+	_, err = hsm.SignVote(chainID, prevote(2))
+	require.NoError(t, err)
+}
+
+func TestFailoverRequiresModules(t *testing.T) {
+	_, err := module.NewFailoverHSM()
+	require.Error(t, err)
+}
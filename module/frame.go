@@ -0,0 +1,103 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package module
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// FrameReader reads the frames that carry jobs and their responses between
+// the host and the CodeSafe machine. Each frame is a little-endian int32
+// length, followed by that many bytes. FrameReader does not buffer, so it
+// reads no further than the end of each frame, and a connection can carry
+// any number of jobs.
+type FrameReader struct {
+	in io.Reader
+}
+
+// NewFrameReader returns a FrameReader reading frames from in.
+func NewFrameReader(in io.Reader) *FrameReader {
+	return &FrameReader{in: in}
+}
+
+// ReadFrame reads the next frame and returns its contents, without the length
+// header. Frames longer than 64 KiB are refused. If in ends before the frame
+// begins, io.EOF is returned; if it ends part way through,
+// io.ErrUnexpectedEOF is returned.
+func (r *FrameReader) ReadFrame() ([]byte, error) {
+	header := make([]byte, wordSize)
+	_, err := io.ReadFull(r.in, header)
+	if err != nil {
+		return nil, err
+	}
+
+	length, err := unmarshallInt(bytes.NewReader(header))
+	if err != nil {
+		return nil, err
+	}
+
+	if length < 0 || length > maxFrameLength {
+		return nil, errors.Errorf("Invalid frame length: %d", length)
+	}
+
+	frame := make([]byte, length)
+	_, err = io.ReadFull(r.in, frame)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, errors.Wrap(err, "Failed to read frame")
+	}
+
+	return frame, nil
+}
+
+// FrameWriter writes frames in the format read by FrameReader.
+type FrameWriter struct {
+	out io.Writer
+}
+
+// NewFrameWriter returns a FrameWriter writing frames to out.
+func NewFrameWriter(out io.Writer) *FrameWriter {
+	return &FrameWriter{out: out}
+}
+
+// WriteFrame writes contents as a single frame, with a length header. The
+// header and contents are written together, in one call to out.Write.
+func (w *FrameWriter) WriteFrame(contents []byte) error {
+	if len(contents) > maxFrameLength {
+		return errors.Errorf("Frame of %d bytes is too long", len(contents))
+	}
+
+	// Note: this is not aligned to four bytes, as a marshalled byte array would be
+	buffer := bytes.NewBuffer(make([]byte, 0, wordSize+len(contents)))
+	err := marshallInt(int32(len(contents)), buffer)
+	if err != nil {
+		return err
+	}
+
+	buffer.Write(contents)
+	_, err = w.out.Write(buffer.Bytes())
+	return err
+}
@@ -0,0 +1,104 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package module_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/thales-e-security/tendermint-hsm-validator/module"
+)
+
+// countingWriter records the number of calls to Write.
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestFramesShareStream(t *testing.T) {
+	stream := new(countingWriter)
+	out := module.NewFrameWriter(stream)
+
+	require.NoError(t, out.WriteFrame([]byte{1, 2, 3}))
+	require.NoError(t, out.WriteFrame(nil))
+	require.NoError(t, out.WriteFrame([]byte("hello")))
+	require.Equal(t, 3, stream.writes)
+	require.Equal(t, "03000000"+"010203"+"00000000"+"05000000"+"68656c6c6f",
+		hex.EncodeToString(stream.Bytes()))
+
+	in := module.NewFrameReader(stream)
+
+	frame, err := in.ReadFrame()
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2, 3}, frame)
+
+	frame, err = in.ReadFrame()
+	require.NoError(t, err)
+	require.Empty(t, frame)
+
+	frame, err = in.ReadFrame()
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello"), frame)
+
+	_, err = in.ReadFrame()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestFrameReaderStopsAtEndOfFrame(t *testing.T) {
+	stream := bytes.NewReader([]byte{2, 0, 0, 0, 'h', 'i', 'x'})
+
+	frame, err := module.NewFrameReader(stream).ReadFrame()
+	require.NoError(t, err)
+	require.Equal(t, []byte("hi"), frame)
+	require.Equal(t, 1, stream.Len())
+}
+
+func TestFrameReaderRejectsBadFrames(t *testing.T) {
+	for name, data := range map[string]string{
+		"negative length":  "ffffffff",
+		"too long":         "01000100" + "00000000",
+		"truncated header": "0800",
+		"truncated frame":  "08000000" + "0000",
+	} {
+		t.Run(name, func(t *testing.T) {
+			input, _ := hex.DecodeString(data)
+			_, err := module.NewFrameReader(bytes.NewReader(input)).ReadFrame()
+			require.Error(t, err)
+			require.NotEqual(t, io.EOF, errors.Cause(err))
+		})
+	}
+}
+
+func TestFrameWriterRejectsLongFrame(t *testing.T) {
+	stream := new(bytes.Buffer)
+	err := module.NewFrameWriter(stream).WriteFrame(make([]byte, 64*1024+1))
+	require.Error(t, err)
+	require.Zero(t, stream.Len())
+}
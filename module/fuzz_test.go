@@ -0,0 +1,85 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+//go:build go1.18
+// +build go1.18
+
+package module
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+// FuzzUnmarshallModuleResponse checks that no response, however malformed,
+// makes the decoder panic or return more than a field can hold.
+func FuzzUnmarshallModuleResponse(f *testing.F) {
+	// The test responses are complete frames, so drop their length headers
+	f.Add(okResponse(nil)[wordSize:])
+	f.Add(okResponse([]byte{1, 2, 3, 4, 5})[wordSize:])
+	f.Add(agreeHello(MaxWireVersion)[wordSize:])
+	f.Add(errorResponse("bad job")[wordSize:])
+	f.Add(processingErrorResponse("too low", CodeHeightRegression)[wordSize:])
+	f.Add([]byte{})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		result, err := unmarshallModuleReponse(data)
+		if err != nil && result != nil {
+			t.Fatalf("returned %d bytes with error %v", len(result), err)
+		}
+		if len(result) > maxFieldLength {
+			t.Fatalf("returned %d bytes, more than the %d allowed", len(result), maxFieldLength)
+		}
+	})
+}
+
+// FuzzUnmarshallAll checks that unmarshallAll never panics, whatever it is
+// given to decode.
+func FuzzUnmarshallAll(f *testing.F) {
+	for _, items := range [][]interface{}{
+		{[]byte{1, 2, 3}, int32(42), int64(-1), "Hello, World!"},
+		{[]byte{}, int32(0), int64(0), ""},
+	} {
+		buffer, err := marshallAll(items...)
+		if err != nil {
+			f.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(buffer)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+	f.Add([]byte{0, 0, 0, 0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var b []byte
+		var i int32
+		var i64 int64
+		var s string
+		err := unmarshallAll(bytes.NewReader(data), &b, &i, &i64, &s)
+		if err == nil && len(b) > maxFieldLength {
+			t.Fatalf("returned %d bytes, more than the %d allowed", len(b), maxFieldLength)
+		}
+	})
+}
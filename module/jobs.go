@@ -0,0 +1,129 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package module
+
+// The request and response of each job, encoded by marshallStruct and
+// unmarshallStruct. Jobs with no request, or no response beyond success,
+// have no struct.
+
+// keyLoadRequest is the request of the seeJobKeyLoad job.
+type keyLoadRequest struct {
+	WrappedKey []byte `wire:"1"`
+}
+
+// keyGenResponse is the response of the seeJobKeyGen job.
+type keyGenResponse struct {
+	PublicKey  [32]byte `wire:"1"`
+	WrappedKey [64]byte `wire:"2"`
+}
+
+// statusResponse is the response of the seeJobStatus job.
+type statusResponse struct {
+	Version   string `wire:"1"`
+	KeyLoaded bool   `wire:"2"`
+	Height    int64  `wire:"3"`
+	Round     int    `wire:"4"`
+	Step      int8   `wire:"5"`
+}
+
+// publicKeyResponse is the response of the seeJobPublicKey job.
+type publicKeyResponse struct {
+	PublicKey [32]byte `wire:"1"`
+	KeyID     []byte   `wire:"2"`
+}
+
+// exportStateResponse is the response of the seeJobExportState job.
+type exportStateResponse struct {
+	Height    int64  `wire:"1"`
+	Round     int    `wire:"2"`
+	Step      int8   `wire:"3"`
+	PublicKey []byte `wire:"4"`
+	Signature []byte `wire:"5"`
+}
+
+// seedStateRequest is the request of the seeJobSeedState job.
+type seedStateRequest struct {
+	Height int64 `wire:"1"`
+	Round  int   `wire:"2"`
+	Step   int8  `wire:"3"`
+}
+
+// partSetHeader identifies the parts of a block.
+type partSetHeader struct {
+	Hash  []byte `wire:"1"`
+	Total int    `wire:"2"`
+}
+
+// blockID identifies a block by its hash and parts.
+type blockID struct {
+	Hash  []byte        `wire:"1"`
+	Parts partSetHeader `wire:"2"`
+}
+
+// signVoteRequest is the request of the seeJobSignVote job.
+type signVoteRequest struct {
+	ChainID   string  `wire:"1"`
+	BlockID   blockID `wire:"2"`
+	Height    int64   `wire:"3"`
+	Round     int     `wire:"4"`
+	Timestamp string  `wire:"5"`
+	Type      uint8   `wire:"6"`
+}
+
+// signProposalRequest is the request of the seeJobSignProposal job. POL is
+// empty if POLRound is -1.
+type signProposalRequest struct {
+	ChainID    string        `wire:"1"`
+	BlockParts partSetHeader `wire:"2"`
+	Height     int64         `wire:"3"`
+	POL        blockID       `wire:"4"`
+	POLRound   int           `wire:"5"`
+	Round      int           `wire:"6"`
+	Timestamp  string        `wire:"7"`
+}
+
+// signHeartbeatRequest is the request of the seeJobSignHeartbeat job.
+type signHeartbeatRequest struct {
+	ChainID          string `wire:"1"`
+	Height           int64  `wire:"2"`
+	Round            int    `wire:"3"`
+	Sequence         int    `wire:"4"`
+	ValidatorAddress []byte `wire:"5"`
+	ValidatorIndex   int    `wire:"6"`
+}
+
+// signResponse is the response of each of the signing jobs.
+type signResponse struct {
+	Signature [64]byte `wire:"1"`
+}
+
+// helloRequest is the request of the seeJobHello job.
+type helloRequest struct {
+	MinVersion int32 `wire:"1"`
+	MaxVersion int32 `wire:"2"`
+}
+
+// helloResponse is the response of the seeJobHello job, listing the jobs the
+// module accepts one per byte.
+type helloResponse struct {
+	Version int32  `wire:"1"`
+	Jobs    []byte `wire:"2"`
+}
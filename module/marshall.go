@@ -38,6 +38,14 @@ const (
 	wordSize                       = 4
 )
 
+// maxFrameLength bounds the length of a response frame, and maxFieldLength
+// the length of a byte string within one. Genuine responses are far smaller;
+// the limits stop a corrupted or malicious length from exhausting memory.
+const (
+	maxFrameLength = 64 * 1024
+	maxFieldLength = 16 * 1024
+)
+
 // marshallAll marshalls all items and returns a buffer. Supported
 // types are []byte, int, int32, uint8 and string. All integer types
 // are treated as 32-bit values.
@@ -82,8 +90,12 @@ func unmarshallAll(reader io.Reader, destinations ...interface{}) error {
 			*dp, err = unmarshallBytes(reader)
 		} else if dp, ok := dest.(*int32); ok {
 			*dp, err = unmarshallInt(reader)
+		} else if dp, ok := dest.(*int64); ok {
+			*dp, err = unmarshallInt64(reader)
 		} else if dp, ok := dest.(*string); ok {
 			*dp, err = unmarshallString(reader)
+		} else {
+			err = errors.Errorf("Unknown type: %s", reflect.TypeOf(dest))
 		}
 
 		if err != nil {
@@ -101,6 +113,13 @@ func unmarshallInt(in io.Reader) (int32, error) {
 	return result, err
 }
 
+// unmarshallInt64 reads an int64 from the input data.
+func unmarshallInt64(in io.Reader) (int64, error) {
+	var result int64
+	err := binary.Read(in, binary.LittleEndian, &result)
+	return result, err
+}
+
 // marshallInt writes an int32 to the output buffer.
 func marshallInt(i int32, out io.Writer) error {
 	return binary.Write(out, binary.LittleEndian, i)
@@ -119,7 +138,15 @@ func marshallString(s string, out io.Writer) error {
 // unmarshallString reads a string from the input data.
 func unmarshallString(in io.Reader) (string, error) {
 	s, err := unmarshallBytes(in)
-	return string(s[:len(s)-1]), err
+	if err != nil {
+		return "", err
+	}
+
+	if len(s) == 0 || s[len(s)-1] != 0 {
+		return "", errors.New("String is missing its terminator")
+	}
+
+	return string(s[:len(s)-1]), nil
 }
 
 // marshallBytes writes a slice to the output buffer.
@@ -149,18 +176,30 @@ func getPaddingForLength(length int) int {
 	return (wordSize - (length % wordSize)) % wordSize
 }
 
-// unmarshallBytes reads a slice from the input data.
+// unmarshallBytes reads a slice from the input data. The length must be no
+// more than maxFieldLength and, if in reports how much data it holds, no more
+// than that.
 func unmarshallBytes(in io.Reader) ([]byte, error) {
 	length, err := unmarshallInt(in)
 	if err != nil {
 		return nil, err
 	}
 
+	if length < 0 || length > maxFieldLength {
+		return nil, errors.Errorf("Invalid field length: %d", length)
+	}
+
+	if r, ok := in.(interface {
+		Len() int
+	}); ok && int(length) > r.Len() {
+		return nil, errors.Errorf("Field length %d exceeds the %d bytes remaining", length, r.Len())
+	}
+
 	result := make([]byte, length)
 
 	n, err := io.ReadFull(in, result)
 	if err != nil {
-		return result, errors.Wrap(err, fmt.Sprintf("Tried to read %d bytes, found %d", length, n))
+		return nil, errors.Wrap(err, fmt.Sprintf("Tried to read %d bytes, found %d", length, n))
 	}
 
 	paddingToDiscard := getPaddingForLength(int(length))
@@ -168,44 +207,53 @@ func unmarshallBytes(in io.Reader) ([]byte, error) {
 	return result, errors.Wrap(err, fmt.Sprintf("Failed to discard %d padding bytes", paddingToDiscard))
 }
 
-// unmarshallModuleReponse unpicks the response from a module. If the response
-// indicates an error then an appropriate error string is returned. Otherwise
-// the job response data is returned.
-func unmarshallModuleReponse(in io.Reader) ([]byte, error) {
-
-	// Skip the first four bytes, since they contain a redundant
-	// length indicator
-	_, err := io.CopyN(ioutil.Discard, in, 4)
+// unmarshallModuleReponse unpicks the contents of a response frame from a
+// module, as returned by FrameReader.ReadFrame. If the response indicates an
+// error then a *ModuleError is returned. Otherwise the job response data is
+// returned. The response must fill the frame exactly.
+func unmarshallModuleReponse(frame []byte) ([]byte, error) {
+	body := bytes.NewReader(frame)
+	responseCode, err := unmarshallInt(body)
 	if err != nil {
 		return nil, err
 	}
 
-	responseCode, err := unmarshallInt(in)
-	if err != nil {
-		return nil, err
-	}
+	var result []byte
+	var moduleErr *ModuleError
 
 	switch responseCode {
 	case seeJobResponse_OK:
-		return unmarshallBytes(in)
+		result, err = unmarshallBytes(body)
+		if err != nil {
+			return nil, err
+		}
 	case seeJobResponse_Error:
-		errorString, err := unmarshallString(in)
+		errorString, err := unmarshallString(body)
 		if err != nil {
 			return nil, errors.WithMessage(err, "Failed to unmarshal error string")
 		}
-		return nil, errors.New("Error from module: " + errorString)
+		moduleErr = &ModuleError{Class: ClassError, Message: errorString}
 
 	case seeJobResponse_ProcessingError:
-		errorString, err := unmarshallString(in)
+		errorString, err := unmarshallString(body)
 		if err != nil {
 			return nil, errors.WithMessage(err, "Failed to unmarshal error string")
 		}
-		errorCode, err := unmarshallInt(in)
+		errorCode, err := unmarshallInt(body)
 		if err != nil {
 			return nil, errors.WithMessage(err, "Failed to unmarshal error code")
 		}
-		return nil, errors.New(fmt.Sprintf("Error from module (code=%d): %s", errorCode, errorString))
+		moduleErr = &ModuleError{Class: ClassProcessing, Code: errorCode, Message: errorString}
 	default:
 		return nil, errors.Errorf("Unknown response code: %d", responseCode)
 	}
+
+	if body.Len() > 0 {
+		return nil, errors.Errorf("%d unexpected bytes after the response", body.Len())
+	}
+
+	if moduleErr != nil {
+		return nil, moduleErr
+	}
+	return result, nil
 }
@@ -22,9 +22,13 @@ package module
 
 import (
 	"bytes"
+	"encoding/hex"
+	"io/ioutil"
 	"math"
+	"strings"
 	"testing"
 
+	pkgerrors "github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -126,3 +130,93 @@ func TestMarshallUnmarshallAll(t *testing.T) {
 	require.Equal(t, i, i2)
 	require.Equal(t, s, s2)
 }
+
+func TestUnmarshallModuleResponseErrors(t *testing.T) {
+	response := func(items ...interface{}) []byte {
+		body, err := marshallAll(items...)
+		require.Nil(t, err, err)
+
+		data, err := ioutil.ReadAll(body)
+		require.Nil(t, err, err)
+		return data
+	}
+
+	_, err := unmarshallModuleReponse(response(int32(seeJobResponse_Error), "bad job"))
+	require.Equal(t, &ModuleError{Class: ClassError, Message: "bad job"}, err)
+	require.Equal(t, "Error from module: bad job", err.Error())
+
+	_, err = unmarshallModuleReponse(response(int32(seeJobResponse_ProcessingError), "too low", CodeHeightRegression))
+	require.Equal(t, &ModuleError{Class: ClassProcessing, Code: CodeHeightRegression, Message: "too low"}, err)
+	require.Equal(t, "Error from module (code=1): too low", err.Error())
+
+	wrapped := pkgerrors.WithMessage(err, "signing failed")
+	moduleErr, ok := AsModuleError(wrapped)
+	require.True(t, ok)
+	require.Equal(t, CodeHeightRegression, moduleErr.Code)
+	require.True(t, IsHeightRegression(wrapped))
+	require.False(t, IsKeyNotLoaded(wrapped))
+	require.False(t, IsBadSignatureInput(wrapped))
+	require.False(t, moduleErr.KeyNotLoaded())
+
+	_, err = unmarshallModuleReponse(response(int32(seeJobResponse_ProcessingError), "no key", CodeKeyNotLoaded))
+	require.True(t, IsKeyNotLoaded(err))
+	require.True(t, err.(*ModuleError).KeyNotLoaded())
+
+	_, err = unmarshallModuleReponse(response(int32(seeJobResponse_ProcessingError), "bad vote", CodeBadSignatureInput))
+	require.True(t, IsBadSignatureInput(err))
+	require.False(t, IsHeightRegression(err))
+
+	// A ClassError response carries no code, whatever its message
+	_, err = unmarshallModuleReponse(response(int32(seeJobResponse_Error), "key not loaded"))
+	require.False(t, IsKeyNotLoaded(err))
+}
+
+func TestUnmarshallBytesRejectsBadLengths(t *testing.T) {
+	for name, data := range map[string]string{
+		"negative":         "ffffffff",
+		"too long":         "01400000" + strings.Repeat("00", maxFieldLength+4),
+		"beyond the input": "00010000" + "01020304",
+	} {
+		t.Run(name, func(t *testing.T) {
+			input, _ := hex.DecodeString(data)
+			_, err := unmarshallBytes(bytes.NewReader(input))
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestUnmarshallStringRequiresTerminator(t *testing.T) {
+	for name, data := range map[string]string{
+		"empty":          "00000000",
+		"not terminated": "02000000" + "68690000",
+	} {
+		t.Run(name, func(t *testing.T) {
+			input, _ := hex.DecodeString(data)
+			_, err := unmarshallString(bytes.NewReader(input))
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestUnmarshallModuleResponseRejectsMalformedResponses(t *testing.T) {
+	for name, data := range map[string]string{
+		"empty":               "",
+		"truncated code":      "0000",
+		"data after response": "00000000" + "00000000" + "00000000",
+		"field beyond frame":  "00000000" + "04000000",
+		"unterminated error":  "01000000" + "01000000" + "78000000",
+		"missing error code":  "02000000" + "01000000" + "00000000",
+		"unknown response":    "03000000",
+		"missing payload":     "00000000",
+		"empty error string":  "01000000" + "00000000",
+		"huge field":          "00000000" + "ffffff7f",
+	} {
+		t.Run(name, func(t *testing.T) {
+			input, _ := hex.DecodeString(data)
+			_, err := unmarshallModuleReponse(input)
+			require.Error(t, err)
+			_, ok := err.(*ModuleError)
+			require.False(t, ok, "malformed frame reported as %v", err)
+		})
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package module
+
+import (
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricsSubsystem is the Prometheus subsystem for metrics from this package.
+const MetricsSubsystem = "hsm"
+
+// Error classes, used to label Metrics.JobErrors.
+const (
+	// errorClassModule counts jobs the module rejected as malformed or unsupported.
+	errorClassModule = "module"
+
+	// errorClassProcessing counts jobs the module refused to process, e.g.
+	// because of a height regression.
+	errorClassProcessing = "processing"
+
+	// errorClassTransport counts jobs that could not be exchanged with the
+	// module, or that it did not answer in time.
+	errorClassTransport = "transport"
+
+	// errorClassResponse counts jobs whose response could not be decoded.
+	errorClassResponse = "response"
+
+	// errorClassRequest counts jobs that could not be sent for a reason on
+	// the host, e.g. because the request could not be encoded.
+	errorClassRequest = "request"
+)
+
+// Metrics contains the metrics exposed by ThalesHSM and FailoverHSM.
+type Metrics struct {
+	// JobLatency is the round trip time of each job, in seconds, labelled
+	// by job.
+	JobLatency metrics.Histogram
+
+	// JobErrors counts failed jobs, labelled by job and by class: "module",
+	// "processing", "transport", "response" or "request". Jobs abandoned by
+	// the host are not counted.
+	JobErrors metrics.Counter
+
+	// Connections is the number of connections open to each module,
+	// labelled by addr.
+	Connections metrics.Gauge
+
+	// Up is 1 if a module was reachable at its last health check or job,
+	// and 0 otherwise, labelled by addr.
+	Up metrics.Gauge
+
+	// Active is 1 for the module that FailoverHSM sends jobs to, and 0 for
+	// the others, labelled by addr.
+	Active metrics.Gauge
+
+	// Failovers counts switches from one module to another.
+	Failovers metrics.Counter
+}
+
+// PrometheusMetrics returns Metrics that are registered with the default
+// Prometheus registry, in the given namespace.
+func PrometheusMetrics(namespace string) *Metrics {
+	return &Metrics{
+		JobLatency: prometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "job_latency_seconds",
+			Help:      "Round trip time of jobs sent to the module.",
+			Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		}, []string{"job"}),
+		JobErrors: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "job_errors_total",
+			Help:      "Failed jobs, by class: module, processing, transport, response or request.",
+		}, []string{"job", "class"}),
+		Connections: prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "connections",
+			Help:      "Connections open to the module.",
+		}, []string{"addr"}),
+		Up: prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "up",
+			Help:      "Whether the module was reachable when last contacted.",
+		}, []string{"addr"}),
+		Active: prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "active",
+			Help:      "Whether the module is the one jobs are sent to.",
+		}, []string{"addr"}),
+		Failovers: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "failovers_total",
+			Help:      "Switches from one module to another.",
+		}, []string{}),
+	}
+}
+
+// NopMetrics returns Metrics that discard all observations.
+func NopMetrics() *Metrics {
+	return &Metrics{
+		JobLatency:  discard.NewHistogram(),
+		JobErrors:   discard.NewCounter(),
+		Connections: discard.NewGauge(),
+		Up:          discard.NewGauge(),
+		Active:      discard.NewGauge(),
+		Failovers:   discard.NewCounter(),
+	}
+}
+
+// jobNames labels metrics for each job number.
+var jobNames = map[int32]string{
+	seeJobKeyLoad:       "load_keys",
+	seeJobKeyGen:        "generate_key",
+	seeJobSignVote:      "sign_vote",
+	seeJobSignProposal:  "sign_proposal",
+	seeJobSignHeartbeat: "sign_heartbeat",
+	seeJobPublicKey:     "public_key",
+	seeJobStatus:        "status",
+	seeJobHello:         "hello",
+	seeJobExportState:   "export_state",
+	seeJobSeedState:     "seed_state",
+}
+
+func jobName(jobNumber int32) string {
+	if name, ok := jobNames[jobNumber]; ok {
+		return name
+	}
+	return "unknown"
+}
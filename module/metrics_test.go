@@ -0,0 +1,113 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package module_test
+
+import (
+	"crypto/rand"
+	"net"
+	"testing"
+
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+	"github.com/tendermint/tendermint/types"
+	"github.com/thales-e-security/tendermint-hsm-validator/module"
+)
+
+// findMetric returns the metric named name whose labels include those
+// given, or nil.
+func findMetric(t *testing.T, name string, labels map[string]string) *dto.Metric {
+	families, err := stdprometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+
+	metrics:
+		for _, metric := range family.Metric {
+			for _, pair := range metric.Label {
+				if value, ok := labels[pair.GetName()]; ok && value != pair.GetValue() {
+					continue metrics
+				}
+			}
+			return metric
+		}
+	}
+	return nil
+}
+
+func TestMetrics(t *testing.T) {
+	wrappingKey := make([]byte, 32)
+	rand.Read(wrappingKey)
+	_, listener := serveSimulator(t, wrappingKey, "127.0.0.1:0")
+
+	addr := listener.Addr().(*net.TCPAddr)
+	hsm := &module.ThalesHSM{
+		Host:    addr.IP.String(),
+		Port:    addr.Port,
+		Metrics: module.PrometheusMetrics("metrics_test"),
+	}
+	defer hsm.Close()
+
+	vote := &types.Vote{Height: 1, Type: types.VoteTypePrevote}
+
+	// No key is loaded, so the module refuses to process the job
+	_, err := hsm.SignVote(chainID, vote)
+	require.Error(t, err)
+
+	generateAndLoad(t, hsm)
+	_, err = hsm.SignVote(chainID, vote)
+	require.NoError(t, err)
+
+	latency := findMetric(t, "metrics_test_hsm_job_latency_seconds", map[string]string{"job": "sign_vote"})
+	require.NotNil(t, latency)
+	require.Equal(t, uint64(2), latency.Histogram.GetSampleCount())
+
+	processing := findMetric(t, "metrics_test_hsm_job_errors_total",
+		map[string]string{"job": "sign_vote", "class": "processing"})
+	require.NotNil(t, processing)
+	require.Equal(t, 1.0, processing.Counter.GetValue())
+
+	connections := findMetric(t, "metrics_test_hsm_connections", nil)
+	require.NotNil(t, connections)
+	require.Equal(t, 1.0, connections.Gauge.GetValue())
+
+	up := findMetric(t, "metrics_test_hsm_up", nil)
+	require.NotNil(t, up)
+	require.Equal(t, 1.0, up.Gauge.GetValue())
+
+	// Once the module has gone, jobs fail to reach it
+	listener.kill()
+	_, err = hsm.SignVote(chainID, vote)
+	require.Error(t, err)
+
+	transport := findMetric(t, "metrics_test_hsm_job_errors_total",
+		map[string]string{"job": "sign_vote", "class": "transport"})
+	require.NotNil(t, transport)
+	require.Equal(t, 1.0, transport.Counter.GetValue())
+
+	connections = findMetric(t, "metrics_test_hsm_connections", nil)
+	require.Equal(t, 0.0, connections.Gauge.GetValue())
+
+	up = findMetric(t, "metrics_test_hsm_up", nil)
+	require.Equal(t, 0.0, up.Gauge.GetValue())
+}
@@ -0,0 +1,176 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package module
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/pkg/errors"
+)
+
+// defaultMaxConnections is the number of sockets a ThalesHSM will hold open
+// to the module if no other value is configured.
+const defaultMaxConnections = 4
+
+// errPoolClosed is returned when a job is attempted after the pool has been
+// closed.
+var errPoolClosed = errors.New("connection pool is closed")
+
+// connPool maintains a small set of long-lived connections to the CodeSafe
+// machine, so that each job does not pay for a TCP handshake and teardown.
+// It is safe for concurrent use.
+type connPool struct {
+	dial func(ctx context.Context) (net.Conn, error)
+
+	// tokens limits the number of connections in use or idle at any one time.
+	tokens chan struct{}
+	idle   chan net.Conn
+
+	mtx    sync.Mutex
+	closed bool
+
+	// open counts connections, idle or in use, and is reported to openGauge.
+	open      int
+	openGauge metrics.Gauge
+}
+
+// newConnPool creates a pool holding at most size connections, which are
+// established using dial.
+func newConnPool(size int, dial func(ctx context.Context) (net.Conn, error)) *connPool {
+	if size <= 0 {
+		size = defaultMaxConnections
+	}
+
+	return &connPool{
+		dial:      dial,
+		tokens:    make(chan struct{}, size),
+		idle:      make(chan net.Conn, size),
+		openGauge: discard.NewGauge(),
+	}
+}
+
+// get returns a connection to the module, blocking if the maximum number of
+// connections are already in use. The reused result indicates whether the
+// connection was previously idle in the pool, rather than freshly dialled.
+// Callers must hand the connection back with put or discard.
+func (p *connPool) get(ctx context.Context) (conn net.Conn, reused bool, err error) {
+	if p.isClosed() {
+		return nil, false, errPoolClosed
+	}
+
+	select {
+	case p.tokens <- struct{}{}:
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+
+	select {
+	case conn = <-p.idle:
+		return conn, true, nil
+	default:
+	}
+
+	conn, err = p.dial(ctx)
+	if err != nil {
+		<-p.tokens
+		return nil, false, err
+	}
+
+	p.mtx.Lock()
+	p.countOpen(1)
+	p.mtx.Unlock()
+
+	return conn, false, nil
+}
+
+// put returns a healthy connection to the pool for reuse.
+func (p *connPool) put(conn net.Conn) {
+	defer func() { <-p.tokens }()
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.closed {
+		p.closeConn(conn)
+		return
+	}
+
+	select {
+	case p.idle <- conn:
+	default:
+		p.closeConn(conn)
+	}
+}
+
+// discard closes a connection that can no longer be trusted, e.g. because
+// a read or write failed part way through a job.
+func (p *connPool) discard(conn net.Conn) {
+	p.mtx.Lock()
+	p.closeConn(conn)
+	p.mtx.Unlock()
+
+	<-p.tokens
+}
+
+// close closes all idle connections. Connections currently in use are closed
+// when they are returned to the pool.
+func (p *connPool) close() error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+
+	for {
+		select {
+		case conn := <-p.idle:
+			p.closeConn(conn)
+		default:
+			return nil
+		}
+	}
+}
+
+// closeConn closes a connection owned by the pool. It must be called with
+// mtx held.
+func (p *connPool) closeConn(conn net.Conn) {
+	conn.Close()
+	p.countOpen(-1)
+}
+
+// countOpen adjusts the number of open connections. It must be called with
+// mtx held.
+func (p *connPool) countOpen(delta int) {
+	p.open += delta
+	p.openGauge.Set(float64(p.open))
+}
+
+func (p *connPool) isClosed() bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.closed
+}
@@ -0,0 +1,210 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package module
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// Versions of the wire protocol spoken between ThalesHSM and the CodeSafe
+// machine. The version is agreed by a hello job when each connection is
+// opened.
+const (
+	// WireVersion1 is the original protocol, with jobs to load and generate
+	// keys and to sign votes, proposals and heartbeats. Modules that speak
+	// only this version reject the hello job with a ClassError response.
+	WireVersion1 int32 = 1
+
+	// WireVersion2 adds the public key, status and hello jobs.
+	WireVersion2 int32 = 2
+
+	// WireVersion3 adds jobs to export the module's signed state and to
+	// seed it with a minimum height, round and step.
+	WireVersion3 int32 = 3
+
+	// MinWireVersion and MaxWireVersion bound the versions this package
+	// can speak.
+	MinWireVersion = WireVersion1
+	MaxWireVersion = WireVersion3
+
+	// DefaultMinWireVersion is the oldest version accepted unless
+	// ThalesHSM.MinVersion says otherwise. Modules speaking WireVersion1
+	// cannot report their loaded key, so are only used if MinVersion is
+	// set to WireVersion1.
+	DefaultMinWireVersion = WireVersion2
+)
+
+// CodeUnsupportedVersion is sent with a ClassProcessing response to the hello
+// job when the module speaks none of the versions offered.
+const CodeUnsupportedVersion int32 = 4
+
+// legacyProtocol is assumed for modules that reject the hello job, if the
+// host accepts WireVersion1.
+var legacyProtocol = Protocol{
+	Version: WireVersion1,
+	jobs: map[int32]bool{
+		seeJobKeyLoad:       true,
+		seeJobKeyGen:        true,
+		seeJobSignVote:      true,
+		seeJobSignProposal:  true,
+		seeJobSignHeartbeat: true,
+	},
+}
+
+// Protocol is what a module agreed to speak in response to the hello job.
+type Protocol struct {
+	// Version is the wire protocol version in use.
+	Version int32
+
+	jobs map[int32]bool
+}
+
+// supports reports whether the module accepts jobs of the given number.
+func (p Protocol) supports(jobNumber int32) bool {
+	return p.jobs[jobNumber]
+}
+
+// JobNames returns the names of the jobs the module accepts, as used to
+// label metrics, in job number order.
+func (p Protocol) JobNames() []string {
+	numbers := make([]int, 0, len(p.jobs))
+	for jobNumber := range p.jobs {
+		numbers = append(numbers, int(jobNumber))
+	}
+	sort.Ints(numbers)
+
+	names := make([]string, len(numbers))
+	for i, jobNumber := range numbers {
+		names[i] = jobName(int32(jobNumber))
+	}
+	return names
+}
+
+// IncompatibleError is returned when a module does not speak any wire protocol
+// version supported by this package. The host or the CodeSafe machine image
+// must be upgraded before they can be used together.
+type IncompatibleError struct {
+	// Version is the version chosen by the module, or zero if it refused
+	// all of the versions offered.
+	Version int32
+
+	// MinVersion is the oldest version the host accepted; see
+	// ThalesHSM.MinVersion.
+	MinVersion int32
+
+	// Message is the reason given by the module, if it refused.
+	Message string
+}
+
+func (e *IncompatibleError) Error() string {
+	if e.Version == 0 {
+		return fmt.Sprintf("module supports no wire protocol version from %d to %d: %s",
+			e.MinVersion, MaxWireVersion, e.Message)
+	}
+	return fmt.Sprintf("module speaks wire protocol version %d, but this host accepts versions %d to %d",
+		e.Version, e.MinVersion, MaxWireVersion)
+}
+
+// UnsupportedJobError is returned, without contacting the module, for a job
+// that the module did not list in its response to the hello job.
+type UnsupportedJobError struct {
+	Job     string
+	Version int32
+}
+
+func (e *UnsupportedJobError) Error() string {
+	return fmt.Sprintf("module does not support the %s job (wire protocol version %d)", e.Job, e.Version)
+}
+
+// Unsupported returns true. It allows validator.HsmPrivValidator to skip
+// optional operations on older modules.
+func (e *UnsupportedJobError) Unsupported() bool {
+	return true
+}
+
+// moduleConn is a connection to a module, with the protocol agreed on it.
+type moduleConn struct {
+	net.Conn
+	protocol Protocol
+}
+
+// hello agrees a protocol version with the module on conn. The request offers
+// the versions from minVersion to MaxWireVersion; the module replies with the
+// version it chose and the numbers of the jobs it accepts, one per byte.
+//
+// A WireVersion1 module cannot be told apart from a newer one that failed to
+// perform the hello job: both send a ClassError response, and version 1
+// defines no code for an unknown job. So a ClassError response is taken to
+// mean WireVersion1 only if minVersion accepts it, and is otherwise refused
+// with an IncompatibleError carrying the module's message. Any other error
+// fails the exchange.
+func hello(ctx context.Context, conn net.Conn, minVersion int32) (Protocol, error) {
+	data, err := marshallStruct(helloRequest{MinVersion: minVersion, MaxVersion: MaxWireVersion})
+	if err != nil {
+		return Protocol{}, err
+	}
+
+	request, err := jobFrame(seeJobHello, data)
+	if err != nil {
+		return Protocol{}, err
+	}
+
+	response, _, err := exchangeFrames(ctx, conn, request)
+	if err != nil {
+		return Protocol{}, err
+	}
+
+	result, err := unmarshallModuleReponse(response)
+	if e, ok := err.(*ModuleError); ok {
+		if e.Class == ClassError {
+			// The module may predate the hello job
+			if minVersion > WireVersion1 {
+				return Protocol{}, &IncompatibleError{MinVersion: minVersion, Message: e.Message}
+			}
+			return legacyProtocol, nil
+		}
+		if e.Class == ClassProcessing && e.Code == CodeUnsupportedVersion {
+			return Protocol{}, &IncompatibleError{MinVersion: minVersion, Message: e.Message}
+		}
+	}
+	if err != nil {
+		return Protocol{}, err
+	}
+
+	var reply helloResponse
+	err = unmarshallStruct(result, &reply)
+	if err != nil {
+		return Protocol{}, err
+	}
+
+	if reply.Version < minVersion || reply.Version > MaxWireVersion {
+		return Protocol{}, &IncompatibleError{Version: reply.Version, MinVersion: minVersion}
+	}
+
+	protocol := Protocol{Version: reply.Version, jobs: make(map[int32]bool, len(reply.Jobs))}
+	for _, jobNumber := range reply.Jobs {
+		protocol.jobs[int32(jobNumber)] = true
+	}
+	return protocol, nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package module
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHelloAgreesProtocol(t *testing.T) {
+	m := newTestModule(t, echoHandler)
+	defer m.close()
+
+	hsm := m.hsm()
+	defer hsm.Close()
+
+	protocol, err := hsm.Protocol(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, MaxWireVersion, protocol.Version)
+	require.Contains(t, protocol.JobNames(), "status")
+
+	_, err = sendJobToModule(context.Background(), seeJobStatus, new(bytes.Buffer), hsm.connections())
+	require.NoError(t, err)
+}
+
+func TestHelloFallsBackToLegacyProtocol(t *testing.T) {
+	m := newTestModule(t, echoHandler)
+	m.helloResponse = errorResponse("unknown job: 7")
+	defer m.close()
+
+	hsm := m.hsm()
+	hsm.MinVersion = WireVersion1
+	defer hsm.Close()
+
+	protocol, err := hsm.Protocol(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, WireVersion1, protocol.Version)
+	require.Equal(t, []string{"load_keys", "generate_key", "sign_vote", "sign_proposal", "sign_heartbeat"},
+		protocol.JobNames())
+
+	_, err = sendJobToModule(context.Background(), seeJobSignVote, new(bytes.Buffer), hsm.connections())
+	require.NoError(t, err)
+
+	_, err = sendJobToModule(context.Background(), seeJobStatus, new(bytes.Buffer), hsm.connections())
+	require.Equal(t, &UnsupportedJobError{Job: "status", Version: WireVersion1}, err)
+	require.False(t, mayHaveReachedModule(err))
+}
+
+func TestHelloRejectsIncompatibleModule(t *testing.T) {
+	m := newTestModule(t, echoHandler)
+	m.helloResponse = agreeHello(MaxWireVersion + 1)
+	defer m.close()
+
+	hsm := m.hsm()
+	defer hsm.Close()
+
+	_, err := sendJobToModule(context.Background(), seeJobSignVote, new(bytes.Buffer), hsm.connections())
+	require.Equal(t, &IncompatibleError{Version: MaxWireVersion + 1, MinVersion: DefaultMinWireVersion}, errors.Cause(err))
+	require.Contains(t, err.Error(), "this host accepts versions")
+	require.False(t, mayHaveReachedModule(err))
+}
+
+func TestHelloRefusedByModule(t *testing.T) {
+	m := newTestModule(t, echoHandler)
+	m.helloResponse = processingErrorResponse("too old", CodeUnsupportedVersion)
+	defer m.close()
+
+	hsm := m.hsm()
+	defer hsm.Close()
+
+	_, err := hsm.Protocol(context.Background())
+	require.Equal(t, &IncompatibleError{MinVersion: DefaultMinWireVersion, Message: "too old"}, errors.Cause(err))
+}
+
+func TestHelloErrorDoesNotFallBack(t *testing.T) {
+	m := newTestModule(t, echoHandler)
+	m.helloResponse = processingErrorResponse("busy", CodeKeyNotLoaded)
+	defer m.close()
+
+	hsm := m.hsm()
+	hsm.MinVersion = WireVersion1
+	defer hsm.Close()
+
+	// Only a ClassError response is taken as a version 1 module
+	_, err := hsm.Protocol(context.Background())
+	require.Error(t, err)
+	require.Equal(t, &ModuleError{Class: ClassProcessing, Code: CodeKeyNotLoaded, Message: "busy"}, errors.Cause(err))
+
+	// The failure is not cached as a downgrade; the next call says hello again
+	_, err = hsm.Protocol(context.Background())
+	require.Error(t, err)
+}
+
+func TestHelloMinVersionRefusesLegacyModule(t *testing.T) {
+	// Whatever the message, a module that rejects the hello job is refused
+	// unless version 1 is accepted, which it is not by default
+	for _, message := range []string{"unknown job: 7", "busy"} {
+		m := newTestModule(t, echoHandler)
+		m.helloResponse = errorResponse(message)
+
+		hsm := m.hsm()
+		_, err := hsm.Protocol(context.Background())
+		require.Equal(t, &IncompatibleError{MinVersion: WireVersion2, Message: message}, errors.Cause(err))
+
+		hsm.Close()
+		m.close()
+	}
+}
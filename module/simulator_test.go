@@ -0,0 +1,75 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package module_test
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thales-e-security/tendermint-hsm-validator/simulator"
+)
+
+// killableListener records accepted connections, so that a test can cut
+// off a module as if it had lost power.
+type killableListener struct {
+	net.Listener
+
+	mtx   sync.Mutex
+	conns []net.Conn
+}
+
+func (l *killableListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.mtx.Lock()
+		l.conns = append(l.conns, conn)
+		l.mtx.Unlock()
+	}
+	return conn, err
+}
+
+func (l *killableListener) kill() {
+	l.Listener.Close()
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+}
+
+// serveSimulator runs a simulator with the given wrapping key on address,
+// e.g. "127.0.0.1:0" for any local port. Killing the listener and serving
+// again on the same address emulates a module that restarts, losing its key
+// and its signed state.
+func serveSimulator(t *testing.T, wrappingKey []byte, address string) (*simulator.Simulator, *killableListener) {
+	sim, err := simulator.New(wrappingKey)
+	require.NoError(t, err)
+
+	listener, err := net.Listen("tcp", address)
+	require.NoError(t, err)
+
+	killable := &killableListener{Listener: listener}
+	go sim.Serve(killable)
+	return sim, killable
+}
@@ -22,10 +22,16 @@ package module
 
 import (
 	"bytes"
-	"errors"
-	"fmt"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/tendermint/tendermint/types"
+	"github.com/tendermint/tmlibs/log"
 	"github.com/thales-e-security/tendermint-hsm-validator/validator"
 )
 
@@ -35,132 +41,488 @@ const (
 	seeJobSignVote      = iota
 	seeJobSignProposal  = iota
 	seeJobSignHeartbeat = iota
+	seeJobPublicKey     = iota
+	seeJobStatus        = iota
+	seeJobHello         = iota
+	seeJobExportState   = iota
+	seeJobSeedState     = iota
 )
 
+// Status is the state reported by a CodeSafe machine.
+type Status struct {
+	// Version identifies the CodeSafe machine's firmware.
+	Version string
+
+	// KeyLoaded is true if the module has a validator key loaded.
+	KeyLoaded bool
+
+	// Height, Round and Step were last signed by the module. They are zero
+	// if it has signed nothing since it started.
+	Height int64
+	Round  int
+	Step   int8
+}
+
 // ThalesHSM implements validator.Hsm and is the interface
 // to the CodeSafe machine running inside the nShield HSM. The
 // CodeSafe machine will respond to instructions sent to its
-// network interface (hence Port, Host).
+// network interface (hence Port, Host), optionally over TLS.
+// The wire protocol version is agreed with a hello job when first
+// connecting; jobs the module does not support then fail with an
+// *UnsupportedJobError, and a module that speaks no supported version
+// cannot be connected to. Connections are kept open and reused between jobs,
+// so a ThalesHSM should not be copied after first use, and its methods have
+// pointer receivers: a *ThalesHSM, not a ThalesHSM, implements validator.Hsm.
+// It is safe for concurrent use.
 type ThalesHSM struct {
 	Port int
 	Host string
+
+	// MaxConnections limits the number of connections held open to the
+	// module. If zero, a small default is used.
+	MaxConnections int
+
+	// TLS, if set, secures the connection to the module. Use
+	// TLSOptions.ClientConfig to construct a suitable configuration.
+	TLS *tls.Config
+
+	// Metrics, if set, records job latency, errors and connection state.
+	Metrics *Metrics
+
+	// MinVersion, if set, is the oldest wire protocol version accepted from
+	// the module. Set it to WireVersion2 to refuse modules that predate the
+	// hello job, whose loaded key and signed state cannot be checked. If
+	// zero, DefaultMinWireVersion is used.
+	MinVersion int32
+
+	// Logger, if set, reports modules that only speak WireVersion1.
+	Logger log.Logger
+
+	poolOnce sync.Once
+	pool     *connPool
+
+	// protocol is the protocol agreed with the module, or nil if it must be
+	// agreed on the next connection.
+	protocolMtx sync.Mutex
+	protocol    *Protocol
+}
+
+var (
+	_ validator.ContextHsm          = (*ThalesHSM)(nil)
+	_ validator.ContextPublicKeyHsm = (*ThalesHSM)(nil)
+	_ validator.ContextStateHsm     = (*ThalesHSM)(nil)
+)
+
+// connections returns the pool of connections to the module, creating it
+// on first use.
+func (h *ThalesHSM) connections() *connPool {
+	h.poolOnce.Do(func() {
+		address := h.address()
+		h.pool = newConnPool(h.MaxConnections, func(ctx context.Context) (net.Conn, error) {
+			return h.connect(ctx, address)
+		})
+		h.pool.openGauge = h.metrics().Connections.With("addr", address)
+	})
+	return h.pool
+}
+
+// connect opens a connection to the module at address. If no protocol has been
+// agreed, because this is the first connection or the last one failed, it
+// starts with a hello job.
+func (h *ThalesHSM) connect(ctx context.Context, address string) (net.Conn, error) {
+	conn, err := h.dial(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+
+	h.protocolMtx.Lock()
+	protocol := h.protocol
+	h.protocolMtx.Unlock()
+
+	if protocol != nil {
+		return &moduleConn{Conn: conn, protocol: *protocol}, nil
+	}
+
+	agreed, err := hello(ctx, conn, h.minVersion())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if agreed.Version == WireVersion1 {
+		h.log().Error("Module predates the hello job; using wire protocol version 1, "+
+			"so its loaded key and signed state are not checked. Upgrade its image, "+
+			"then set the minimum wire version back to 2", "addr", address)
+
+		// Older modules may hang up after rejecting the hello job
+		conn.Close()
+		conn, err = h.dial(ctx, address)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	h.protocolMtx.Lock()
+	h.protocol = &agreed
+	h.protocolMtx.Unlock()
+
+	return &moduleConn{Conn: conn, protocol: agreed}, nil
+}
+
+// forgetProtocol makes the next connection agree the protocol again, in case
+// the module has been restarted with a different image.
+func (h *ThalesHSM) forgetProtocol() {
+	h.protocolMtx.Lock()
+	h.protocol = nil
+	h.protocolMtx.Unlock()
+}
+
+// dial opens a connection to the module at address, using TLS if configured.
+func (h *ThalesHSM) dial(ctx context.Context, address string) (net.Conn, error) {
+	if h.TLS != nil {
+		dialer := tls.Dialer{Config: h.TLS}
+		return dialer.DialContext(ctx, "tcp", address)
+	}
+
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", address)
+}
+
+// Protocol returns the wire protocol agreed with the module, connecting to it
+// if no connection is open.
+func (h *ThalesHSM) Protocol(ctx context.Context) (Protocol, error) {
+	pool := h.connections()
+
+	conn, _, err := pool.get(ctx)
+	if err != nil {
+		if err == errPoolClosed || ctx.Err() != nil {
+			return Protocol{}, err
+		}
+		return Protocol{}, &connectionError{err: err}
+	}
+	defer pool.put(conn)
+
+	return conn.(*moduleConn).protocol, nil
+}
+
+func (h *ThalesHSM) metrics() *Metrics {
+	if h.Metrics == nil {
+		return NopMetrics()
+	}
+	return h.Metrics
+}
+
+func (h *ThalesHSM) minVersion() int32 {
+	if h.MinVersion == 0 {
+		return DefaultMinWireVersion
+	}
+	return h.MinVersion
+}
+
+func (h *ThalesHSM) log() log.Logger {
+	if h.Logger == nil {
+		return log.NewNopLogger()
+	}
+	return h.Logger
+}
+
+// sendJob sends a job to the module, unmarshalls the result into response
+// unless it is nil, and records the latency and outcome of the job.
+func (h *ThalesHSM) sendJob(ctx context.Context, jobNumber int32, marshalledData io.Reader,
+	response interface{}) error {
+	metrics := h.metrics()
+	job := jobName(jobNumber)
+
+	start := time.Now()
+	result, err := sendJobToModule(ctx, jobNumber, marshalledData, h.connections())
+	metrics.JobLatency.With("job", job).Observe(time.Since(start).Seconds())
+
+	if err == nil && response != nil {
+		err = unmarshallStruct(result, response)
+		if err != nil {
+			err = &responseError{err: err}
+		}
+	}
+
+	up := metrics.Up.With("addr", h.address())
+	switch e := err.(type) {
+	case nil:
+		up.Set(1)
+	case *UnsupportedJobError:
+		up.Set(1)
+	case *ModuleError:
+		up.Set(1)
+		class := errorClassModule
+		if e.Class == ClassProcessing {
+			class = errorClassProcessing
+		}
+		metrics.JobErrors.With("job", job, "class", class).Add(1)
+	case *responseError:
+		up.Set(1)
+		metrics.JobErrors.With("job", job, "class", errorClassResponse).Add(1)
+	case *connectionError:
+		h.forgetProtocol()
+		up.Set(0)
+		metrics.JobErrors.With("job", job, "class", errorClassTransport).Add(1)
+	default:
+		switch err {
+		case context.DeadlineExceeded:
+			// The module did not answer in time
+			up.Set(0)
+			metrics.JobErrors.With("job", job, "class", errorClassTransport).Add(1)
+		case context.Canceled, errPoolClosed:
+			// Abandoned by the host, so the module is not to blame
+		default:
+			metrics.JobErrors.With("job", job, "class", errorClassRequest).Add(1)
+		}
+	}
+
+	return err
+}
+
+// Close releases any connections held open to the module.
+func (h *ThalesHSM) Close() error {
+	return h.connections().close()
+}
+
+// address returns the module's network address, as host:port.
+func (h *ThalesHSM) address() string {
+	return net.JoinHostPort(h.Host, strconv.Itoa(h.Port))
 }
 
 // LoadKeys implements Hsm.LoadKeys by sending the encrypted key to the
 // HSM to be loaded.
-func (h ThalesHSM) LoadKeys(wrappedPrivKey []byte) error {
-	buffer, err := marshallAll(wrappedPrivKey)
+func (h *ThalesHSM) LoadKeys(wrappedPrivKey []byte) error {
+	return h.LoadKeysContext(context.Background(), wrappedPrivKey)
+}
+
+// LoadKeysContext implements ContextHsm.LoadKeysContext. The job is abandoned
+// if ctx expires before the module responds.
+func (h *ThalesHSM) LoadKeysContext(ctx context.Context, wrappedPrivKey []byte) error {
+	buffer, err := marshallStruct(keyLoadRequest{WrappedKey: wrappedPrivKey})
 	if err != nil {
 		return err
 	}
 
-	_, err = sendJobToModule(seeJobKeyLoad, buffer, h.Host, h.Port)
-	return err
+	return h.sendJob(ctx, seeJobKeyLoad, buffer, nil)
 }
 
 // GenerateKey implements Hsm.GenerateKey by creating a new ed25519 key pair in
 // the HSM and returning an encrypted copy of the private key and
 // the public key.
-func (h ThalesHSM) GenerateKey() (validator.Ed25519KeyPair, error) {
-	response := validator.Ed25519KeyPair{}
-	buffer := new(bytes.Buffer)
+func (h *ThalesHSM) GenerateKey() (validator.Ed25519KeyPair, error) {
+	return h.GenerateKeyContext(context.Background())
+}
 
-	result, err := sendJobToModule(seeJobKeyGen, buffer, h.Host, h.Port)
+// GenerateKeyContext implements ContextHsm.GenerateKeyContext. The job is
+// abandoned if ctx expires before the module responds.
+func (h *ThalesHSM) GenerateKeyContext(ctx context.Context) (validator.Ed25519KeyPair, error) {
+	var response keyGenResponse
+	err := h.sendJob(ctx, seeJobKeyGen, new(bytes.Buffer), &response)
 	if err != nil {
-		return response, err
+		return validator.Ed25519KeyPair{}, err
 	}
 
-	buffer = bytes.NewBuffer(result)
+	return validator.Ed25519KeyPair{
+		PublicKey:         response.PublicKey,
+		WrappedPrivateKey: response.WrappedKey,
+	}, nil
+}
+
+// Status asks the module for its version, whether it has a key loaded, and
+// the height, round and step it last signed. It does not need a key, so can
+// be used to check that the module is responding.
+func (h *ThalesHSM) Status(ctx context.Context) (Status, error) {
+	var response statusResponse
+	err := h.sendJob(ctx, seeJobStatus, new(bytes.Buffer), &response)
+	if err != nil {
+		return Status{}, err
+	}
 
-	var pubKey, privKey []byte
+	return Status{
+		Version:   response.Version,
+		KeyLoaded: response.KeyLoaded,
+		Height:    response.Height,
+		Round:     response.Round,
+		Step:      response.Step,
+	}, nil
+}
+
+// PublicKey implements PublicKeyHsm.PublicKey by asking the HSM for the public
+// key and identifier of the key it has loaded.
+func (h *ThalesHSM) PublicKey() (validator.LoadedKey, error) {
+	return h.PublicKeyContext(context.Background())
+}
 
-	err = unmarshallAll(buffer, &pubKey, &privKey)
+// PublicKeyContext implements ContextPublicKeyHsm.PublicKeyContext. The job
+// is abandoned if ctx expires before the module responds.
+func (h *ThalesHSM) PublicKeyContext(ctx context.Context) (validator.LoadedKey, error) {
+	var response publicKeyResponse
+	err := h.sendJob(ctx, seeJobPublicKey, new(bytes.Buffer), &response)
 	if err != nil {
-		return response, err
+		return validator.LoadedKey{}, err
 	}
 
-	if len(pubKey) != len(response.PublicKey) {
-		return response, errors.New(
-			fmt.Sprintf("Bad public key size: got %d, expected %d", len(pubKey), len(response.PublicKey)))
+	return validator.LoadedKey{PublicKey: response.PublicKey, ID: response.KeyID}, nil
+}
+
+// ExportState implements StateHsm.ExportState by asking the HSM for the last
+// height, round and step it signed, signed with the loaded key.
+func (h *ThalesHSM) ExportState() (validator.SignedState, error) {
+	return h.ExportStateContext(context.Background())
+}
+
+// ExportStateContext implements ContextStateHsm.ExportStateContext. The job is
+// abandoned if ctx expires before the module responds.
+func (h *ThalesHSM) ExportStateContext(ctx context.Context) (validator.SignedState, error) {
+	var response exportStateResponse
+	err := h.sendJob(ctx, seeJobExportState, new(bytes.Buffer), &response)
+	if err != nil {
+		return validator.SignedState{}, h.checkKeyLoaded(ctx, err)
 	}
 
-	copy(response.PublicKey[:], pubKey)
+	return validator.SignedState{
+		Height:    response.Height,
+		Round:     response.Round,
+		Step:      response.Step,
+		PublicKey: response.PublicKey,
+		Signature: response.Signature,
+	}, nil
+}
+
+// SeedState implements StateHsm.SeedState by raising the height, round and
+// step at or before which the HSM will not sign.
+func (h *ThalesHSM) SeedState(height int64, round int, step int8) error {
+	return h.SeedStateContext(context.Background(), height, round, step)
+}
 
-	if len(privKey) != len(response.WrappedPrivateKey) {
-		return response, errors.New(
-			fmt.Sprintf("Bad private key size: got %d, expected %d", len(privKey),
-				len(response.WrappedPrivateKey)))
+// SeedStateContext implements ContextStateHsm.SeedStateContext. The job is
+// abandoned if ctx expires before the module responds.
+func (h *ThalesHSM) SeedStateContext(ctx context.Context, height int64, round int, step int8) error {
+	buffer, err := marshallStruct(seedStateRequest{Height: height, Round: round, Step: step})
+	if err != nil {
+		return err
 	}
 
-	copy(response.WrappedPrivateKey[:], privKey)
-	return response, nil
+	return h.sendJob(ctx, seeJobSeedState, buffer, nil)
 }
 
 // SignVote implements Hsm.SignVote by signing the canonical representation of the vote,
 // within the HSM. This operation will fail if there is a regression in round, step or height.
-func (h ThalesHSM) SignVote(chainId string, vote *types.Vote) ([]byte, error) {
-	buffer, err := marshallAll(chainId, []byte(vote.BlockID.Hash), []byte(vote.BlockID.PartsHeader.Hash),
-		vote.BlockID.PartsHeader.Total, vote.Height, vote.Round, types.CanonicalTime(vote.Timestamp), vote.Type)
-	if err != nil {
-		return nil, err
-	}
+func (h *ThalesHSM) SignVote(chainId string, vote *types.Vote) ([]byte, error) {
+	return h.SignVoteContext(context.Background(), chainId, vote)
+}
 
-	result, err := sendJobToModule(seeJobSignVote, buffer, h.Host, h.Port)
+// SignVoteContext implements ContextHsm.SignVoteContext. The job is abandoned
+// if ctx expires before the module responds.
+func (h *ThalesHSM) SignVoteContext(ctx context.Context, chainId string, vote *types.Vote) ([]byte, error) {
+	buffer, err := marshallStruct(signVoteRequest{
+		ChainID:   chainId,
+		BlockID:   newBlockID(vote.BlockID),
+		Height:    vote.Height,
+		Round:     vote.Round,
+		Timestamp: types.CanonicalTime(vote.Timestamp),
+		Type:      vote.Type,
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	buffer = bytes.NewBuffer(result)
-	return unmarshallBytes(buffer)
+	return h.sign(ctx, seeJobSignVote, buffer)
 }
 
 // SignProposal implements Hsm.SignProposal by signing the canonical representation of the proposal,
 // within the HSM. This operation will fail if there is a regression in round, step or height.
-func (h ThalesHSM) SignProposal(chainId string, proposal *types.Proposal) ([]byte, error) {
-	// If pol_round == -1, we won't have these pieces of data:
-	var polBlockIDHash []byte
-	var partsHash []byte
-	var partsTotal int
-
-	if proposal.POLRound == -1 {
-		polBlockIDHash = []byte{}
-		partsHash = []byte{}
-	} else {
-		polBlockIDHash = proposal.POLBlockID.Hash
-		partsHash = proposal.POLBlockID.PartsHeader.Hash
-		partsTotal = proposal.POLBlockID.PartsHeader.Total
-	}
-
-	buffer, err := marshallAll(chainId, []byte(proposal.BlockPartsHeader.Hash), proposal.BlockPartsHeader.Total,
-		proposal.Height, polBlockIDHash, partsHash, partsTotal, proposal.POLRound, proposal.Round,
-		types.CanonicalTime(proposal.Timestamp))
-	if err != nil {
-		return nil, err
+func (h *ThalesHSM) SignProposal(chainId string, proposal *types.Proposal) ([]byte, error) {
+	return h.SignProposalContext(context.Background(), chainId, proposal)
+}
+
+// SignProposalContext implements ContextHsm.SignProposalContext. The job is
+// abandoned if ctx expires before the module responds.
+func (h *ThalesHSM) SignProposalContext(ctx context.Context, chainId string,
+	proposal *types.Proposal) ([]byte, error) {
+	request := signProposalRequest{
+		ChainID:    chainId,
+		BlockParts: newPartSetHeader(proposal.BlockPartsHeader),
+		Height:     proposal.Height,
+		POLRound:   proposal.POLRound,
+		Round:      proposal.Round,
+		Timestamp:  types.CanonicalTime(proposal.Timestamp),
 	}
 
-	result, err := sendJobToModule(seeJobSignProposal, buffer, h.Host, h.Port)
+	// If pol_round == -1, there is no POL block ID, and it is sent empty
+	if proposal.POLRound != -1 {
+		request.POL = newBlockID(proposal.POLBlockID)
+	}
+
+	buffer, err := marshallStruct(request)
 	if err != nil {
 		return nil, err
 	}
 
-	buffer = bytes.NewBuffer(result)
-	return unmarshallBytes(buffer)
+	return h.sign(ctx, seeJobSignProposal, buffer)
 }
 
 // SignHeartbeat implements Hsm.SignHeartbeat by signing the canonical representation of the heartbeat,
 // within the HSM.
-func (h ThalesHSM) SignHeartbeat(chainId string, hb *types.Heartbeat) ([]byte, error) {
-	buffer, err := marshallAll(chainId, hb.Height, hb.Round, hb.Sequence, []byte(hb.ValidatorAddress),
-		hb.ValidatorIndex)
+func (h *ThalesHSM) SignHeartbeat(chainId string, hb *types.Heartbeat) ([]byte, error) {
+	return h.SignHeartbeatContext(context.Background(), chainId, hb)
+}
+
+// SignHeartbeatContext implements ContextHsm.SignHeartbeatContext. The job is
+// abandoned if ctx expires before the module responds.
+func (h *ThalesHSM) SignHeartbeatContext(ctx context.Context, chainId string, hb *types.Heartbeat) ([]byte, error) {
+	buffer, err := marshallStruct(signHeartbeatRequest{
+		ChainID:          chainId,
+		Height:           hb.Height,
+		Round:            hb.Round,
+		Sequence:         hb.Sequence,
+		ValidatorAddress: hb.ValidatorAddress,
+		ValidatorIndex:   hb.ValidatorIndex,
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	result, err := sendJobToModule(seeJobSignHeartbeat, buffer, h.Host, h.Port)
+	return h.sign(ctx, seeJobSignHeartbeat, buffer)
+}
+
+// sign sends one of the signing jobs, with the marshalled request, and
+// returns the signature from the response.
+func (h *ThalesHSM) sign(ctx context.Context, jobNumber int32, request io.Reader) ([]byte, error) {
+	var response signResponse
+	err := h.sendJob(ctx, jobNumber, request, &response)
 	if err != nil {
-		return nil, err
+		return nil, h.checkKeyLoaded(ctx, err)
+	}
+
+	return response.Signature[:], nil
+}
+
+// checkKeyLoaded is called with the error from a job needing the key. If the
+// module refused the job with a code that does not give the reason, it is
+// asked for its status, and if it reports that it holds no key, the error's
+// KeyNotLoaded method returns true. The error is returned unchanged if the
+// code gives the reason, or the module cannot report its status.
+func (h *ThalesHSM) checkKeyLoaded(ctx context.Context, err error) error {
+	moduleErr, ok := err.(*ModuleError)
+	if !ok || !moduleErr.ambiguous() {
+		return err
+	}
+
+	status, statusErr := h.Status(ctx)
+	if statusErr == nil && !status.KeyLoaded {
+		moduleErr.keyNotLoaded = true
 	}
+	return moduleErr
+}
+
+// newBlockID converts id for a signing job.
+func newBlockID(id types.BlockID) blockID {
+	return blockID{Hash: id.Hash, Parts: newPartSetHeader(id.PartsHeader)}
+}
 
-	buffer = bytes.NewBuffer(result)
-	return unmarshallBytes(buffer)
+// newPartSetHeader converts header for a signing job.
+func newPartSetHeader(header types.PartSetHeader) partSetHeader {
+	return partSetHeader{Hash: header.Hash, Total: header.Total}
 }
@@ -0,0 +1,384 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package module_test // in this package, since the simulator is also a client of module
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pkgerrors "github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/tendermint/tendermint/types"
+	"github.com/thales-e-security/tendermint-hsm-validator/module"
+	"github.com/thales-e-security/tendermint-hsm-validator/simulator"
+	"github.com/thales-e-security/tendermint-hsm-validator/validator"
+)
+
+const chainID = "test-chain"
+
+// startSimulator runs a simulator on a local port and returns a ThalesHSM
+// connected to it.
+func startSimulator(t *testing.T) (*module.ThalesHSM, func()) {
+	return startSimulatorVersion(t, 0)
+}
+
+// startSimulatorVersion is like startSimulator, but the simulator speaks at
+// most the given wire protocol version.
+func startSimulatorVersion(t *testing.T, wireVersion int32) (*module.ThalesHSM, func()) {
+	wrappingKey := make([]byte, 32)
+	rand.Read(wrappingKey)
+
+	sim, err := simulator.New(wrappingKey)
+	require.NoError(t, err)
+	sim.WireVersion = wireVersion
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go sim.Serve(listener)
+
+	addr := listener.Addr().(*net.TCPAddr)
+	hsm := &module.ThalesHSM{Host: addr.IP.String(), Port: addr.Port}
+
+	return hsm, func() {
+		hsm.Close()
+		sim.Close()
+	}
+}
+
+// generateAndLoad creates a key in the simulator and loads it.
+func generateAndLoad(t *testing.T, hsm *module.ThalesHSM) validator.Ed25519KeyPair {
+	pair, err := hsm.GenerateKey()
+	require.NoError(t, err)
+	require.NoError(t, hsm.LoadKeys(pair.WrappedPrivateKey[:]))
+	return pair
+}
+
+func TestSimulatorSignVote(t *testing.T) {
+	hsm, stop := startSimulator(t)
+	defer stop()
+
+	pair := generateAndLoad(t, hsm)
+
+	vote := &types.Vote{
+		Height:    10,
+		Round:     2,
+		Timestamp: time.Now().UTC().Truncate(time.Millisecond),
+		Type:      types.VoteTypePrecommit,
+	}
+	vote.BlockID.Hash = []byte("block hash")
+	vote.BlockID.PartsHeader.Hash = []byte("parts hash")
+	vote.BlockID.PartsHeader.Total = 3
+
+	sig, err := hsm.SignVote(chainID, vote)
+	require.NoError(t, err)
+	require.True(t, ed25519.Verify(pair.PublicKey[:], types.SignBytes(chainID, vote), sig))
+
+	// Nil votes carry no block ID
+	nilVote := &types.Vote{Height: 11, Type: types.VoteTypePrevote}
+	sig, err = hsm.SignVote(chainID, nilVote)
+	require.NoError(t, err)
+	require.True(t, ed25519.Verify(pair.PublicKey[:], types.SignBytes(chainID, nilVote), sig))
+}
+
+func TestSimulatorSignProposal(t *testing.T) {
+	hsm, stop := startSimulator(t)
+	defer stop()
+
+	pair := generateAndLoad(t, hsm)
+
+	proposal := &types.Proposal{Height: 5, Round: 1, POLRound: -1}
+	proposal.BlockPartsHeader.Hash = []byte("parts hash")
+	proposal.BlockPartsHeader.Total = 1
+
+	sig, err := hsm.SignProposal(chainID, proposal)
+	require.NoError(t, err)
+	require.True(t, ed25519.Verify(pair.PublicKey[:], types.SignBytes(chainID, proposal), sig))
+
+	polProposal := &types.Proposal{Height: 5, Round: 2, POLRound: 1}
+	polProposal.BlockPartsHeader.Hash = []byte("parts hash")
+	polProposal.BlockPartsHeader.Total = 1
+	polProposal.POLBlockID.Hash = []byte("pol block")
+	polProposal.POLBlockID.PartsHeader.Hash = []byte("pol parts")
+	polProposal.POLBlockID.PartsHeader.Total = 2
+
+	sig, err = hsm.SignProposal(chainID, polProposal)
+	require.NoError(t, err)
+	require.True(t, ed25519.Verify(pair.PublicKey[:], types.SignBytes(chainID, polProposal), sig))
+}
+
+func TestSimulatorSignHeartbeat(t *testing.T) {
+	hsm, stop := startSimulator(t)
+	defer stop()
+
+	pair := generateAndLoad(t, hsm)
+
+	hb := &types.Heartbeat{
+		ValidatorAddress: []byte("validator address!!!"),
+		ValidatorIndex:   3,
+		Height:           7,
+		Round:            1,
+		Sequence:         42,
+	}
+
+	sig, err := hsm.SignHeartbeat(chainID, hb)
+	require.NoError(t, err)
+	require.True(t, ed25519.Verify(pair.PublicKey[:], types.SignBytes(chainID, hb), sig))
+}
+
+func TestSimulatorStatus(t *testing.T) {
+	hsm, stop := startSimulator(t)
+	defer stop()
+
+	status, err := hsm.Status(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, module.Status{Version: simulator.Version}, status)
+
+	generateAndLoad(t, hsm)
+	_, err = hsm.SignVote(chainID, &types.Vote{Height: 10, Round: 1, Type: types.VoteTypePrecommit})
+	require.NoError(t, err)
+
+	status, err = hsm.Status(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, module.Status{
+		Version:   simulator.Version,
+		KeyLoaded: true,
+		Height:    10,
+		Round:     1,
+		Step:      3,
+	}, status)
+}
+
+func TestSimulatorPublicKey(t *testing.T) {
+	hsm, stop := startSimulator(t)
+	defer stop()
+
+	_, err := hsm.PublicKey()
+	require.True(t, module.IsKeyNotLoaded(err))
+
+	pair := generateAndLoad(t, hsm)
+
+	key, err := hsm.PublicKey()
+	require.NoError(t, err)
+	require.Equal(t, pair.PublicKey, key.PublicKey)
+
+	keyID := sha256.Sum256(pair.WrappedPrivateKey[:])
+	require.Equal(t, keyID[:], key.ID)
+}
+
+func TestSimulatorRejectsRegression(t *testing.T) {
+	hsm, stop := startSimulator(t)
+	defer stop()
+
+	generateAndLoad(t, hsm)
+
+	_, err := hsm.SignVote(chainID, &types.Vote{Height: 10, Round: 1, Type: types.VoteTypePrecommit})
+	require.NoError(t, err)
+
+	_, err = hsm.SignVote(chainID, &types.Vote{Height: 10, Round: 1, Type: types.VoteTypePrevote})
+	require.True(t, module.IsHeightRegression(err))
+	require.False(t, module.IsKeyNotLoaded(err))
+
+	_, err = hsm.SignProposal(chainID, &types.Proposal{Height: 9, POLRound: -1})
+	require.True(t, module.IsHeightRegression(err))
+
+	_, err = hsm.SignVote(chainID, &types.Vote{Height: 10, Round: 1, Type: 0x7f})
+	require.True(t, module.IsBadSignatureInput(err))
+
+	_, err = hsm.SignVote(chainID, &types.Vote{Height: 11, Type: types.VoteTypePrevote})
+	require.NoError(t, err)
+}
+
+func TestSimulatorRequiresLoadedKey(t *testing.T) {
+	hsm, stop := startSimulator(t)
+	defer stop()
+
+	_, err := hsm.SignVote(chainID, &types.Vote{Height: 1, Type: types.VoteTypePrevote})
+	require.True(t, module.IsKeyNotLoaded(err))
+
+	moduleErr, ok := module.AsModuleError(err)
+	require.True(t, ok)
+	require.Equal(t, module.ClassProcessing, moduleErr.Class)
+	require.Equal(t, module.CodeKeyNotLoaded, moduleErr.Code)
+	require.Equal(t, "no key loaded", moduleErr.Message)
+
+	var bogus [64]byte
+	err = hsm.LoadKeys(bogus[:])
+	moduleErr, ok = module.AsModuleError(err)
+	require.True(t, ok)
+	require.Equal(t, module.ClassError, moduleErr.Class)
+	require.False(t, module.IsKeyNotLoaded(err))
+}
+
+func TestLegacyModuleKeyLoss(t *testing.T) {
+	hsm, stop := startSimulatorVersion(t, module.WireVersion1)
+	defer stop()
+	hsm.MinVersion = module.WireVersion1
+
+	// The code says the key was lost, without the status job
+	_, err := hsm.SignVote(chainID, &types.Vote{Height: 1, Type: types.VoteTypePrevote})
+	require.True(t, module.IsKeyNotLoaded(err))
+}
+
+func TestSimulatorWithPrivValidator(t *testing.T) {
+	hsm, stop := startSimulator(t)
+	defer stop()
+
+	pv, err := validator.NewHsmPrivValidator(hsm)
+	require.NoError(t, err)
+
+	vote := &types.Vote{Height: 1, Type: types.VoteTypePrevote}
+	require.NoError(t, pv.SignVote(chainID, vote))
+	require.True(t, pv.GetPubKey().VerifyBytes(types.SignBytes(chainID, vote), vote.Signature))
+}
+
+func TestSimulatorPrivValidatorFile(t *testing.T) {
+	hsm, stop := startSimulator(t)
+	defer stop()
+
+	dir, err := ioutil.TempDir("", "TestSimulatorPrivValidatorFile")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	pvFile := filepath.Join(dir, "hsm-priv-validator.json")
+
+	pv, err := validator.NewHsmPrivValidator(hsm)
+	require.NoError(t, err)
+	pv.ChainID = chainID
+	require.NoError(t, pv.SaveToFile(pvFile))
+
+	loaded, err := validator.LoadFromFile(pvFile, hsm)
+	require.NoError(t, err)
+	defer loaded.Close()
+	require.Equal(t, pv.PublicKey, loaded.PublicKey)
+	require.NoError(t, loaded.SignVote(chainID, &types.Vote{Height: 1, Type: types.VoteTypePrevote}))
+}
+
+func TestSimulatorLegacyWireVersion(t *testing.T) {
+	hsm, stop := startSimulatorVersion(t, module.WireVersion1)
+	defer stop()
+
+	// Version 1 is only spoken if accepted explicitly
+	_, err := hsm.Protocol(context.Background())
+	require.IsType(t, &module.IncompatibleError{}, pkgerrors.Cause(err))
+
+	hsm.MinVersion = module.WireVersion1
+	protocol, err := hsm.Protocol(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, module.WireVersion1, protocol.Version)
+
+	_, err = hsm.Status(context.Background())
+	require.IsType(t, &module.UnsupportedJobError{}, err)
+
+	// The private validator works without the public key job only if told
+	// that it cannot check which key the module loaded
+	dir, err := ioutil.TempDir("", "TestSimulatorLegacyWireVersion")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	pvFile := filepath.Join(dir, "hsm-priv-validator.json")
+
+	pv, err := validator.NewHsmPrivValidator(hsm)
+	require.NoError(t, err)
+	require.Error(t, pv.SaveToFile(pvFile))
+
+	pv.AllowUncheckedKey = true
+	require.NoError(t, pv.SaveToFile(pvFile))
+
+	_, err = validator.LoadFromFile(pvFile, hsm)
+	require.Error(t, err)
+
+	loaded, err := validator.LoadFromFileWithOptions(pvFile, hsm, validator.LoadOptions{AllowUncheckedKey: true})
+	require.NoError(t, err)
+	defer loaded.Close()
+	require.NoError(t, loaded.SignVote(chainID, &types.Vote{Height: 1, Type: types.VoteTypePrevote}))
+}
+
+func TestPrivValidatorReloadsKeyAfterRestart(t *testing.T) {
+	wrappingKey := make([]byte, 32)
+	rand.Read(wrappingKey)
+
+	sim, listener := serveSimulator(t, wrappingKey, "127.0.0.1:0")
+	addr := listener.Addr().(*net.TCPAddr)
+
+	hsm := &module.ThalesHSM{Host: addr.IP.String(), Port: addr.Port}
+	defer hsm.Close()
+
+	pv, err := validator.NewHsmPrivValidator(hsm)
+	require.NoError(t, err)
+	require.NoError(t, pv.SignVote(chainID, &types.Vote{Height: 1, Type: types.VoteTypePrevote}))
+
+	// A fresh simulator on the same address has no key loaded, and has
+	// forgotten what was signed, so it is seeded with the host's state as the
+	// key is reloaded
+	sim.Close()
+	listener.kill()
+	sim, _ = serveSimulator(t, wrappingKey, addr.String())
+	defer sim.Close()
+
+	vote := &types.Vote{Height: 2, Type: types.VoteTypePrevote}
+	require.NoError(t, pv.SignVote(chainID, vote))
+	require.True(t, pv.GetPubKey().VerifyBytes(types.SignBytes(chainID, vote), vote.Signature))
+
+	state, err := hsm.ExportState()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), state.Height)
+}
+
+func TestExportAndSeedState(t *testing.T) {
+	hsm, cleanup := startSimulator(t)
+	defer cleanup()
+
+	pv, err := validator.NewHsmPrivValidator(hsm)
+	require.NoError(t, err)
+
+	vote := &types.Vote{Height: 3, Round: 1, Type: types.VoteTypePrevote}
+	require.NoError(t, pv.SignVote(chainID, vote))
+
+	state, err := pv.ExportState()
+	require.NoError(t, err)
+	require.Equal(t, int64(3), state.Height)
+	require.Equal(t, 1, state.Round)
+	require.Equal(t, int8(2), state.Step)
+	require.NoError(t, state.Verify(pv.PublicKey))
+
+	// Seeding below the current state changes nothing
+	require.NoError(t, hsm.SeedState(2, 0, 0))
+	exported, err := hsm.ExportState()
+	require.NoError(t, err)
+	require.Equal(t, state, exported)
+
+	require.NoError(t, hsm.SeedState(10, 0, 0))
+	status, err := hsm.Status(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, int64(10), status.Height)
+
+	// The module refuses to sign at or below the seeded state
+	_, err = hsm.SignVote(chainID, &types.Vote{Height: 9, Type: types.VoteTypePrecommit})
+	require.True(t, module.IsHeightRegression(err))
+	_, err = hsm.SignVote(chainID, &types.Vote{Height: 11, Type: types.VoteTypePrevote})
+	require.NoError(t, err)
+}
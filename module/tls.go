@@ -0,0 +1,139 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package module
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// TLSOptions describes how to secure the connection to the CodeSafe machine.
+// The host authenticates itself with a client certificate, and authenticates
+// the module either against a CA, against pinned certificate fingerprints, or
+// both.
+type TLSOptions struct {
+	// CertFile and KeyFile are PEM files holding the client certificate and
+	// private key presented to the module.
+	CertFile string
+	KeyFile  string
+
+	// CAFile is a PEM file of CA certificates trusted to issue the module's
+	// certificate. If empty, PinnedCerts must be set.
+	CAFile string
+
+	// ServerName overrides the name expected in the module's certificate.
+	// If empty, the configured host is used.
+	ServerName string
+
+	// PinnedCerts holds hex SHA-256 fingerprints of the module certificates
+	// that will be accepted. If empty, any certificate issued by CAFile is
+	// accepted.
+	PinnedCerts []string
+}
+
+// ClientConfig loads the files named in o and returns a TLS configuration
+// suitable for ThalesHSM.TLS.
+func (o TLSOptions) ClientConfig() (*tls.Config, error) {
+	if o.CertFile == "" || o.KeyFile == "" {
+		return nil, errors.New("a client certificate and key are required")
+	}
+
+	if o.CAFile == "" && len(o.PinnedCerts) == 0 {
+		return nil, errors.New("a CA file or pinned certificate is required to authenticate the module")
+	}
+
+	cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to load client certificate")
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ServerName:   o.ServerName,
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if o.CAFile != "" {
+		pem, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to read CA file")
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in %s", o.CAFile)
+		}
+	}
+
+	if len(o.PinnedCerts) > 0 {
+		pins, err := parsePins(o.PinnedCerts)
+		if err != nil {
+			return nil, err
+		}
+
+		// Without a CA, the pins are the only means of authenticating the module,
+		// so the standard chain verification is skipped in favour of them.
+		config.InsecureSkipVerify = o.CAFile == ""
+		config.VerifyPeerCertificate = verifyPinned(pins)
+	}
+
+	return config, nil
+}
+
+// parsePins decodes hex SHA-256 fingerprints, ignoring any colon separators.
+func parsePins(pinned []string) ([][]byte, error) {
+	var pins [][]byte
+	for _, p := range pinned {
+		pin, err := hex.DecodeString(strings.Replace(p, ":", "", -1))
+		if err != nil || len(pin) != sha256.Size {
+			return nil, errors.Errorf("invalid certificate fingerprint: %s", p)
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// verifyPinned returns a tls.Config.VerifyPeerCertificate function that
+// accepts the connection only if the module's leaf certificate matches one
+// of pins.
+func verifyPinned(pins [][]byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("module presented no certificate")
+		}
+
+		fingerprint := sha256.Sum256(rawCerts[0])
+		for _, pin := range pins {
+			if bytes.Equal(fingerprint[:], pin) {
+				return nil
+			}
+		}
+
+		return errors.Errorf("module certificate %x is not pinned", fingerprint)
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package module
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testPKI holds a CA and certificates issued by it, written to a
+// temporary directory.
+type testPKI struct {
+	dir        string
+	caFile     string
+	serverCert tls.Certificate
+	clientCert string
+	clientKey  string
+	caPool     *x509.CertPool
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	dir, err := ioutil.TempDir("", "hsm-tls")
+	require.NoError(t, err)
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+	caCert, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+
+	pki := &testPKI{
+		dir:        dir,
+		caFile:     filepath.Join(dir, "ca.pem"),
+		clientCert: filepath.Join(dir, "client.pem"),
+		clientKey:  filepath.Join(dir, "client-key.pem"),
+		caPool:     x509.NewCertPool(),
+	}
+	pki.caPool.AddCert(caCert)
+	writePEM(t, pki.caFile, "CERTIFICATE", caDER)
+
+	issue := func(serial int64, usage x509.ExtKeyUsage) ([]byte, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err)
+
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: "localhost"},
+			DNSNames:     []string{"localhost"},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+		require.NoError(t, err)
+		return der, key
+	}
+
+	serverDER, serverKey := issue(2, x509.ExtKeyUsageServerAuth)
+	pki.serverCert = tls.Certificate{Certificate: [][]byte{serverDER}, PrivateKey: serverKey}
+
+	clientDER, clientKey := issue(3, x509.ExtKeyUsageClientAuth)
+	writePEM(t, pki.clientCert, "CERTIFICATE", clientDER)
+	keyDER, err := x509.MarshalECPrivateKey(clientKey)
+	require.NoError(t, err)
+	writePEM(t, pki.clientKey, "EC PRIVATE KEY", keyDER)
+
+	return pki
+}
+
+func (p *testPKI) close() {
+	os.RemoveAll(p.dir)
+}
+
+func (p *testPKI) serverFingerprint() string {
+	fingerprint := sha256.Sum256(p.serverCert.Certificate[0])
+	return hex.EncodeToString(fingerprint[:])
+}
+
+// listen starts a TLS listener that requires client certificates issued by the test CA.
+func (p *testPKI) listen(t *testing.T) net.Listener {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{p.serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    p.caPool,
+	})
+	require.NoError(t, err)
+	return listener
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+	require.NoError(t, err)
+}
+
+func TestTLSWithCA(t *testing.T) {
+	pki := newTestPKI(t)
+	defer pki.close()
+
+	m := serveTestModule(pki.listen(t), echoHandler)
+	defer m.close()
+
+	config, err := TLSOptions{
+		CertFile: pki.clientCert,
+		KeyFile:  pki.clientKey,
+		CAFile:   pki.caFile,
+	}.ClientConfig()
+	require.NoError(t, err)
+
+	hsm := m.hsm()
+	hsm.TLS = config
+	defer hsm.Close()
+
+	result, err := sendJobToModule(context.Background(), seeJobSignVote, new(bytes.Buffer), hsm.connections())
+	require.NoError(t, err)
+
+	job, err := unmarshallInt(bytes.NewReader(result))
+	require.NoError(t, err)
+	require.Equal(t, int32(seeJobSignVote), job)
+}
+
+func TestTLSWithPinnedCertificate(t *testing.T) {
+	pki := newTestPKI(t)
+	defer pki.close()
+
+	m := serveTestModule(pki.listen(t), echoHandler)
+	defer m.close()
+
+	config, err := TLSOptions{
+		CertFile:    pki.clientCert,
+		KeyFile:     pki.clientKey,
+		PinnedCerts: []string{pki.serverFingerprint()},
+	}.ClientConfig()
+	require.NoError(t, err)
+
+	hsm := m.hsm()
+	hsm.TLS = config
+	defer hsm.Close()
+
+	_, err = sendJobToModule(context.Background(), seeJobSignVote, new(bytes.Buffer), hsm.connections())
+	require.NoError(t, err)
+}
+
+func TestTLSRejectsUnpinnedCertificate(t *testing.T) {
+	pki := newTestPKI(t)
+	defer pki.close()
+
+	m := serveTestModule(pki.listen(t), echoHandler)
+	defer m.close()
+
+	var otherPin [sha256.Size]byte
+	config, err := TLSOptions{
+		CertFile:    pki.clientCert,
+		KeyFile:     pki.clientKey,
+		CAFile:      pki.caFile,
+		PinnedCerts: []string{hex.EncodeToString(otherPin[:])},
+	}.ClientConfig()
+	require.NoError(t, err)
+
+	hsm := m.hsm()
+	hsm.TLS = config
+	defer hsm.Close()
+
+	_, err = sendJobToModule(context.Background(), seeJobSignVote, new(bytes.Buffer), hsm.connections())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not pinned")
+}
+
+func TestTLSRequiresClientCertificate(t *testing.T) {
+	pki := newTestPKI(t)
+	defer pki.close()
+
+	m := serveTestModule(pki.listen(t), echoHandler)
+	defer m.close()
+
+	hsm := m.hsm()
+	hsm.TLS = &tls.Config{RootCAs: pki.caPool}
+	defer hsm.Close()
+
+	_, err := sendJobToModule(context.Background(), seeJobSignVote, new(bytes.Buffer), hsm.connections())
+	require.Error(t, err)
+}
+
+func TestTLSOptionsValidation(t *testing.T) {
+	_, err := TLSOptions{CAFile: "ca.pem"}.ClientConfig()
+	require.Error(t, err)
+
+	_, err = TLSOptions{CertFile: "cert.pem", KeyFile: "key.pem"}.ClientConfig()
+	require.Error(t, err)
+
+	_, err = parsePins([]string{"not hex"})
+	require.Error(t, err)
+
+	pins, err := parsePins([]string{"00:11:22:33:44:55:66:77:88:99:aa:bb:cc:dd:ee:ff:" +
+		"00:11:22:33:44:55:66:77:88:99:aa:bb:cc:dd:ee:ff"})
+	require.NoError(t, err)
+	require.Len(t, pins, 1)
+}
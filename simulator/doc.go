@@ -0,0 +1,3 @@
+// Package simulator provides an in-process stand-in for the CodeSafe machine
+// that runs inside the Thales HSM, for use in tests and local testnets.
+package simulator
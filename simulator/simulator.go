@@ -0,0 +1,561 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package simulator
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tendermint/go-wire"
+	"github.com/tendermint/tendermint/types"
+	"github.com/thales-e-security/tendermint-hsm-validator/module"
+	"github.com/thales-e-security/tendermint-hsm-validator/validator"
+)
+
+// Job numbers, as sent by module.ThalesHSM.
+const (
+	jobKeyLoad = iota
+	jobKeyGen
+	jobSignVote
+	jobSignProposal
+	jobSignHeartbeat
+	jobPublicKey
+	jobStatus
+	jobHello
+	jobExportState
+	jobSeedState
+)
+
+// jobsByVersion lists the jobs accepted at each wire protocol version.
+var jobsByVersion = map[int32][]int32{
+	module.WireVersion1: {jobKeyLoad, jobKeyGen, jobSignVote, jobSignProposal, jobSignHeartbeat},
+	module.WireVersion2: {jobKeyLoad, jobKeyGen, jobSignVote, jobSignProposal, jobSignHeartbeat,
+		jobPublicKey, jobStatus, jobHello},
+	module.WireVersion3: {jobKeyLoad, jobKeyGen, jobSignVote, jobSignProposal, jobSignHeartbeat,
+		jobPublicKey, jobStatus, jobHello, jobExportState, jobSeedState},
+}
+
+// Version is reported by the simulator in response to a status job.
+const Version = "simulator"
+
+// wrappedKeySize is the size of a wrapped private key: a nonce, followed by
+// the encrypted ed25519 seed and its authentication tag.
+const (
+	wrapNonceSize  = 16
+	wrappedKeySize = 64
+)
+
+// processingError is returned by job handlers to send a ProcessingError
+// response with a specific code.
+type processingError struct {
+	code int32
+	msg  string
+}
+
+func (e processingError) Error() string {
+	return e.msg
+}
+
+// Simulator is an in-process stand-in for the CodeSafe machine running in
+// the nShield HSM. It speaks the same wire protocol, so a module.ThalesHSM
+// can be pointed at it. Private keys are wrapped under a software key, and
+// the simulator enforces the same height, round and step rules as the real
+// module. It is intended for tests and local testnets only.
+type Simulator struct {
+	// WireVersion, if set, limits the simulator to an older wire protocol
+	// version, so that hosts can be tested against older CodeSafe machine
+	// images. At module.WireVersion1 the hello job is rejected as unknown.
+	// It must be set before Serve is called.
+	WireVersion int32
+
+	wrapper cipher.AEAD
+
+	mtx       sync.Mutex
+	key       ed25519.PrivateKey
+	keyID     []byte
+	signed    validator.Position
+	signBytes []byte
+
+	listenerMtx sync.Mutex
+	listeners   []net.Listener
+	closed      bool
+}
+
+// New creates a Simulator that wraps private keys under wrappingKey, which
+// must be 32 bytes long. Keys generated by one Simulator can be loaded by
+// another with the same wrapping key.
+func New(wrappingKey []byte) (*Simulator, error) {
+	if len(wrappingKey) != 32 {
+		return nil, errors.Errorf("wrapping key must be 32 bytes, found %d", len(wrappingKey))
+	}
+
+	block, err := aes.NewCipher(wrappingKey)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapper, err := cipher.NewGCMWithNonceSize(block, wrapNonceSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Simulator{wrapper: wrapper}, nil
+}
+
+// Serve accepts connections on listener and answers jobs until Close is
+// called or the listener fails.
+func (s *Simulator) Serve(listener net.Listener) error {
+	s.listenerMtx.Lock()
+	if s.closed {
+		s.listenerMtx.Unlock()
+		return errors.New("simulator is closed")
+	}
+	s.listeners = append(s.listeners, listener)
+	s.listenerMtx.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops the simulator from accepting new connections.
+func (s *Simulator) Close() error {
+	s.listenerMtx.Lock()
+	defer s.listenerMtx.Unlock()
+
+	s.closed = true
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	return nil
+}
+
+func (s *Simulator) isClosed() bool {
+	s.listenerMtx.Lock()
+	defer s.listenerMtx.Unlock()
+	return s.closed
+}
+
+// serveConn answers jobs on conn until it is closed.
+func (s *Simulator) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	in := module.NewFrameReader(conn)
+	out := module.NewFrameWriter(conn)
+	for {
+		frame, err := in.ReadFrame()
+		if err != nil {
+			return
+		}
+
+		err = out.WriteFrame(s.handleJob(frame))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// handleJob processes a single job and returns the response, without its
+// length header.
+func (s *Simulator) handleJob(frame []byte) []byte {
+	in := &decoder{in: bytes.NewReader(frame)}
+	job := in.int32()
+
+	payload, err := s.runJob(job, in)
+
+	out := new(encoder)
+	switch e := err.(type) {
+	case nil:
+		out.int32(responseOK)
+		out.bytes(payload)
+	case processingError:
+		out.int32(responseProcessingError)
+		out.string(e.msg)
+		out.int32(e.code)
+	default:
+		out.int32(responseError)
+		out.string(e.Error())
+	}
+
+	return out.Bytes()
+}
+
+// runJob dispatches job to its handler, rejecting jobs that are not part of
+// the simulator's wire protocol version.
+func (s *Simulator) runJob(job int32, in *decoder) ([]byte, error) {
+	if s.accepts(job) {
+		switch job {
+		case jobKeyLoad:
+			return s.loadKey(in)
+		case jobKeyGen:
+			return s.generateKey(in)
+		case jobSignVote:
+			return s.signVote(in)
+		case jobSignProposal:
+			return s.signProposal(in)
+		case jobSignHeartbeat:
+			return s.signHeartbeat(in)
+		case jobPublicKey:
+			return s.publicKey()
+		case jobStatus:
+			return s.status()
+		case jobHello:
+			return s.hello(in)
+		case jobExportState:
+			return s.exportState()
+		case jobSeedState:
+			return s.seedState(in)
+		}
+	}
+
+	return nil, errors.Errorf("unknown job: %d", job)
+}
+
+// wireVersion returns the newest wire protocol version the simulator speaks.
+func (s *Simulator) wireVersion() int32 {
+	if s.WireVersion == 0 {
+		return module.MaxWireVersion
+	}
+	return s.WireVersion
+}
+
+// accepts reports whether job is part of the simulator's wire protocol.
+func (s *Simulator) accepts(job int32) bool {
+	for _, j := range jobsByVersion[s.wireVersion()] {
+		if j == job {
+			return true
+		}
+	}
+	return false
+}
+
+// hello chooses the newest wire protocol version offered by the host that the
+// simulator speaks, and lists the jobs accepted at that version.
+func (s *Simulator) hello(in *decoder) ([]byte, error) {
+	min := in.int32()
+	max := in.int32()
+	if in.err != nil {
+		return nil, in.err
+	}
+
+	version := s.wireVersion()
+	if max < version {
+		version = max
+	}
+	if version < min || version < module.WireVersion1 {
+		return nil, processingError{module.CodeUnsupportedVersion,
+			fmt.Sprintf("wire protocol versions %d to %d are not supported", min, max)}
+	}
+
+	jobs := make([]byte, len(jobsByVersion[version]))
+	for i, job := range jobsByVersion[version] {
+		jobs[i] = byte(job)
+	}
+
+	out := new(encoder)
+	out.int32(version)
+	out.bytes(jobs)
+	return out.Bytes(), nil
+}
+
+// loadKey unwraps a private key and makes it the key used for signing.
+func (s *Simulator) loadKey(in *decoder) ([]byte, error) {
+	wrapped := in.bytes()
+	if in.err != nil {
+		return nil, in.err
+	}
+
+	key, err := s.unwrap(wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	keyID := sha256.Sum256(wrapped)
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.key = key
+	s.keyID = keyID[:]
+	return nil, nil
+}
+
+// status reports the simulator's version, whether a key is loaded and the
+// last signed height, round and step.
+func (s *Simulator) status() ([]byte, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var keyLoaded int32
+	if s.key != nil {
+		keyLoaded = 1
+	}
+
+	out := new(encoder)
+	out.string(Version)
+	out.int32(keyLoaded)
+	out.int64(s.signed.Height)
+	out.int32(int32(s.signed.Round))
+	out.int32(int32(s.signed.Step))
+	return out.Bytes(), nil
+}
+
+// exportState returns the last signed height, round and step, signed with
+// the loaded key, along with its public key.
+func (s *Simulator) exportState() ([]byte, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.key == nil {
+		return nil, processingError{module.CodeKeyNotLoaded, "no key loaded"}
+	}
+
+	state := validator.SignedState{Height: s.signed.Height, Round: s.signed.Round, Step: s.signed.Step}
+
+	out := new(encoder)
+	out.int64(s.signed.Height)
+	out.int32(int32(s.signed.Round))
+	out.int32(int32(s.signed.Step))
+	out.bytes(s.key.Public().(ed25519.PublicKey))
+	out.bytes(ed25519.Sign(s.key, state.SignBytes()))
+	return out.Bytes(), nil
+}
+
+// seedState raises the last signed height, round and step to those given,
+// if they are later. Nothing may then be signed at them, since the data
+// signed there is unknown.
+func (s *Simulator) seedState(in *decoder) ([]byte, error) {
+	var seed validator.Position
+	seed.Height = in.int64()
+	seed.Round = int(in.int32())
+	seed.Step = int8(in.int32())
+	if in.err != nil {
+		return nil, in.err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.signed.Before(seed) {
+		s.signed, s.signBytes = seed, nil
+	}
+	return nil, nil
+}
+
+// publicKey returns the public key of the loaded key, and its identifier: the
+// SHA-256 hash of the wrapped key it was loaded from.
+func (s *Simulator) publicKey() ([]byte, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.key == nil {
+		return nil, processingError{module.CodeKeyNotLoaded, "no key loaded"}
+	}
+
+	out := new(encoder)
+	out.bytes(s.key.Public().(ed25519.PublicKey))
+	out.bytes(s.keyID)
+	return out.Bytes(), nil
+}
+
+// generateKey creates a new key pair, returning the public key and the
+// wrapped private key.
+func (s *Simulator) generateKey(in *decoder) ([]byte, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped, err := s.wrap(priv)
+	if err != nil {
+		return nil, err
+	}
+
+	out := new(encoder)
+	out.bytes(pub)
+	out.bytes(wrapped)
+	return out.Bytes(), nil
+}
+
+// signVote decodes a vote, checks for regressions and signs it.
+func (s *Simulator) signVote(in *decoder) ([]byte, error) {
+	chainID := in.string()
+	vote := &types.Vote{}
+	vote.BlockID.Hash = in.bytes()
+	vote.BlockID.PartsHeader.Hash = in.bytes()
+	vote.BlockID.PartsHeader.Total = int(in.int32())
+	vote.Height = in.int64()
+	vote.Round = int(in.int32())
+	timestamp := in.string()
+	vote.Type = byte(in.int32())
+	if in.err != nil {
+		return nil, processingError{module.CodeBadSignatureInput, in.err.Error()}
+	}
+
+	step, err := validator.VoteStep(vote)
+	if err != nil {
+		return nil, processingError{module.CodeBadSignatureInput, "unknown vote type"}
+	}
+
+	vote.Timestamp, err = parseTime(timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.signHRS(validator.Position{Height: vote.Height, Round: vote.Round, Step: step},
+		types.SignBytes(chainID, vote))
+}
+
+// signProposal decodes a proposal, checks for regressions and signs it.
+func (s *Simulator) signProposal(in *decoder) ([]byte, error) {
+	chainID := in.string()
+	proposal := &types.Proposal{}
+	proposal.BlockPartsHeader.Hash = in.bytes()
+	proposal.BlockPartsHeader.Total = int(in.int32())
+	proposal.Height = in.int64()
+	proposal.POLBlockID.Hash = in.bytes()
+	proposal.POLBlockID.PartsHeader.Hash = in.bytes()
+	proposal.POLBlockID.PartsHeader.Total = int(in.int32())
+	proposal.POLRound = int(in.int32())
+	proposal.Round = int(in.int32())
+	timestamp := in.string()
+	if in.err != nil {
+		return nil, processingError{module.CodeBadSignatureInput, in.err.Error()}
+	}
+
+	var err error
+	proposal.Timestamp, err = parseTime(timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.signHRS(validator.Position{Height: proposal.Height, Round: proposal.Round, Step: validator.StepPropose},
+		types.SignBytes(chainID, proposal))
+}
+
+// signHeartbeat decodes and signs a heartbeat. Heartbeats are not subject to
+// regression checks.
+func (s *Simulator) signHeartbeat(in *decoder) ([]byte, error) {
+	chainID := in.string()
+	hb := &types.Heartbeat{}
+	hb.Height = in.int64()
+	hb.Round = int(in.int32())
+	hb.Sequence = int(in.int32())
+	hb.ValidatorAddress = in.bytes()
+	hb.ValidatorIndex = int(in.int32())
+	if in.err != nil {
+		return nil, processingError{module.CodeBadSignatureInput, in.err.Error()}
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.key == nil {
+		return nil, processingError{module.CodeKeyNotLoaded, "no key loaded"}
+	}
+
+	return signatureResponse(ed25519.Sign(s.key, types.SignBytes(chainID, hb))), nil
+}
+
+// signHRS signs signBytes if its height, round and step advance the last
+// signed state. Identical sign bytes at the same height, round and step may
+// be signed again, since ed25519 signatures are deterministic.
+func (s *Simulator) signHRS(hrs validator.Position, signBytes []byte) ([]byte, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.key == nil {
+		return nil, processingError{module.CodeKeyNotLoaded, "no key loaded"}
+	}
+
+	if hrs.Before(s.signed) {
+		return nil, processingError{module.CodeHeightRegression, "height, round or step regression"}
+	}
+
+	if hrs == s.signed && !bytes.Equal(signBytes, s.signBytes) {
+		return nil, processingError{module.CodeHeightRegression, "conflicting data at same height, round and step"}
+	}
+
+	s.signed, s.signBytes = hrs, signBytes
+	return signatureResponse(ed25519.Sign(s.key, signBytes)), nil
+}
+
+// wrap encrypts the seed of priv under the wrapping key.
+func (s *Simulator) wrap(priv ed25519.PrivateKey) ([]byte, error) {
+	nonce := make([]byte, wrapNonceSize, wrappedKeySize)
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.wrapper.Seal(nonce, nonce, priv.Seed(), nil), nil
+}
+
+// unwrap reverses wrap.
+func (s *Simulator) unwrap(wrapped []byte) (ed25519.PrivateKey, error) {
+	if len(wrapped) != wrappedKeySize {
+		return nil, errors.Errorf("wrapped key must be %d bytes, found %d", wrappedKeySize, len(wrapped))
+	}
+
+	seed, err := s.wrapper.Open(nil, wrapped[:wrapNonceSize], wrapped[wrapNonceSize:], nil)
+	if err != nil {
+		return nil, errors.New("failed to unwrap key")
+	}
+
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// signatureResponse marshals a signature as the payload of a signing job.
+func signatureResponse(sig []byte) []byte {
+	out := new(encoder)
+	out.bytes(sig)
+	return out.Bytes()
+}
+
+// parseTime reverses types.CanonicalTime.
+func parseTime(timestamp string) (time.Time, error) {
+	t, err := time.Parse(wire.RFC3339Millis, timestamp)
+	if err != nil {
+		return t, processingError{module.CodeBadSignatureInput, "bad timestamp: " + timestamp}
+	}
+	return t, nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package simulator
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/thales-e-security/tendermint-hsm-validator/module"
+)
+
+func TestWrapUnwrap(t *testing.T) {
+	wrappingKey := make([]byte, 32)
+	rand.Read(wrappingKey)
+
+	sim, err := New(wrappingKey)
+	require.NoError(t, err)
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	wrapped, err := sim.wrap(priv)
+	require.NoError(t, err)
+	require.Len(t, wrapped, wrappedKeySize)
+
+	unwrapped, err := sim.unwrap(wrapped)
+	require.NoError(t, err)
+	require.Equal(t, priv, unwrapped)
+
+	wrapped[wrapNonceSize] ^= 1
+	_, err = sim.unwrap(wrapped)
+	require.Error(t, err)
+
+	otherKey := make([]byte, 32)
+	rand.Read(otherKey)
+	other, err := New(otherKey)
+	require.NoError(t, err)
+
+	wrapped, err = sim.wrap(priv)
+	require.NoError(t, err)
+	_, err = other.unwrap(wrapped)
+	require.Error(t, err)
+}
+
+func TestNewRequiresValidWrappingKey(t *testing.T) {
+	_, err := New(make([]byte, 16))
+	require.Error(t, err)
+}
+
+func TestHandleUnknownJob(t *testing.T) {
+	sim, err := New(make([]byte, 32))
+	require.NoError(t, err)
+
+	frame := new(encoder)
+	frame.int32(99)
+
+	in := &decoder{in: bytes.NewReader(sim.handleJob(frame.Bytes()))}
+	require.Equal(t, int32(responseError), in.int32())
+	require.Contains(t, in.string(), "unknown job")
+	require.NoError(t, in.err)
+}
+
+func TestHandleHello(t *testing.T) {
+	sim, err := New(make([]byte, 32))
+	require.NoError(t, err)
+
+	hello := func(min, max int32) *decoder {
+		frame := new(encoder)
+		frame.int32(jobHello)
+		frame.int32(min)
+		frame.int32(max)
+		return &decoder{in: bytes.NewReader(sim.handleJob(frame.Bytes()))}
+	}
+
+	in := hello(module.MinWireVersion, module.MaxWireVersion)
+	require.Equal(t, int32(responseOK), in.int32())
+	payload := &decoder{in: bytes.NewReader(in.bytes())}
+	require.Equal(t, module.MaxWireVersion, payload.int32())
+	require.Contains(t, payload.bytes(), byte(jobStatus))
+	require.NoError(t, payload.err)
+
+	// A host that only speaks version 1 is offered only version 1 jobs
+	in = hello(module.WireVersion1, module.WireVersion1)
+	require.Equal(t, int32(responseOK), in.int32())
+	payload = &decoder{in: bytes.NewReader(in.bytes())}
+	require.Equal(t, module.WireVersion1, payload.int32())
+	require.NotContains(t, payload.bytes(), byte(jobStatus))
+
+	in = hello(module.MaxWireVersion+1, module.MaxWireVersion+2)
+	require.Equal(t, int32(responseProcessingError), in.int32())
+	in.string()
+	require.Equal(t, module.CodeUnsupportedVersion, in.int32())
+	require.NoError(t, in.err)
+
+	// An older image does not know the hello job at all
+	sim.WireVersion = module.WireVersion1
+	in = hello(module.MinWireVersion, module.MaxWireVersion)
+	require.Equal(t, int32(responseError), in.int32())
+	require.Contains(t, in.string(), "unknown job")
+}
@@ -0,0 +1,121 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package simulator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// Response codes sent at the start of each reply, as understood by
+// module.ThalesHSM.
+const (
+	responseOK              = 0
+	responseError           = 1
+	responseProcessingError = 2
+	wordSize                = 4
+)
+
+// decoder reads the fields of a job. The first error encountered is
+// remembered and all later reads return zero values, so callers need only
+// check err once all fields are read.
+type decoder struct {
+	in  io.Reader
+	err error
+}
+
+func (d *decoder) int32() int32 {
+	var i int32
+	if d.err == nil {
+		d.err = binary.Read(d.in, binary.LittleEndian, &i)
+	}
+	return i
+}
+
+func (d *decoder) int64() int64 {
+	var i int64
+	if d.err == nil {
+		d.err = binary.Read(d.in, binary.LittleEndian, &i)
+	}
+	return i
+}
+
+func (d *decoder) bytes() []byte {
+	length := d.int32()
+	if d.err != nil {
+		return nil
+	}
+
+	if length < 0 {
+		d.err = errors.Errorf("negative field length: %d", length)
+		return nil
+	}
+
+	result := make([]byte, length)
+	_, d.err = io.ReadFull(d.in, result)
+	if d.err == nil {
+		_, d.err = io.CopyN(ioutil.Discard, d.in, int64(padding(int(length))))
+	}
+	return result
+}
+
+func (d *decoder) string() string {
+	s := d.bytes()
+	if len(s) == 0 {
+		if d.err == nil {
+			d.err = errors.New("string is missing its terminator")
+		}
+		return ""
+	}
+	return string(s[:len(s)-1])
+}
+
+// encoder writes the fields of a response.
+type encoder struct {
+	bytes.Buffer
+}
+
+func (e *encoder) int32(i int32) {
+	binary.Write(e, binary.LittleEndian, i)
+}
+
+func (e *encoder) int64(i int64) {
+	binary.Write(e, binary.LittleEndian, i)
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.Write(b)
+	e.Write(make([]byte, padding(len(b))))
+}
+
+func (e *encoder) string(s string) {
+	e.bytes(append([]byte(s), 0))
+}
+
+// padding calculates the amount of padding required to align with the word boundary.
+func padding(length int) int {
+	return (wordSize - (length % wordSize)) % wordSize
+}
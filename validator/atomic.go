@@ -0,0 +1,120 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package validator
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// tempFile is the part of *os.File used by writeFileAtomic.
+type tempFile interface {
+	io.Writer
+	Sync() error
+	Close() error
+	Name() string
+}
+
+// createTempFile creates the temporary file written by writeFileAtomic. It is
+// replaced by tests to simulate failures.
+var createTempFile = func(dir, prefix string) (tempFile, error) {
+	return ioutil.TempFile(dir, prefix)
+}
+
+// writeFileAtomic replaces the file at filePath with data, such that a crash
+// or failed write leaves either the old or the new contents in place. The data
+// is written to a temporary file in the same directory, which is synced and
+// renamed over filePath, then the directory is synced, where the platform
+// allows it, so that the rename is durable; see syncDir. If backups is positive, the previous file is kept as filePath.1,
+// and older backups are shifted up to filePath.<backups>.
+func writeFileAtomic(filePath string, data []byte, perm os.FileMode, backups int) (err error) {
+	dir := filepath.Dir(filePath)
+
+	f, err := createTempFile(dir, "."+filepath.Base(filePath)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), perm)
+	}
+	if err != nil {
+		return err
+	}
+
+	if backups > 0 {
+		err = rotateBackups(filePath, perm, backups)
+		if err != nil {
+			return errors.WithMessage(err, "failed to back up "+filePath)
+		}
+	}
+
+	err = os.Rename(f.Name(), filePath)
+	if err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// BackupFilePath returns the path of the nth most recent backup of the file
+// at filePath, counting from 1.
+func BackupFilePath(filePath string, n int) string {
+	return fmt.Sprintf("%s.%d", filePath, n)
+}
+
+// rotateBackups shifts the backups of filePath up by one, discarding the
+// oldest, and copies filePath to the first backup. The file at filePath is
+// left in place.
+func rotateBackups(filePath string, perm os.FileMode, backups int) error {
+	current, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for i := backups - 1; i > 0; i-- {
+		err = os.Rename(BackupFilePath(filePath, i), BackupFilePath(filePath, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return writeFileAtomic(BackupFilePath(filePath, 1), current, perm, 0)
+}
@@ -0,0 +1,141 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package validator
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// failingFile wraps a temporary file, failing writes after limit bytes, or
+// failing Sync if failSync is set.
+type failingFile struct {
+	*os.File
+	limit    int
+	failSync bool
+}
+
+func (f *failingFile) Write(p []byte) (int, error) {
+	if len(p) > f.limit {
+		n, _ := f.File.Write(p[:f.limit])
+		return n, errors.New("no space left on device")
+	}
+	return f.File.Write(p)
+}
+
+func (f *failingFile) Sync() error {
+	if f.failSync {
+		return errors.New("sync failed")
+	}
+	return f.File.Sync()
+}
+
+func withFailingFiles(limit int, failSync bool) func() {
+	original := createTempFile
+	createTempFile = func(dir, prefix string) (tempFile, error) {
+		f, err := ioutil.TempFile(dir, prefix)
+		if err != nil {
+			return nil, err
+		}
+		return &failingFile{File: f, limit: limit, failSync: failSync}, nil
+	}
+	return func() { createTempFile = original }
+}
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", t.Name())
+	require.NoError(t, err)
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func requireFiles(t *testing.T, dir string, expected map[string]string) {
+	infos, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+
+	found := make(map[string]string)
+	for _, info := range infos {
+		contents, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+		require.NoError(t, err)
+		found[info.Name()] = string(contents)
+		require.Equal(t, os.FileMode(0600), info.Mode().Perm(), info.Name())
+	}
+	require.Equal(t, expected, found)
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "file.json")
+
+	require.NoError(t, writeFileAtomic(path, []byte("first"), 0600, 0))
+	require.NoError(t, writeFileAtomic(path, []byte("second"), 0600, 0))
+	requireFiles(t, dir, map[string]string{"file.json": "second"})
+}
+
+func TestWriteFileAtomicFailingWriter(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "file.json")
+
+	require.NoError(t, writeFileAtomic(path, []byte("original"), 0600, 1))
+
+	testCases := []struct {
+		limit    int
+		failSync bool
+	}{
+		{limit: 0},
+		{limit: 3},
+		{limit: 100, failSync: true},
+	}
+
+	for _, tc := range testCases {
+		restore := withFailingFiles(tc.limit, tc.failSync)
+		err := writeFileAtomic(path, []byte("replacement"), 0600, 1)
+		restore()
+
+		// The original is intact, no backup is taken and the temporary file
+		// is removed
+		require.Error(t, err)
+		requireFiles(t, dir, map[string]string{"file.json": "original"})
+	}
+}
+
+func TestWriteFileAtomicBackups(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "file.json")
+
+	for _, contents := range []string{"v1", "v2", "v3", "v4"} {
+		require.NoError(t, writeFileAtomic(path, []byte(contents), 0600, 2))
+	}
+
+	requireFiles(t, dir, map[string]string{
+		"file.json":   "v4",
+		"file.json.1": "v3",
+		"file.json.2": "v2",
+	})
+	require.Equal(t, path+".1", BackupFilePath(path, 1))
+}
@@ -0,0 +1,639 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package validator
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tendermint/go-crypto"
+	"github.com/tendermint/go-wire/data"
+	"github.com/tendermint/tendermint/types"
+)
+
+// Operations recorded in the audit log.
+const (
+	AuditSignVote      = "SignVote"
+	AuditSignProposal  = "SignProposal"
+	AuditSignHeartbeat = "SignHeartbeat"
+	AuditSignFile      = "SignFile"
+	AuditLoadKeys      = "LoadKeys"
+	AuditGenerateKey   = "GenerateKey"
+	AuditSeedState     = "SeedState"
+
+	// AuditRepairLog records that an incomplete entry, left when the
+	// process stopped part way through writing it, was removed from the
+	// end of the log.
+	AuditRepairLog = "RepairLog"
+)
+
+// maxAuditEntry bounds the length of a line in the audit log.
+const maxAuditEntry = 1 << 20
+
+// maxAuditError bounds the length of the error recorded in an entry. Module
+// errors include messages from the module, which may be long.
+const maxAuditError = 64 << 10
+
+// MinAuditKeySize is the shortest key accepted for an audit log.
+const MinAuditKeySize = 32
+
+// AuditPartialFilePath returns the path of the file to which incomplete
+// entries are moved from the audit log at logFilePath.
+func AuditPartialFilePath(logFilePath string) string {
+	return logFilePath + ".partial"
+}
+
+// AuditEntry records one operation and its outcome. Fields that do not apply
+// to the operation are left empty. Error is empty, and Signature set, if a
+// signature was produced and released.
+type AuditEntry struct {
+	// Seq numbers the entries in the log, from 1.
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	Op   string    `json:"op"`
+
+	ChainID string `json:"chain_id,omitempty"`
+
+	// Type is "prevote", "precommit", "proposal" or "heartbeat".
+	Type   string `json:"type,omitempty"`
+	Height int64  `json:"height,omitempty"`
+	Round  int    `json:"round,omitempty"`
+	Step   int8   `json:"step,omitempty"`
+
+	// BlockID is the hash of the block voted for, or of the parts of the
+	// block proposed.
+	BlockID data.Bytes `json:"block_id,omitempty"`
+
+	// SignBytes are the bytes that were, or would have been, signed.
+	SignBytes data.Bytes `json:"sign_bytes,omitempty"`
+	Signature data.Bytes `json:"signature,omitempty"`
+
+	// PublicKey identifies the key loaded or generated.
+	PublicKey data.Bytes `json:"public_key,omitempty"`
+
+	Error string `json:"error,omitempty"`
+
+	// PrevHash is the Hash of the previous entry, and is empty for the first.
+	PrevHash data.Bytes `json:"prev_hash"`
+
+	// Hash is the HMAC-SHA256, with the log's key, of the entry's JSON
+	// encoding with an empty Hash, or its SHA-256 hash if the log has no key.
+	Hash data.Bytes `json:"hash"`
+}
+
+// computeHash returns the hash of e, ignoring its Hash field, keyed with key
+// unless it is nil.
+func (e AuditEntry) computeHash(key []byte) ([]byte, error) {
+	e.Hash = nil
+	encoded, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	if key == nil {
+		hash := sha256.Sum256(encoded)
+		return hash[:], nil
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(encoded)
+	return mac.Sum(nil), nil
+}
+
+// ReadAuditKey reads the key for an audit log from the file at filePath,
+// which holds at least MinAuditKeySize random bytes, e.g. as written by
+// "head -c 32 /dev/urandom". The key must be kept somewhere that those able
+// to write the log cannot read, or it protects nothing.
+func ReadAuditKey(filePath string) ([]byte, error) {
+	key, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to read audit log key")
+	}
+	if len(key) < MinAuditKeySize {
+		return nil, errors.Errorf("audit log key %s is %d bytes long, but must be at least %d",
+			filePath, len(key), MinAuditKeySize)
+	}
+	return key, nil
+}
+
+// AuditHead is the position of the last entry in an audit log.
+type AuditHead struct {
+	Entries uint64     `json:"entries"`
+	Hash    data.Bytes `json:"hash"`
+}
+
+// AuditHeadFilePath returns the path of the file that records the head of the
+// audit log at logFilePath.
+func AuditHeadFilePath(logFilePath string) string {
+	return logFilePath + ".head"
+}
+
+// AuditLog is an append-only log of the operations an HsmPrivValidator asks
+// of the HSM, as lines of JSON. Each entry includes the hash of the one before
+// it, and the head of the log is written to the file at AuditHeadFilePath
+// after each entry, so that an entry altered, removed or cut from the end is
+// detected by VerifyAuditLog.
+//
+// If the log has a key, the hashes are HMACs with it, so that entries cannot
+// be rewritten, nor the head moved, without the key. Without a key, this only
+// detects accidental damage or careless editing: anyone who can write the log
+// can rewrite every entry after the one they change, and the head, so that
+// the log still verifies.
+type AuditLog struct {
+	filePath string
+	key      []byte
+	lock     *fileLock
+
+	mtx  sync.Mutex
+	file *os.File
+	head AuditHead
+
+	// size is the length of the log up to the end of the last entry.
+	size int64
+
+	// err is set if an entry may have been partly written, after which
+	// nothing more can be appended.
+	err error
+}
+
+// OpenAuditLog opens the audit log at filePath for appending, creating it if
+// it does not exist. An existing log is verified first, and is refused if it
+// has been altered or truncated. An incomplete entry at the end of the log,
+// left if the process stopped while writing it, is instead moved to the file
+// at AuditPartialFilePath, and an AuditRepairLog entry records that it was.
+// The log is locked, via the file at filePath + ".lock", until it is closed
+// or the process exits. If key is not nil, the entries are keyed with it; see
+// ReadAuditKey. A log must always be opened with the key it was written with.
+func OpenAuditLog(filePath string, key []byte) (l *AuditLog, err error) {
+	lock, err := lockFile(filePath + ".lock")
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot use audit log "+filePath)
+	}
+	defer func() {
+		if err != nil {
+			lock.release()
+		}
+	}()
+
+	head, size, partial, err := readAuditLog(filePath, key, true, nil)
+	if err != nil {
+		return nil, err
+	}
+	if partial > 0 {
+		err = movePartialEntry(filePath, size)
+		if err != nil {
+			return nil, errors.WithMessage(err, fmt.Sprintf("failed to remove incomplete entry %d from audit log %s",
+				head.Entries+1, filePath))
+		}
+	}
+
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	l = &AuditLog{filePath: filePath, key: key, lock: lock, file: file, head: head, size: size}
+
+	// The head is behind if the process stopped between writing an entry
+	// and recording it
+	err = l.writeHead()
+	if err == nil && partial > 0 {
+		err = l.Append(AuditEntry{
+			Op: AuditRepairLog,
+			Error: fmt.Sprintf("entry %d was incomplete, and its %d bytes were moved to %s",
+				head.Entries+1, partial, AuditPartialFilePath(filePath)),
+		})
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// movePartialEntry appends everything after the first size bytes of the log
+// at filePath to the file at AuditPartialFilePath, followed by a newline, and
+// then truncates the log to size bytes.
+func movePartialEntry(filePath string, size int64) error {
+	logFile, err := os.OpenFile(filePath, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	_, err = logFile.Seek(size, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	partial, err := ioutil.ReadAll(logFile)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(AuditPartialFilePath(filePath), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(partial, '\n'))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = logFile.Truncate(size)
+	if err != nil {
+		return err
+	}
+	return logFile.Sync()
+}
+
+// Append completes entry with its sequence number, time and hashes, and
+// writes it to the log. The entry is synced to disk before Append returns. An
+// error longer than 64 KiB is truncated, and an entry that is still too long
+// to be read back is refused.
+//
+// If the entry, or the head that follows it, cannot be written, the log is
+// cut back to the previous entry, so that it does not record an operation
+// whose outcome was not released. If that fails too, nothing more can be
+// appended.
+func (l *AuditLog) Append(entry AuditEntry) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.err != nil {
+		return l.err
+	}
+
+	if len(entry.Error) > maxAuditError {
+		entry.Error = entry.Error[:maxAuditError] + "... (truncated)"
+	}
+
+	entry.Seq = l.head.Entries + 1
+	entry.Time = time.Now().UTC()
+	entry.PrevHash = l.head.Hash
+
+	hash, err := entry.computeHash(l.key)
+	if err != nil {
+		return err
+	}
+	entry.Hash = hash
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if len(line) > maxAuditEntry {
+		return errors.Errorf("audit log entry is %d bytes long, more than the limit of %d", len(line), maxAuditEntry)
+	}
+
+	_, err = l.file.Write(line)
+	if err == nil {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		return l.rollback(errors.Wrap(err, "failed to write audit log "+l.filePath))
+	}
+
+	previous := l.head
+	l.head = AuditHead{Entries: entry.Seq, Hash: hash}
+	err = l.writeHead()
+	if err != nil {
+		l.head = previous
+		return l.rollback(err)
+	}
+
+	l.size += int64(len(line))
+	return nil
+}
+
+// rollback removes anything written to the log after the last entry, after
+// err prevented an entry from being recorded, and returns err. If the log
+// cannot be cut back, it may record the entry, and nothing more can be
+// appended.
+func (l *AuditLog) rollback(err error) error {
+	truncErr := l.file.Truncate(l.size)
+	if truncErr == nil {
+		truncErr = l.file.Sync()
+	}
+	if truncErr != nil {
+		l.err = errors.Errorf("%v, and entry %d may remain in the log: %v", err, l.head.Entries+1, truncErr)
+		return l.err
+	}
+	return err
+}
+
+// Head returns the position of the last entry written.
+func (l *AuditLog) Head() AuditHead {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.head
+}
+
+// Close closes the log and releases its lock.
+func (l *AuditLog) Close() error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.err == nil {
+		l.err = errors.New("audit log is closed")
+	}
+
+	err := l.file.Close()
+	if lockErr := l.lock.release(); err == nil {
+		err = lockErr
+	}
+	return err
+}
+
+func (l *AuditLog) writeHead() error {
+	encoded, err := json.Marshal(l.head)
+	if err != nil {
+		return err
+	}
+	return errors.WithMessage(writeFileAtomic(AuditHeadFilePath(l.filePath), encoded, 0600, 0),
+		"failed to write audit log head")
+}
+
+// VerifyAuditLog checks that every entry in the audit log at filePath is
+// intact and follows the one before it, and that the log extends to the head
+// recorded alongside it. key is the key the log was written with, or nil if
+// it has none. It returns the head of the log.
+func VerifyAuditLog(filePath string, key []byte) (AuditHead, error) {
+	head, _, _, err := readAuditLog(filePath, key, false, nil)
+	return head, err
+}
+
+// ReadAuditLog verifies the audit log at filePath, as VerifyAuditLog does,
+// calling visit with each entry in turn. Since truncation is only detected
+// at the end of the log, entries must not be relied on unless ReadAuditLog
+// succeeds.
+func ReadAuditLog(filePath string, key []byte, visit func(AuditEntry) error) (AuditHead, error) {
+	head, _, _, err := readAuditLog(filePath, key, false, visit)
+	return head, err
+}
+
+// readAuditLog implements ReadAuditLog, and also returns the length of the
+// log up to the end of the last entry. If opening is set, a log that does not
+// exist, and has no head, is treated as empty, and an incomplete entry at the
+// end of the log is not an error: the length of what was written of it is
+// returned instead. visit may be nil.
+func readAuditLog(filePath string, key []byte, opening bool, visit func(AuditEntry) error) (
+	head AuditHead, size, partial int64, err error) {
+	// The head is read first, as the log may be appended to in the meantime
+	var recorded AuditHead
+	encoded, err := ioutil.ReadFile(AuditHeadFilePath(filePath))
+	headMissing := os.IsNotExist(err)
+	if err == nil {
+		err = json.Unmarshal(encoded, &recorded)
+		if err != nil {
+			return head, 0, 0, errors.WithMessage(err, "failed to parse audit log head")
+		}
+	} else if !headMissing {
+		return head, 0, 0, err
+	}
+
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) && headMissing && opening {
+		return head, 0, 0, nil
+	} else if err != nil {
+		return head, 0, 0, err
+	}
+	defer file.Close()
+
+	var checkpoint []byte
+	var visitErr error
+	head, size, err = scanAuditLog(file, key, func(entry AuditEntry) error {
+		if entry.Seq == recorded.Entries {
+			checkpoint = entry.Hash
+		}
+		if visit != nil {
+			visitErr = visit(entry)
+		}
+		return visitErr
+	})
+	if incomplete, ok := err.(incompleteEntryError); ok && opening {
+		partial, err = incomplete.length, nil
+	}
+	if visitErr != nil {
+		return head, size, partial, visitErr
+	} else if err != nil {
+		return head, size, partial, errors.WithMessage(err, "audit log "+filePath+" is damaged")
+	}
+
+	if headMissing {
+		if head.Entries == 0 && opening {
+			return head, size, partial, nil
+		}
+		return head, size, partial, errors.Errorf("audit log %s has no head file, so it may have been truncated", filePath)
+	}
+	if head.Entries < recorded.Entries {
+		return head, size, partial, errors.Errorf("audit log %s has been truncated: it has %d entries, but %d were written",
+			filePath, head.Entries, recorded.Entries)
+	}
+	if !bytes.Equal(checkpoint, recorded.Hash) {
+		return head, size, partial, errors.Errorf("audit log %s has been replaced: entry %d does not match its head",
+			filePath, recorded.Entries)
+	}
+
+	return head, size, partial, nil
+}
+
+// ScanAuditLog reads an audit log, written with key, from r, calling visit
+// with each entry in turn, and returns the head of the log. It fails if an
+// entry has been altered, removed or reordered, or if visit returns an error.
+func ScanAuditLog(r io.Reader, key []byte, visit func(AuditEntry) error) (AuditHead, error) {
+	head, _, err := scanAuditLog(r, key, visit)
+	return head, err
+}
+
+// incompleteEntryError is returned by scanAuditLog if the log ends with an
+// entry that has no newline.
+type incompleteEntryError struct {
+	seq    uint64
+	length int64
+}
+
+func (e incompleteEntryError) Error() string {
+	return fmt.Sprintf("entry %d is incomplete, %d bytes were written", e.seq, e.length)
+}
+
+// scanAuditLog implements ScanAuditLog, and also returns the length of the
+// log up to the end of the last complete entry.
+func scanAuditLog(r io.Reader, key []byte, visit func(AuditEntry) error) (head AuditHead, size int64, err error) {
+	reader := bufio.NewReaderSize(r, maxAuditEntry)
+
+	for {
+		line, err := reader.ReadSlice('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				return head, size, incompleteEntryError{seq: head.Entries + 1, length: int64(len(line))}
+			}
+			return head, size, nil
+		} else if err == bufio.ErrBufferFull {
+			return head, size, errors.Errorf("entry %d is too long", head.Entries+1)
+		} else if err != nil {
+			return head, size, err
+		}
+
+		entry, err := parseAuditEntry(line, key)
+		if err != nil {
+			return head, size, errors.WithMessage(err, fmt.Sprintf("entry %d", head.Entries+1))
+		}
+
+		if entry.Seq != head.Entries+1 {
+			return head, size, errors.Errorf("entry %d has sequence number %d", head.Entries+1, entry.Seq)
+		}
+		if !bytes.Equal(entry.PrevHash, head.Hash) {
+			return head, size, errors.Errorf("entry %d does not follow entry %d", entry.Seq, head.Entries)
+		}
+
+		err = visit(entry)
+		if err != nil {
+			return head, size, err
+		}
+
+		head = AuditHead{Entries: entry.Seq, Hash: entry.Hash}
+		size += int64(len(line))
+	}
+}
+
+// parseAuditEntry parses a line of the audit log, including its newline, and
+// checks its hash, keyed with key unless it is nil. The line must be exactly
+// as it was written.
+func parseAuditEntry(line []byte, key []byte) (AuditEntry, error) {
+	var entry AuditEntry
+
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&entry)
+	if err != nil {
+		return entry, err
+	}
+
+	hash, err := entry.computeHash(key)
+	if err != nil {
+		return entry, err
+	}
+	if !hmac.Equal(hash, entry.Hash) {
+		return entry, errors.New("hash does not match contents, the entry has been modified, " +
+			"or the log was written with a different key")
+	}
+
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		return entry, err
+	}
+	if !bytes.Equal(append(encoded, '\n'), line) {
+		return entry, errors.New("entry is not in its original form")
+	}
+
+	return entry, nil
+}
+
+// voteAuditEntry describes signing vote for chainID.
+func voteAuditEntry(chainID string, vote *types.Vote) AuditEntry {
+	entry := AuditEntry{
+		Op:        AuditSignVote,
+		ChainID:   chainID,
+		Height:    vote.Height,
+		Round:     vote.Round,
+		BlockID:   vote.BlockID.Hash,
+		SignBytes: types.SignBytes(chainID, vote),
+		Signature: signatureBytes(vote.Signature),
+	}
+
+	switch vote.Type {
+	case types.VoteTypePrevote:
+		entry.Type, entry.Step = "prevote", StepPrevote
+	case types.VoteTypePrecommit:
+		entry.Type, entry.Step = "precommit", StepPrecommit
+	default:
+		entry.Type = fmt.Sprintf("vote type %d", vote.Type)
+	}
+
+	return entry
+}
+
+// proposalAuditEntry describes signing proposal for chainID.
+func proposalAuditEntry(chainID string, proposal *types.Proposal) AuditEntry {
+	return AuditEntry{
+		Op:        AuditSignProposal,
+		ChainID:   chainID,
+		Type:      "proposal",
+		Height:    proposal.Height,
+		Round:     proposal.Round,
+		Step:      StepPropose,
+		BlockID:   proposal.BlockPartsHeader.Hash,
+		SignBytes: types.SignBytes(chainID, proposal),
+		Signature: signatureBytes(proposal.Signature),
+	}
+}
+
+// heartbeatAuditEntry describes signing heartbeat for chainID as op.
+func heartbeatAuditEntry(op, chainID string, heartbeat *types.Heartbeat) AuditEntry {
+	return AuditEntry{
+		Op:        op,
+		ChainID:   chainID,
+		Type:      "heartbeat",
+		Height:    heartbeat.Height,
+		Round:     heartbeat.Round,
+		SignBytes: types.SignBytes(chainID, heartbeat),
+		Signature: signatureBytes(heartbeat.Signature),
+	}
+}
+
+// seedAuditEntry describes seeding the HSM with state, for chainID.
+func seedAuditEntry(chainID string, state SignState) AuditEntry {
+	return AuditEntry{
+		Op:      AuditSeedState,
+		ChainID: chainID,
+		Height:  state.Height,
+		Round:   state.Round,
+		Step:    state.Step,
+	}
+}
+
+// signatureBytes returns the raw bytes of an Ed25519 signature, or nil if
+// sig is empty.
+func signatureBytes(sig crypto.Signature) []byte {
+	ed25519, ok := sig.Unwrap().(crypto.SignatureEd25519)
+	if !ok {
+		return nil
+	}
+	return ed25519[:]
+}
@@ -0,0 +1,139 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package validator
+
+import (
+	"bytes"
+
+	"github.com/pkg/errors"
+	"github.com/tendermint/tendermint/types"
+)
+
+// Outcomes of the operations in an audit log.
+const (
+	AuditOutcomeOK    = "ok"
+	AuditOutcomeError = "error"
+)
+
+// Outcome returns AuditOutcomeOK if the operation succeeded, and otherwise
+// AuditOutcomeError.
+func (e AuditEntry) Outcome() string {
+	if e.Error != "" {
+		return AuditOutcomeError
+	}
+	return AuditOutcomeOK
+}
+
+// AuditQuery selects entries from an audit log. Fields left empty match every
+// entry.
+type AuditQuery struct {
+	// MinHeight and MaxHeight bound the height of the entries, inclusively.
+	// A MaxHeight of zero is no bound.
+	MinHeight int64
+	MaxHeight int64
+
+	ChainID string
+	Type    string
+
+	// Outcome is AuditOutcomeOK or AuditOutcomeError.
+	Outcome string
+}
+
+// Matches reports whether entry is selected by q.
+func (q AuditQuery) Matches(entry AuditEntry) bool {
+	return entry.Height >= q.MinHeight &&
+		(q.MaxHeight == 0 || entry.Height <= q.MaxHeight) &&
+		(q.ChainID == "" || entry.ChainID == q.ChainID) &&
+		(q.Type == "" || entry.Type == q.Type) &&
+		(q.Outcome == "" || entry.Outcome() == q.Outcome)
+}
+
+// EvidenceVote is what an audit log shows about one of the votes in a
+// DuplicateVoteEvidence.
+type EvidenceVote struct {
+	Vote *types.Vote
+
+	// Valid is true if the vote's signature verifies against the
+	// validator's public key.
+	Valid bool
+
+	// Entry records the signature of the vote, or is nil if the log has no
+	// such signature.
+	Entry *AuditEntry
+}
+
+// EvidenceReport compares a DuplicateVoteEvidence with an audit log.
+type EvidenceReport struct {
+	// OurKey is true if the evidence is against the validator's public key.
+	OurKey bool
+
+	VoteA EvidenceVote
+	VoteB EvidenceVote
+}
+
+// Produced reports whether the audit log shows that the validator signed
+// both votes.
+func (r EvidenceReport) Produced() bool {
+	return r.OurKey && r.VoteA.Entry != nil && r.VoteB.Entry != nil
+}
+
+// CheckEvidence looks for the votes in evidence, against the validator with
+// the given public key on chainID, among the signatures recorded in the audit
+// log at filePath, written with key. The log is verified as it is read.
+func CheckEvidence(filePath string, key []byte, publicKey []byte, chainID string,
+	evidence *types.DuplicateVoteEvidence) (EvidenceReport, error) {
+
+	if evidence.VoteA == nil || evidence.VoteB == nil {
+		return EvidenceReport{}, errors.New("evidence must include two votes")
+	}
+
+	pv := HsmPrivValidator{PublicKey: publicKey}
+	report := EvidenceReport{
+		OurKey: pv.GetPubKey().Equals(evidence.PubKey),
+		VoteA:  checkEvidenceVote(&pv, chainID, evidence.VoteA),
+		VoteB:  checkEvidenceVote(&pv, chainID, evidence.VoteB),
+	}
+
+	_, err := ReadAuditLog(filePath, key, func(entry AuditEntry) error {
+		for _, vote := range []*EvidenceVote{&report.VoteA, &report.VoteB} {
+			if vote.Entry == nil && entry.matchesVote(vote.Vote) {
+				found := entry
+				vote.Entry = &found
+			}
+		}
+		return nil
+	})
+	return report, err
+}
+
+func checkEvidenceVote(pv *HsmPrivValidator, chainID string, vote *types.Vote) EvidenceVote {
+	return EvidenceVote{
+		Vote:  vote,
+		Valid: pv.GetPubKey().VerifyBytes(types.SignBytes(chainID, vote), vote.Signature),
+	}
+}
+
+// matchesVote reports whether e records the release of vote's signature.
+func (e AuditEntry) matchesVote(vote *types.Vote) bool {
+	signature := signatureBytes(vote.Signature)
+	return e.Op == AuditSignVote && e.Outcome() == AuditOutcomeOK &&
+		len(signature) > 0 && bytes.Equal(e.Signature, signature)
+}
@@ -0,0 +1,528 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package validator_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/tendermint/go-crypto"
+	"github.com/tendermint/tendermint/types"
+	"github.com/thales-e-security/tendermint-hsm-validator/mocks"
+	"github.com/thales-e-security/tendermint-hsm-validator/validator"
+)
+
+func tempAuditLog(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", t.Name())
+	require.NoError(t, err)
+	return filepath.Join(dir, "audit.jsonl"), func() { os.RemoveAll(dir) }
+}
+
+// readAuditLog returns the entries in the audit log at filePath.
+func readAuditLog(t *testing.T, filePath string) []validator.AuditEntry {
+	file, err := os.Open(filePath)
+	require.NoError(t, err)
+	defer file.Close()
+
+	var entries []validator.AuditEntry
+	_, err = validator.ScanAuditLog(file, nil, func(entry validator.AuditEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	require.NoError(t, err)
+	return entries
+}
+
+// writeAuditLog appends n entries to a new audit log at filePath.
+func writeAuditLog(t *testing.T, filePath string, n int) {
+	audit, err := validator.OpenAuditLog(filePath, nil)
+	require.NoError(t, err)
+	for i := 0; i < n; i++ {
+		require.NoError(t, audit.Append(validator.AuditEntry{Op: validator.AuditSignVote, Height: int64(i + 1)}))
+	}
+	require.NoError(t, audit.Close())
+}
+
+func TestAuditLogRecordsSigning(t *testing.T) {
+	logFile, cleanup := tempAuditLog(t)
+	defer cleanup()
+
+	audit, err := validator.OpenAuditLog(logFile, nil)
+	require.NoError(t, err)
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHSM := mocks.NewMockHsm(mockCtrl)
+
+	pv := validator.HsmPrivValidator{
+		Hsm:              signingHsm{mockHSM},
+		EncryptedPrivKey: []byte("private key"),
+		PublicKey:        testPublicKey(),
+		Audit:            audit,
+	}
+	defer pv.Close()
+
+	mockHSM.EXPECT().LoadKeys(pv.EncryptedPrivKey).Return(nil)
+	mockHSM.EXPECT().PublicKey().Return(validator.LoadedKey{}, nil)
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{}, nil)
+	mockHSM.EXPECT().SignVote(testChainID, gomock.Any()).Return(nil, nil)
+	mockHSM.EXPECT().SignHeartbeat(testChainID, gomock.Any()).Return(nil, nil)
+
+	vote := &types.Vote{Height: 5, Round: 1, Type: types.VoteTypePrecommit,
+		BlockID: types.BlockID{Hash: []byte("block hash")}}
+	require.NoError(t, pv.SignVote(testChainID, vote))
+
+	// Refused by the host, so the HSM is not asked
+	require.Error(t, pv.SignVote(testChainID, &types.Vote{Height: 4, Type: types.VoteTypePrevote}))
+
+	require.NoError(t, pv.SignHeartbeat(testChainID, &types.Heartbeat{Height: 5, Round: 1}))
+
+	entries := readAuditLog(t, logFile)
+	require.Len(t, entries, 4)
+
+	require.Equal(t, validator.AuditLoadKeys, entries[0].Op)
+	require.Equal(t, testPublicKey(), []byte(entries[0].PublicKey))
+	require.Empty(t, entries[0].Error)
+
+	signed := entries[1]
+	require.Equal(t, validator.AuditSignVote, signed.Op)
+	require.Equal(t, testChainID, signed.ChainID)
+	require.Equal(t, "precommit", signed.Type)
+	require.Equal(t, int64(5), signed.Height)
+	require.Equal(t, 1, signed.Round)
+	require.Equal(t, int8(3), signed.Step)
+	require.Equal(t, []byte("block hash"), []byte(signed.BlockID))
+	require.Equal(t, types.SignBytes(testChainID, vote), []byte(signed.SignBytes))
+	require.Equal(t, signatureBytes(vote.Signature), []byte(signed.Signature))
+	require.Empty(t, signed.Error)
+
+	refused := entries[2]
+	require.Equal(t, "prevote", refused.Type)
+	require.Equal(t, int64(4), refused.Height)
+	require.Empty(t, refused.Signature)
+	require.Contains(t, refused.Error, "height regression")
+
+	require.Equal(t, validator.AuditSignHeartbeat, entries[3].Op)
+	require.NotEmpty(t, entries[3].Signature)
+
+	head, err := validator.VerifyAuditLog(logFile, nil)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), head.Entries)
+	require.Equal(t, entries[3].Hash, head.Hash)
+}
+
+func TestAuditLogFollowsSigningOrder(t *testing.T) {
+	logFile, cleanup := tempAuditLog(t)
+	defer cleanup()
+
+	audit, err := validator.OpenAuditLog(logFile, nil)
+	require.NoError(t, err)
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHSM := mocks.NewMockHsm(mockCtrl)
+
+	pv := validator.HsmPrivValidator{
+		Hsm:              signingHsm{mockHSM},
+		EncryptedPrivKey: []byte("private key"),
+		PublicKey:        testPublicKey(),
+		Audit:            audit,
+	}
+	defer pv.Close()
+
+	const signers = 20
+
+	// The HSM is only asked while the sign lock is held, so this is the
+	// order in which the votes were signed
+	var signed []int64
+	mockHSM.EXPECT().LoadKeys(pv.EncryptedPrivKey).Return(nil)
+	mockHSM.EXPECT().PublicKey().Return(validator.LoadedKey{}, nil)
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{}, nil)
+	mockHSM.EXPECT().SignVote(testChainID, gomock.Any()).Do(func(_ string, vote *types.Vote) {
+		signed = append(signed, vote.Height)
+	}).Return(nil, nil).MaxTimes(signers)
+
+	var wg sync.WaitGroup
+	for i := 1; i <= signers; i++ {
+		wg.Add(1)
+		go func(height int64) {
+			defer wg.Done()
+			pv.SignVote(testChainID, &types.Vote{Height: height, Type: types.VoteTypePrevote})
+		}(int64(i))
+	}
+	wg.Wait()
+
+	var recorded []int64
+	for _, entry := range readAuditLog(t, logFile) {
+		if entry.Op == validator.AuditSignVote && entry.Error == "" {
+			recorded = append(recorded, entry.Height)
+		}
+	}
+	require.NotEmpty(t, signed)
+	require.Equal(t, signed, recorded)
+}
+
+func TestAuditLogWithholdsUnrecordedSignature(t *testing.T) {
+	logFile, cleanup := tempAuditLog(t)
+	defer cleanup()
+
+	audit, err := validator.OpenAuditLog(logFile, nil)
+	require.NoError(t, err)
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHSM := mocks.NewMockHsm(mockCtrl)
+
+	pv := validator.HsmPrivValidator{
+		Hsm:              signingHsm{mockHSM},
+		EncryptedPrivKey: []byte("private key"),
+		PublicKey:        testPublicKey(),
+		Audit:            audit,
+	}
+
+	mockHSM.EXPECT().LoadKeys(pv.EncryptedPrivKey).Return(nil)
+	mockHSM.EXPECT().PublicKey().Return(validator.LoadedKey{}, nil)
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{}, nil)
+	mockHSM.EXPECT().SignVote(testChainID, gomock.Any()).Return(nil, nil).Times(2)
+
+	require.NoError(t, pv.SignVote(testChainID, &types.Vote{Height: 1, Type: types.VoteTypePrevote}))
+	require.NoError(t, audit.Close())
+
+	// The HSM signs, but the signature is not released
+
+	vote := &types.Vote{Height: 2, Type: types.VoteTypePrevote}
+	err = pv.SignVote(testChainID, vote)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to write audit log")
+	require.True(t, vote.Signature.Empty())
+}
+
+func TestOpenAuditLogContinuesChain(t *testing.T) {
+	logFile, cleanup := tempAuditLog(t)
+	defer cleanup()
+
+	writeAuditLog(t, logFile, 2)
+
+	audit, err := validator.OpenAuditLog(logFile, nil)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), audit.Head().Entries)
+
+	// The log is in use
+	_, err = validator.OpenAuditLog(logFile, nil)
+	require.Error(t, err)
+
+	require.NoError(t, audit.Append(validator.AuditEntry{Op: validator.AuditLoadKeys}))
+	require.NoError(t, audit.Close())
+
+	entries := readAuditLog(t, logFile)
+	require.Len(t, entries, 3)
+	require.Equal(t, uint64(3), entries[2].Seq)
+	require.Equal(t, entries[1].Hash, entries[2].PrevHash)
+
+	_, err = validator.VerifyAuditLog(logFile, nil)
+	require.NoError(t, err)
+}
+
+func TestVerifyAuditLogDetectsTampering(t *testing.T) {
+	logFile, cleanup := tempAuditLog(t)
+	defer cleanup()
+
+	writeAuditLog(t, logFile, 3)
+
+	original, err := ioutil.ReadFile(logFile)
+	require.NoError(t, err)
+	head, err := ioutil.ReadFile(validator.AuditHeadFilePath(logFile))
+	require.NoError(t, err)
+	lines := bytes.SplitAfter(original, []byte("\n"))[:3]
+
+	// Another log of the same length, whose last entry differs from the head
+	writeAuditLog(t, logFile+".other", 3)
+	other, err := ioutil.ReadFile(logFile + ".other")
+	require.NoError(t, err)
+
+	for name, tampered := range map[string][]byte{
+		"altered":     bytes.Replace(original, []byte(`"height":2`), []byte(`"height":9`), 1),
+		"reformatted": bytes.Replace(original, []byte(`"height":2,`), []byte(`"height": 2,`), 1),
+		"removed":     append(append([]byte{}, lines[0]...), lines[2]...),
+		"reordered":   bytes.Join([][]byte{lines[1], lines[0], lines[2]}, nil),
+		"truncated":   bytes.Join(lines[:2], nil),
+		"replaced":    other,
+	} {
+		require.NoError(t, ioutil.WriteFile(logFile, tampered, 0600))
+
+		_, err := validator.VerifyAuditLog(logFile, nil)
+		require.Error(t, err, name)
+
+		_, err = validator.OpenAuditLog(logFile, nil)
+		require.Error(t, err, name)
+
+		require.NoError(t, ioutil.WriteFile(validator.AuditHeadFilePath(logFile), head, 0600))
+	}
+
+	// The head must not be lost
+	require.NoError(t, ioutil.WriteFile(logFile, original, 0600))
+	_, err = validator.VerifyAuditLog(logFile, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, os.Remove(validator.AuditHeadFilePath(logFile)))
+	_, err = validator.VerifyAuditLog(logFile, nil)
+	require.Error(t, err)
+}
+
+func TestKeyedAuditLog(t *testing.T) {
+	logFile, cleanup := tempAuditLog(t)
+	defer cleanup()
+
+	key := bytes.Repeat([]byte{1}, validator.MinAuditKeySize)
+	audit, err := validator.OpenAuditLog(logFile, key)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		require.NoError(t, audit.Append(validator.AuditEntry{Op: validator.AuditSignVote, Height: int64(i + 1)}))
+	}
+	require.NoError(t, audit.Close())
+
+	head, err := validator.VerifyAuditLog(logFile, key)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), head.Entries)
+
+	_, err = validator.VerifyAuditLog(logFile, nil)
+	require.Error(t, err, "no key")
+	_, err = validator.VerifyAuditLog(logFile, bytes.Repeat([]byte{2}, validator.MinAuditKeySize))
+	require.Error(t, err, "another key")
+
+	// A log and head rewritten without the key do not verify with it
+	writeAuditLog(t, logFile+".forged", 2)
+	for _, suffix := range []string{"", ".head"} {
+		forged, err := ioutil.ReadFile(logFile + ".forged" + suffix)
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(logFile+suffix, forged, 0600))
+	}
+	_, err = validator.VerifyAuditLog(logFile, key)
+	require.Error(t, err)
+	_, err = validator.OpenAuditLog(logFile, key)
+	require.Error(t, err)
+}
+
+func TestReadAuditKey(t *testing.T) {
+	logFile, cleanup := tempAuditLog(t)
+	defer cleanup()
+	keyFile := logFile + ".key"
+
+	require.NoError(t, ioutil.WriteFile(keyFile, make([]byte, validator.MinAuditKeySize-1), 0400))
+	_, err := validator.ReadAuditKey(keyFile)
+	require.Error(t, err)
+
+	require.NoError(t, os.Remove(keyFile))
+	require.NoError(t, ioutil.WriteFile(keyFile, make([]byte, validator.MinAuditKeySize), 0400))
+	key, err := validator.ReadAuditKey(keyFile)
+	require.NoError(t, err)
+	require.Len(t, key, validator.MinAuditKeySize)
+}
+
+func TestOpenAuditLogRemovesIncompleteEntry(t *testing.T) {
+	logFile, cleanup := tempAuditLog(t)
+	defer cleanup()
+
+	writeAuditLog(t, logFile, 2)
+
+	// The process stopped part way through the third entry
+	partial := []byte(`{"seq":3,"time":"2018-`)
+	file, err := os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND, 0600)
+	require.NoError(t, err)
+	_, err = file.Write(partial)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	_, err = validator.VerifyAuditLog(logFile, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "entry 3 is incomplete")
+
+	audit, err := validator.OpenAuditLog(logFile, nil)
+	require.NoError(t, err)
+	require.NoError(t, audit.Close())
+
+	entries := readAuditLog(t, logFile)
+	require.Len(t, entries, 3)
+	require.Equal(t, validator.AuditRepairLog, entries[2].Op)
+	require.Contains(t, entries[2].Error, "entry 3 was incomplete")
+
+	moved, err := ioutil.ReadFile(validator.AuditPartialFilePath(logFile))
+	require.NoError(t, err)
+	require.Equal(t, append(partial, '\n'), moved)
+
+	_, err = validator.VerifyAuditLog(logFile, nil)
+	require.NoError(t, err)
+}
+
+func TestAuditLogAcceptsLongErrors(t *testing.T) {
+	logFile, cleanup := tempAuditLog(t)
+	defer cleanup()
+
+	audit, err := validator.OpenAuditLog(logFile, nil)
+	require.NoError(t, err)
+
+	// Longer than the reader's default buffer, and longer than the limit
+	long := string(bytes.Repeat([]byte("e"), 5000))
+	tooLong := string(bytes.Repeat([]byte("\x01"), 1<<20))
+	require.NoError(t, audit.Append(validator.AuditEntry{Op: validator.AuditSignVote, Error: long}))
+	require.NoError(t, audit.Append(validator.AuditEntry{Op: validator.AuditSignVote, Error: tooLong}))
+	require.NoError(t, audit.Close())
+
+	audit, err = validator.OpenAuditLog(logFile, nil)
+	require.NoError(t, err)
+	require.NoError(t, audit.Close())
+
+	entries := readAuditLog(t, logFile)
+	require.Len(t, entries, 2)
+	require.Equal(t, long, entries[0].Error)
+	require.True(t, len(entries[1].Error) < len(tooLong))
+	require.Contains(t, entries[1].Error, "(truncated)")
+}
+
+func TestAuditLogRemovesEntryWithoutHead(t *testing.T) {
+	logFile, cleanup := tempAuditLog(t)
+	defer cleanup()
+
+	writeAuditLog(t, logFile, 1)
+	original, err := ioutil.ReadFile(logFile)
+	require.NoError(t, err)
+
+	audit, err := validator.OpenAuditLog(logFile, nil)
+	require.NoError(t, err)
+	defer audit.Close()
+
+	// The head cannot be replaced, so the entry is not recorded
+	headFile := validator.AuditHeadFilePath(logFile)
+	require.NoError(t, os.Remove(headFile))
+	require.NoError(t, os.Mkdir(headFile, 0700))
+
+	require.Error(t, audit.Append(validator.AuditEntry{Op: validator.AuditSignVote, Height: 2}))
+	written, err := ioutil.ReadFile(logFile)
+	require.NoError(t, err)
+	require.Equal(t, original, written)
+	require.Equal(t, uint64(1), audit.Head().Entries)
+
+	// Once the head can be written, the chain continues from the last entry
+	require.NoError(t, os.Remove(headFile))
+	require.NoError(t, audit.Append(validator.AuditEntry{Op: validator.AuditSignVote, Height: 2}))
+	require.Len(t, readAuditLog(t, logFile), 2)
+}
+
+func TestAuditQuery(t *testing.T) {
+	entry := validator.AuditEntry{ChainID: testChainID, Type: "prevote", Height: 5}
+	failed := entry
+	failed.Error = "height regression"
+
+	for _, tc := range []struct {
+		query   validator.AuditQuery
+		entry   validator.AuditEntry
+		matches bool
+	}{
+		{validator.AuditQuery{}, entry, true},
+		{validator.AuditQuery{MinHeight: 5, MaxHeight: 5}, entry, true},
+		{validator.AuditQuery{MinHeight: 6}, entry, false},
+		{validator.AuditQuery{MaxHeight: 4}, entry, false},
+		{validator.AuditQuery{ChainID: "other"}, entry, false},
+		{validator.AuditQuery{Type: "prevote"}, entry, true},
+		{validator.AuditQuery{Type: "precommit"}, entry, false},
+		{validator.AuditQuery{Outcome: validator.AuditOutcomeOK}, entry, true},
+		{validator.AuditQuery{Outcome: validator.AuditOutcomeOK}, failed, false},
+		{validator.AuditQuery{Outcome: validator.AuditOutcomeError}, failed, true},
+	} {
+		require.Equal(t, tc.matches, tc.query.Matches(tc.entry), "%+v", tc.query)
+	}
+}
+
+func TestCheckEvidence(t *testing.T) {
+	logFile, cleanup := tempAuditLog(t)
+	defer cleanup()
+
+	audit, err := validator.OpenAuditLog(logFile, nil)
+	require.NoError(t, err)
+	defer audit.Close()
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHSM := mocks.NewMockHsm(mockCtrl)
+
+	mockHSM.EXPECT().LoadKeys(gomock.Any()).Return(nil).Times(2)
+	mockHSM.EXPECT().PublicKey().Return(validator.LoadedKey{}, nil).Times(2)
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{}, nil).Times(2)
+	mockHSM.EXPECT().SignVote(testChainID, gomock.Any()).Return(nil, nil).Times(2)
+
+	newVote := func(block string) *types.Vote {
+		return &types.Vote{Height: 3, Type: types.VoteTypePrecommit, BlockID: types.BlockID{Hash: []byte(block)}}
+	}
+
+	pv := validator.HsmPrivValidator{
+		Hsm:              signingHsm{mockHSM},
+		EncryptedPrivKey: []byte("private key"),
+		PublicKey:        testPublicKey(),
+		Audit:            audit,
+	}
+	voteA := newVote("block A")
+	require.NoError(t, pv.SignVote(testChainID, voteA))
+
+	// Signed with the key, but not through the validator
+	voteB := newVote("block B")
+	voteB.Signature = testKey.Sign(types.SignBytes(testChainID, voteB))
+
+	evidence := &types.DuplicateVoteEvidence{PubKey: pv.GetPubKey(), VoteA: voteA, VoteB: voteB}
+	require.NoError(t, evidence.Verify(testChainID))
+
+	report, err := validator.CheckEvidence(logFile, nil, testPublicKey(), testChainID, evidence)
+	require.NoError(t, err)
+	require.True(t, report.OurKey)
+	require.NotNil(t, report.VoteA.Entry)
+	require.Equal(t, uint64(2), report.VoteA.Entry.Seq)
+	require.True(t, report.VoteB.Valid)
+	require.Nil(t, report.VoteB.Entry)
+	require.False(t, report.Produced())
+
+	// A second validator, without the first's sign state, signs the other
+	// vote through the same log
+	other := validator.HsmPrivValidator{
+		Hsm:              signingHsm{mockHSM},
+		EncryptedPrivKey: []byte("private key"),
+		PublicKey:        testPublicKey(),
+		Audit:            audit,
+	}
+	voteB = newVote("block B")
+	require.NoError(t, other.SignVote(testChainID, voteB))
+	evidence.VoteB = voteB
+
+	report, err = validator.CheckEvidence(logFile, nil, testPublicKey(), testChainID, evidence)
+	require.NoError(t, err)
+	require.True(t, report.Produced())
+
+	// Evidence against another validator
+	evidence.PubKey = crypto.GenPrivKeyEd25519().PubKey()
+	report, err = validator.CheckEvidence(logFile, nil, testPublicKey(), testChainID, evidence)
+	require.NoError(t, err)
+	require.False(t, report.OurKey)
+	require.False(t, report.Produced())
+}
@@ -0,0 +1,126 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package validator
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TimeoutError is returned when an HSM operation does not complete within
+// the timeout configured on the HsmPrivValidator.
+type TimeoutError struct {
+	// Op is the name of the operation that timed out, e.g. "SignVote".
+	Op string
+
+	// Limit is the timeout that was exceeded.
+	Limit time.Duration
+
+	// Err is the error returned by the Hsm when the operation was abandoned.
+	Err error
+}
+
+// Error implements error.
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %s: %v", e.Op, e.Limit, e.Err)
+}
+
+// Timeout always returns true. It allows TimeoutError to be detected in
+// the same way as a net.Error.
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// SignatureError is returned when a signature from the HSM does not verify
+// against the validator's public key, e.g. because it was corrupted or made
+// with another key. The signature is discarded rather than handed to Tendermint.
+type SignatureError struct {
+	// Op is the name of the operation that returned the signature, e.g.
+	// "SignVote".
+	Op string
+}
+
+// Error implements error.
+func (e *SignatureError) Error() string {
+	return fmt.Sprintf("%s: signature from HSM does not verify against the public key", e.Op)
+}
+
+// StateError is returned when the HSM's signed state does not match the
+// last signed state recorded by the host, and so cannot be trusted not to
+// sign again at a height, round and step already signed. An HSM that is
+// behind the host is seeded with the host's state first, so this is only
+// returned if the HSM is ahead of the host, or still differs once seeded.
+type StateError struct {
+	// HSM is the last height, round and step signed by the HSM.
+	HSM SignedState
+
+	// Host is the last height, round and step recorded by the host.
+	Host SignState
+}
+
+// Error implements error.
+func (e *StateError) Error() string {
+	if e.Host.Position().Before(e.HSM.Position()) {
+		return fmt.Sprintf("HSM has signed up to %s, beyond the %s recorded by this validator; "+
+			"if nothing else has signed with the key, run hsm-validator import-state to adopt the HSM's state",
+			e.HSM.Position(), e.Host.Position())
+	}
+	return fmt.Sprintf("HSM has signed up to %s, but this validator has signed %s, and seeding the HSM did not change it",
+		e.HSM.Position(), e.Host.Position())
+}
+
+// unsupportedError is returned for an operation from an optional interface,
+// such as PublicKeyHsm, that the Hsm does not implement. It is treated as
+// though the HSM had reported that it does not support the operation.
+type unsupportedError struct {
+	// Op is the name of the operation, e.g. "PublicKey".
+	Op string
+}
+
+// Error implements error.
+func (e *unsupportedError) Error() string {
+	return fmt.Sprintf("HSM does not support %s", e.Op)
+}
+
+// Unsupported always returns true. See isUnsupported.
+func (e *unsupportedError) Unsupported() bool {
+	return true
+}
+
+// isKeyNotLoaded reports whether err, or the error it wraps, indicates that
+// the HSM has no key loaded. See Hsm.
+func isKeyNotLoaded(err error) bool {
+	e, ok := errors.Cause(err).(interface {
+		KeyNotLoaded() bool
+	})
+	return ok && e.KeyNotLoaded()
+}
+
+// isUnsupported reports whether err, or the error it wraps, indicates that
+// the HSM does not support the operation. See Hsm.
+func isUnsupported(err error) bool {
+	e, ok := errors.Cause(err).(interface {
+		Unsupported() bool
+	})
+	return ok && e.Unsupported()
+}
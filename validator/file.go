@@ -0,0 +1,172 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package validator
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/tendermint/go-crypto"
+	"github.com/tendermint/go-wire/data"
+	"github.com/tendermint/tendermint/types"
+)
+
+// FileVersion is the version of the privValidator file format written by
+// SaveToFile. Files written before the format was versioned are treated as
+// version 1, and are migrated when loaded.
+const FileVersion = 2
+
+// LegacyFileSuffix is appended to the path of a version 1 privValidator file
+// to keep a copy of it when it is migrated.
+const LegacyFileSuffix = ".v1"
+
+// fileBindingPrefix begins the chain ID of the heartbeat that is signed to
+// bind a privValidator file to its key pair. No real chain uses it, so the
+// signature cannot be replayed as a heartbeat.
+const fileBindingPrefix = "hsm-priv-validator-file:"
+
+// privValidatorFile is the format in which an HsmPrivValidator is persisted.
+// Signature is made by the HSM with the validator key, over a heartbeat whose
+// chain ID carries a digest of the other fields, after unwrapping
+// EncryptedPrivKey. It binds the wrapped private key and the metadata to the
+// public key, and cannot be recomputed without the HSM.
+type privValidatorFile struct {
+	Version          int        `json:"version"`
+	ChainID          string     `json:"chain_id"`
+	Created          time.Time  `json:"created"`
+	SecurityWorld    string     `json:"security_world,omitempty"`
+	PublicKey        data.Bytes `json:"public_key"`
+	EncryptedPrivKey data.Bytes `json:"encrypted_priv_key"`
+	Signature        data.Bytes `json:"signature,omitempty"`
+}
+
+// legacyPrivValidatorFile is the version 1 format, which has no version,
+// metadata or integrity check.
+type legacyPrivValidatorFile struct {
+	EncryptedPrivKey []byte
+	PublicKey        []byte
+}
+
+// parsePrivValidatorFile parses the contents of a privValidator file. A
+// version 1 file is returned with legacy set, and no metadata. Later versions
+// are only returned if their signature verifies against their public key.
+func parsePrivValidatorFile(raw []byte) (file privValidatorFile, legacy bool, err error) {
+	var header struct {
+		Version int `json:"version"`
+	}
+	err = json.Unmarshal(raw, &header)
+	if err != nil {
+		return file, false, err
+	}
+
+	switch header.Version {
+	case 0:
+		var old legacyPrivValidatorFile
+		err = json.Unmarshal(raw, &old)
+		if err != nil {
+			return file, false, err
+		}
+		file = privValidatorFile{Version: 1, PublicKey: old.PublicKey, EncryptedPrivKey: old.EncryptedPrivKey}
+		legacy = true
+	case FileVersion:
+		err = json.Unmarshal(raw, &file)
+		if err != nil {
+			return file, false, err
+		}
+	default:
+		return file, false, errors.Errorf("unsupported version %d, expected %d", header.Version, FileVersion)
+	}
+
+	if len(file.EncryptedPrivKey) == 0 {
+		return file, false, errors.New("no encrypted private key")
+	}
+
+	if len(file.PublicKey) != len(crypto.PubKeyEd25519{}) {
+		return file, false, errors.Errorf("expected %d byte public key, found %d bytes",
+			len(crypto.PubKeyEd25519{}), len(file.PublicKey))
+	}
+
+	if !legacy {
+		ok, err := file.verify()
+		if err != nil {
+			return file, false, err
+		}
+		if !ok {
+			return file, false, errors.New("signature does not match contents, the file has been modified")
+		}
+	}
+
+	return file, legacy, nil
+}
+
+// ReadPublicKey returns the public key in the privValidator file at filePath,
+// without using an HSM. The file must be valid, but is not locked or migrated.
+func ReadPublicKey(filePath string) ([]byte, error) {
+	bytes, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	file, _, err := parsePrivValidatorFile(bytes)
+	if err != nil {
+		return nil, errors.WithMessage(err, "invalid privValidator file "+filePath)
+	}
+	return file.PublicKey, nil
+}
+
+// binding returns the chain ID and heartbeat whose signature binds the
+// contents of f, other than its signature.
+func (f privValidatorFile) binding() (string, *types.Heartbeat, error) {
+	f.Signature = nil
+	contents, err := json.Marshal(f)
+	if err != nil {
+		return "", nil, err
+	}
+
+	digest := sha256.Sum256(contents)
+	heartbeat := &types.Heartbeat{ValidatorAddress: f.pubKey().Address()}
+	return fileBindingPrefix + hex.EncodeToString(digest[:]), heartbeat, nil
+}
+
+// verify reports whether the signature in f is valid for its contents.
+func (f privValidatorFile) verify() (bool, error) {
+	chainID, heartbeat, err := f.binding()
+	if err != nil {
+		return false, err
+	}
+
+	sig, err := makeSignatureFromBytes(f.Signature)
+	if err != nil {
+		return false, nil
+	}
+
+	return f.pubKey().VerifyBytes(types.SignBytes(chainID, heartbeat), sig), nil
+}
+
+func (f privValidatorFile) pubKey() crypto.PubKey {
+	var pk crypto.PubKeyEd25519
+	copy(pk[:], f.PublicKey)
+	return crypto.PubKey{PubKeyInner: pk}
+}
@@ -0,0 +1,403 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package validator_test
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/require"
+	"github.com/tendermint/go-crypto"
+	"github.com/tendermint/tendermint/types"
+	"github.com/thales-e-security/tendermint-hsm-validator/mocks"
+	"github.com/thales-e-security/tendermint-hsm-validator/validator"
+)
+
+// wrongKeyHsm reports a key other than testKey, as if it had loaded a
+// wrapped key that does not match the public key.
+type wrongKeyHsm struct {
+	*mocks.MockHsm
+}
+
+func (h wrongKeyHsm) PublicKey() (validator.LoadedKey, error) {
+	key := validator.LoadedKey{ID: []byte{1, 2, 3}}
+	key.PublicKey = crypto.GenPrivKeyEd25519().PubKey().Unwrap().(crypto.PubKeyEd25519)
+	return key, nil
+}
+
+// unsupportedError is returned by an HSM that predates an operation.
+type unsupportedError struct{}
+
+func (unsupportedError) Error() string {
+	return "not supported"
+}
+
+func (unsupportedError) Unsupported() bool {
+	return true
+}
+
+func tempPrivValidatorFile(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", t.Name())
+	require.NoError(t, err)
+	return filepath.Join(dir, "hsm-priv-validator.json"), func() { os.RemoveAll(dir) }
+}
+
+// fileSigningHsm holds testKey, and only loads keys and signs heartbeats, as
+// needed to sign privValidator files for tests without a mocked HSM.
+type fileSigningHsm struct {
+	validator.Hsm
+}
+
+func (fileSigningHsm) LoadKeys(wrappedPrivKey []byte) error {
+	return nil
+}
+
+func (fileSigningHsm) PublicKey() (validator.LoadedKey, error) {
+	var key validator.LoadedKey
+	copy(key.PublicKey[:], testPublicKey())
+	return key, nil
+}
+
+func (fileSigningHsm) SignHeartbeat(chainID string, heartbeat *types.Heartbeat) ([]byte, error) {
+	return testSign(types.SignBytes(chainID, heartbeat)), nil
+}
+
+// saveTestFile writes a privValidator file for testKey, returning its fields.
+// It is signed with fileSigningHsm, so the tests' own HSMs are not used.
+func saveTestFile(t *testing.T, pvFile string) map[string]interface{} {
+	pv := validator.HsmPrivValidator{
+		Hsm:              fileSigningHsm{},
+		PublicKey:        testPublicKey(),
+		EncryptedPrivKey: []byte("private key"),
+		ChainID:          testChainID,
+	}
+	require.NoError(t, pv.SaveToFile(pvFile))
+
+	bytes, err := ioutil.ReadFile(pvFile)
+	require.NoError(t, err)
+
+	var fields map[string]interface{}
+	require.NoError(t, json.Unmarshal(bytes, &fields))
+	return fields
+}
+
+func writeJSON(t *testing.T, path string, value interface{}) {
+	bytes, err := json.Marshal(value)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(path, bytes, 0600))
+}
+
+func TestSaveToFileFormat(t *testing.T) {
+	pvFile, cleanup := tempPrivValidatorFile(t)
+	defer cleanup()
+
+	fields := saveTestFile(t, pvFile)
+	require.Equal(t, float64(validator.FileVersion), fields["version"])
+	require.Equal(t, testChainID, fields["chain_id"])
+	require.NotEmpty(t, fields["created"])
+	require.NotEmpty(t, fields["signature"])
+}
+
+func TestLoadLegacyFile(t *testing.T) {
+	pvFile, cleanup := tempPrivValidatorFile(t)
+	defer cleanup()
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHSM := mocks.NewMockHsm(mockCtrl)
+
+	legacy := []byte(fmt.Sprintf(`{"EncryptedPrivKey":"%s","PublicKey":"%s"}`,
+		base64.StdEncoding.EncodeToString([]byte("private key")),
+		base64.StdEncoding.EncodeToString(testPublicKey())))
+	require.NoError(t, ioutil.WriteFile(pvFile, legacy, 0600))
+
+	mockHSM.EXPECT().LoadKeys([]byte("private key")).Return(nil).Times(2)
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{}, nil).Times(2)
+	mockHSM.EXPECT().PublicKey().Return(validator.LoadedKey{}, nil).Times(2)
+
+	// Only the migrated file is signed; it is not signed again when loaded
+	mockHSM.EXPECT().SignHeartbeat(gomock.Any(), gomock.Any()).Return(nil, nil)
+
+	pv, err := validator.LoadFromFile(pvFile, signingHsm{mockHSM})
+	require.NoError(t, err)
+	require.Equal(t, testPublicKey(), pv.PublicKey)
+	require.Equal(t, "", pv.ChainID)
+
+	// The original is kept, and the file is rewritten in the current format
+	kept, err := ioutil.ReadFile(pvFile + validator.LegacyFileSuffix)
+	require.NoError(t, err)
+	require.Equal(t, legacy, kept)
+	require.NoError(t, pv.Close())
+
+	migrated, err := validator.LoadFromFile(pvFile, signingHsm{mockHSM})
+	require.NoError(t, err)
+	require.Equal(t, pv.EncryptedPrivKey, migrated.EncryptedPrivKey)
+	require.True(t, pv.Created.Equal(migrated.Created))
+}
+
+func TestLoadTamperedFile(t *testing.T) {
+	pvFile, cleanup := tempPrivValidatorFile(t)
+	defer cleanup()
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHSM := mocks.NewMockHsm(mockCtrl)
+
+	fields := saveTestFile(t, pvFile)
+
+	for field, value := range map[string]interface{}{
+		"chain_id":           "another-chain",
+		"created":            "2018-01-01T00:00:00Z",
+		"security_world":     "another-world",
+		"encrypted_priv_key": "00",
+		"signature":          "00",
+	} {
+		tampered := make(map[string]interface{})
+		for k, v := range fields {
+			tampered[k] = v
+		}
+		tampered[field] = value
+		writeJSON(t, pvFile, tampered)
+
+		// The HSM is not used
+		_, err := validator.LoadFromFile(pvFile, signingHsm{mockHSM})
+		require.Error(t, err, field)
+		require.Contains(t, err.Error(), "the file has been modified", field)
+	}
+}
+
+func TestReadPublicKey(t *testing.T) {
+	pvFile, cleanup := tempPrivValidatorFile(t)
+	defer cleanup()
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHSM := mocks.NewMockHsm(mockCtrl)
+
+	fields := saveTestFile(t, pvFile)
+
+	// The HSM is not used
+	publicKey, err := validator.ReadPublicKey(pvFile)
+	require.NoError(t, err)
+	require.Equal(t, testPublicKey(), publicKey)
+
+	fields["chain_id"] = "another-chain"
+	writeJSON(t, pvFile, fields)
+	_, err = validator.ReadPublicKey(pvFile)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "the file has been modified")
+}
+
+func TestLoadFileWithMismatchedKey(t *testing.T) {
+	pvFile, cleanup := tempPrivValidatorFile(t)
+	defer cleanup()
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHSM := mocks.NewMockHsm(mockCtrl)
+
+	saveTestFile(t, pvFile)
+
+	// The key is refused before the HSM is asked for its state
+	mockHSM.EXPECT().LoadKeys(gomock.Any()).Return(nil)
+
+	_, err := validator.LoadFromFile(pvFile, wrongKeyHsm{mockHSM})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "could not be bound to its public key")
+	require.Contains(t, err.Error(), "(ID 010203)")
+}
+
+func TestLoadFileWithoutPublicKeySupport(t *testing.T) {
+	pvFile, cleanup := tempPrivValidatorFile(t)
+	defer cleanup()
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHSM := mocks.NewMockHsm(mockCtrl)
+
+	saveTestFile(t, pvFile)
+
+	mockHSM.EXPECT().LoadKeys(gomock.Any()).Return(nil).Times(2)
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{}, nil)
+	mockHSM.EXPECT().PublicKey().Return(validator.LoadedKey{}, unsupportedError{}).Times(2)
+
+	// The wrapped key cannot be bound to the public key
+	_, err := validator.LoadFromFile(pvFile, signingHsm{mockHSM})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cannot report the public key")
+
+	pv, err := validator.LoadFromFileWithOptions(pvFile, signingHsm{mockHSM},
+		validator.LoadOptions{AllowUncheckedKey: true})
+	require.NoError(t, err)
+	require.NoError(t, pv.Close())
+
+	// Other errors still prevent the file from loading
+	mockHSM.EXPECT().LoadKeys(gomock.Any()).Return(nil)
+	mockHSM.EXPECT().PublicKey().Return(validator.LoadedKey{}, errors.New("module failed"))
+
+	_, err = validator.LoadFromFile(pvFile, signingHsm{mockHSM})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "module failed")
+}
+
+// basicHsm hides every method of an Hsm beyond those of the Hsm interface.
+type basicHsm struct {
+	validator.Hsm
+}
+
+func TestLoadFileWithBasicHsm(t *testing.T) {
+	pvFile, cleanup := tempPrivValidatorFile(t)
+	defer cleanup()
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHSM := mocks.NewMockHsm(mockCtrl)
+
+	saveTestFile(t, pvFile)
+
+	// An HSM that does not implement PublicKeyHsm is treated as one that
+	// cannot report its key, and one that does not implement StateHsm is
+	// not checked against the sign state
+	mockHSM.EXPECT().LoadKeys(gomock.Any()).Return(nil).Times(2)
+
+	_, err := validator.LoadFromFile(pvFile, basicHsm{signingHsm{mockHSM}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cannot report the public key")
+
+	pv, err := validator.LoadFromFileWithOptions(pvFile, basicHsm{signingHsm{mockHSM}},
+		validator.LoadOptions{AllowUncheckedKey: true})
+	require.NoError(t, err)
+	defer pv.Close()
+
+	mockHSM.EXPECT().SignVote(testChainID, gomock.Any()).Return(nil, nil)
+	require.NoError(t, pv.SignVote(testChainID, &types.Vote{Height: 1, Type: types.VoteTypePrevote}))
+
+	_, err = pv.ExportState()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "HSM does not support ExportState")
+}
+
+func TestLoadUnsupportedFile(t *testing.T) {
+	pvFile, cleanup := tempPrivValidatorFile(t)
+	defer cleanup()
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHSM := mocks.NewMockHsm(mockCtrl)
+
+	writeJSON(t, pvFile, map[string]interface{}{"version": validator.FileVersion + 1})
+	_, err := validator.LoadFromFile(pvFile, mockHSM)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unsupported version")
+
+	writeJSON(t, pvFile, map[string]interface{}{"PublicKey": testPublicKey()})
+	_, err = validator.LoadFromFile(pvFile, mockHSM)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no encrypted private key")
+}
+
+func TestSignRefusesOtherChain(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	pv := validator.HsmPrivValidator{Hsm: mocks.NewMockHsm(mockCtrl), ChainID: testChainID}
+
+	err := pv.SignVote("other", &types.Vote{Height: 1, Type: types.VoteTypePrevote})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `validator is for chain "chainID", not "other"`)
+
+	require.Error(t, pv.SignProposal("other", &types.Proposal{Height: 1}))
+	require.Error(t, pv.SignHeartbeat("other", &types.Heartbeat{}))
+}
+
+func TestLoadLockedFile(t *testing.T) {
+	pvFile, cleanup := tempPrivValidatorFile(t)
+	defer cleanup()
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHSM := mocks.NewMockHsm(mockCtrl)
+
+	saveTestFile(t, pvFile)
+
+	mockHSM.EXPECT().LoadKeys(gomock.Any()).Return(nil).Times(2)
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{}, nil).Times(2)
+	mockHSM.EXPECT().PublicKey().Return(validator.LoadedKey{}, nil).Times(2)
+
+	pv, err := validator.LoadFromFile(pvFile, signingHsm{mockHSM})
+	require.NoError(t, err)
+
+	// Neither a second validator nor a rewrite of the file is allowed
+	_, err = validator.LoadFromFile(pvFile, signingHsm{mockHSM})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), fmt.Sprintf("locked by this process (PID %d)", os.Getpid()))
+
+	other := validator.HsmPrivValidator{Hsm: signingHsm{mockHSM}, PublicKey: testPublicKey()}
+	err = other.SaveToFile(pvFile)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cannot write privValidator file")
+
+	require.NoError(t, pv.Close())
+
+	pv, err = validator.LoadFromFile(pvFile, signingHsm{mockHSM})
+	require.NoError(t, err)
+	require.NoError(t, pv.Close())
+}
+
+func TestLoadFileForOtherSecurityWorld(t *testing.T) {
+	pvFile, cleanup := tempPrivValidatorFile(t)
+	defer cleanup()
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHSM := mocks.NewMockHsm(mockCtrl)
+
+	pv := validator.HsmPrivValidator{
+		Hsm:              fileSigningHsm{},
+		PublicKey:        testPublicKey(),
+		EncryptedPrivKey: []byte("private key"),
+		SecurityWorld:    "world-1",
+	}
+	require.NoError(t, pv.SaveToFile(pvFile))
+
+	// The file is refused without any job being sent to the HSM
+	_, err := validator.LoadFromFileWithOptions(pvFile, signingHsm{mockHSM},
+		validator.LoadOptions{SecurityWorld: "world-2"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `is for Security World "world-1", not "world-2"`)
+
+	// The lock is released, so the file can be loaded for its own world
+	mockHSM.EXPECT().LoadKeys(gomock.Any()).Return(nil)
+	mockHSM.EXPECT().PublicKey().Return(validator.LoadedKey{}, nil)
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{}, unsupportedError{})
+
+	loaded, err := validator.LoadFromFileWithOptions(pvFile, signingHsm{mockHSM},
+		validator.LoadOptions{SecurityWorld: "world-1"})
+	require.NoError(t, err)
+	require.NoError(t, loaded.Close())
+}
@@ -21,6 +21,8 @@
 package validator
 
 import (
+	"context"
+
 	"github.com/tendermint/tendermint/types"
 )
 
@@ -31,7 +33,25 @@ type Ed25519KeyPair struct {
 	WrappedPrivateKey [64]byte
 }
 
-// Hsm defines the interface to the HSM.
+// LoadedKey describes the key the HSM has loaded.
+type LoadedKey struct {
+	PublicKey [32]byte
+
+	// ID identifies the key to operators, in a form chosen by the HSM.
+	ID []byte
+}
+
+// Hsm defines the interface to the HSM. If a signing operation fails because
+// the HSM no longer holds the key, e.g. after a restart, the error should
+// have a KeyNotLoaded() bool method that returns true. HsmPrivValidator then
+// reloads the key and retries the operation once.
+//
+// An HSM that can report the key it has loaded, or keep and export its
+// signed state, should also implement PublicKeyHsm or StateHsm. These are
+// detected when needed; without them, the loaded key or the HSM's signed
+// state is not checked. The same happens if an operation fails because the
+// HSM predates it, which is signalled by an error with an Unsupported() bool
+// method that returns true.
 type Hsm interface {
 	// LoadKeys loads the encrypted private key into the HSM.
 	LoadKeys(wrappedPrivKey []byte) error
@@ -54,3 +74,68 @@ type Hsm interface {
 	// it in the HSM.
 	SignHeartbeat(chainId string, hb *types.Heartbeat) ([]byte, error)
 }
+
+// PublicKeyHsm is implemented by Hsm types that can report the key they
+// have loaded, so that HsmPrivValidator can check it is the validator key.
+type PublicKeyHsm interface {
+	// PublicKey returns the public key, and an identifier, of the key
+	// loaded in the HSM.
+	PublicKey() (LoadedKey, error)
+}
+
+// StateHsm is implemented by Hsm types that remember the last height, round
+// and step they signed, so that HsmPrivValidator can compare it with the
+// host's sign state and seed an HSM that is behind.
+type StateHsm interface {
+	// ExportState returns the last height, round and step signed by the HSM,
+	// signed with the loaded key. See SignedState.
+	ExportState() (SignedState, error)
+
+	// SeedState raises the height, round and step at or before which the
+	// HSM will not sign. It never lowers them.
+	SeedState(height int64, round int, step int8) error
+}
+
+// ContextHsm is implemented by Hsm types that can abandon an operation
+// when its context is cancelled or its deadline passes. The methods
+// behave as their Hsm counterparts, but return an error as soon as
+// ctx is done.
+type ContextHsm interface {
+	Hsm
+
+	// LoadKeysContext is the context-aware form of LoadKeys.
+	LoadKeysContext(ctx context.Context, wrappedPrivKey []byte) error
+
+	// GenerateKeyContext is the context-aware form of GenerateKey.
+	GenerateKeyContext(ctx context.Context) (Ed25519KeyPair, error)
+
+	// SignVoteContext is the context-aware form of SignVote.
+	SignVoteContext(ctx context.Context, chainId string, vote *types.Vote) ([]byte, error)
+
+	// SignProposalContext is the context-aware form of SignProposal.
+	SignProposalContext(ctx context.Context, chainId string, proposal *types.Proposal) ([]byte, error)
+
+	// SignHeartbeatContext is the context-aware form of SignHeartbeat.
+	SignHeartbeatContext(ctx context.Context, chainId string, hb *types.Heartbeat) ([]byte, error)
+}
+
+// ContextPublicKeyHsm is implemented by PublicKeyHsm types that can abandon
+// PublicKey when its context is done, as ContextHsm does.
+type ContextPublicKeyHsm interface {
+	PublicKeyHsm
+
+	// PublicKeyContext is the context-aware form of PublicKey.
+	PublicKeyContext(ctx context.Context) (LoadedKey, error)
+}
+
+// ContextStateHsm is implemented by StateHsm types that can abandon an
+// operation when its context is done, as ContextHsm does.
+type ContextStateHsm interface {
+	StateHsm
+
+	// ExportStateContext is the context-aware form of ExportState.
+	ExportStateContext(ctx context.Context) (SignedState, error)
+
+	// SeedStateContext is the context-aware form of SeedState.
+	SeedStateContext(ctx context.Context, height int64, round int, step int8) error
+}
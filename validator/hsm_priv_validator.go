@@ -21,82 +21,561 @@
 package validator
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"sync"
+	"time"
 
 	"io/ioutil"
+	"path/filepath"
 
 	"github.com/pkg/errors"
 	"github.com/tendermint/go-crypto"
 	"github.com/tendermint/go-wire/data"
 	"github.com/tendermint/tendermint/types"
+	"github.com/tendermint/tmlibs/log"
 )
 
 // HsmPrivValidator is a Tendermint private validator that protects
 // keys and critical blockchain logic within a Thales nShield HSM.
+// It is safe for concurrent use, once its exported fields are set.
+// Votes and proposals are signed one at a time, in the order they
+// arrive; heartbeats do not wait for them.
 type HsmPrivValidator struct {
 	EncryptedPrivKey []byte
 	PublicKey        []byte
 	Hsm              Hsm `json:"-"`
-	keysLoaded       bool
+
+	// ChainID, if set, is the only chain for which the validator will sign.
+	ChainID string
+
+	// Created is when the validator was first saved.
+	Created time.Time
+
+	// SecurityWorld identifies the security world whose modules can load
+	// EncryptedPrivKey. It is recorded for operators, and is not checked.
+	SecurityWorld string
+
+	// Backups is the number of previous privValidator files kept by
+	// SaveToFile, from filePath.1, the most recent, to filePath.<Backups>.
+	Backups int `json:"-"`
+
+	// Timeout bounds each operation sent to the HSM. If zero, operations
+	// may block indefinitely. It only has an effect if Hsm implements
+	// ContextHsm; operations that exceed it fail with a *TimeoutError.
+	Timeout time.Duration `json:"-"`
+
+	// Metrics, if set, records the last signed height, round and step, and
+	// operations that timed out.
+	Metrics *Metrics `json:"-"`
+
+	// Audit, if set, records every signature requested and every key loaded
+	// or generated, with the outcome. A signature is not released unless it
+	// has been recorded.
+	Audit *AuditLog `json:"-"`
+
+	// AllowUncheckedKey lets the key be used when the HSM cannot report the
+	// public key of the key it has loaded; see LoadOptions.AllowUncheckedKey.
+	AllowUncheckedKey bool `json:"-"`
+
+	logger log.Logger
+
+	// lock is held on the file the validator was loaded from.
+	lock *fileLock
+
+	// signMtx serialises votes and proposals, so that they reach the HSM
+	// in a deterministic order and are recorded in Audit in that order, and
+	// guards signState.
+	signMtx   sync.Mutex
+	signState *SignState
+
+	// signed is the height, round and step of signState. It has its own
+	// mutex so that it can be compared with the HSM's state when the key is
+	// loaded, which may happen while signMtx is held.
+	signedMtx sync.Mutex
+	signed    Position
+
+	// keyMtx guards keysLoaded and keyGeneration, and is held while the key
+	// is loaded so that concurrent operations do not load it twice.
+	keyMtx        sync.Mutex
+	keysLoaded    bool
+	keyGeneration uint64
 }
 
 // NewHsmPrivValidator constructs a new HsmPrivValidator, including
-// generating a new key pair using the supplied Hsm interface. The
-// key pair will not be loaded after generation.
-func NewHsmPrivValidator(hsm Hsm) (HsmPrivValidator, error) {
-	result := HsmPrivValidator{}
+// generating a new key pair using the supplied Hsm interface. The key
+// pair is not loaded into the HSM until the validator first signs.
+func NewHsmPrivValidator(hsm Hsm) (*HsmPrivValidator, error) {
+	return NewHsmPrivValidatorWithAudit(hsm, nil)
+}
+
+// NewHsmPrivValidatorWithAudit is like NewHsmPrivValidator, but records the
+// key generation in audit, which is used by the result. audit may be nil.
+func NewHsmPrivValidatorWithAudit(hsm Hsm, audit *AuditLog) (*HsmPrivValidator, error) {
+	pv := &HsmPrivValidator{Hsm: hsm, Audit: audit}
+
 	pair, err := hsm.GenerateKey()
+	entry := AuditEntry{Op: AuditGenerateKey}
+	if err == nil {
+		entry.PublicKey = pair.PublicKey[:]
+	}
+	err = pv.audit(entry, err)
 	if err != nil {
-		return result, errors.WithMessage(err, "failed to generate key pair")
+		return nil, errors.WithMessage(err, "failed to generate key pair")
 	}
 
-	result.EncryptedPrivKey = pair.WrappedPrivateKey[:]
-	result.PublicKey = pair.PublicKey[:]
-	result.Hsm = hsm
-	return result, nil
+	pv.EncryptedPrivKey = pair.WrappedPrivateKey[:]
+	pv.PublicKey = pair.PublicKey[:]
+	return pv, nil
 }
 
-// LoadFromFile reads the privValidator from disk and loads the
-// keys into the HSM.
+// LoadFromFile reads the privValidator from disk, along with the last signed
+// state kept alongside it, and loads the keys into the HSM. The HSM must
+// report that it has loaded the key with the expected public key. An HSM that
+// has signed less than the last signed state is seeded with it, and one that
+// has signed more is refused; see StateError. The file's signature, and that
+// the sign state was recorded for the same key, are checked before the HSM is
+// used. A file in the version 1 format is migrated to the current one, keeping
+// a copy of the original at filePath + LegacyFileSuffix.
+//
+// The file and its sign state are locked, via the file at
+// LockFilePath(filePath), until the validator is closed or the process exits.
+// Loading fails if another process, or another validator in this process,
+// holds the lock.
 func LoadFromFile(filePath string, hsm Hsm) (*HsmPrivValidator, error) {
+	return LoadFromFileWithOptions(filePath, hsm, LoadOptions{})
+}
+
+// LoadOptions configures the validator returned by LoadFromFileWithOptions.
+// They are applied before the HSM is first used, so they also cover the
+// operations made while the file is loaded.
+type LoadOptions struct {
+	// Audit, Backups, Timeout, Metrics and AllowUncheckedKey set the fields
+	// of the same names.
+	Audit   *AuditLog
+	Backups int
+	Timeout time.Duration
+	Metrics *Metrics
+
+	// Logger, if set, is passed to SetLogger.
+	Logger log.Logger
+
+	// AllowUncheckedKey lets the file load when the HSM cannot report the
+	// public key of the key it has loaded, as CodeSafe machines that predate
+	// the public key job cannot. Binding the loaded key to the public key is
+	// then skipped, which is logged, so only the file's signature, made when
+	// it was saved, confirms that the wrapped key belongs to the public key.
+	AllowUncheckedKey bool
+
+	// SecurityWorld, if set, is the Security World the file must record.
+	// A file for another one is refused before the HSM is used.
+	SecurityWorld string
+}
+
+// LoadFromFileWithOptions is like LoadFromFile, but applies opts to the
+// result. If loading fails, opts.Audit is left open.
+func LoadFromFileWithOptions(filePath string, hsm Hsm, opts LoadOptions) (pv *HsmPrivValidator, err error) {
+	lock, err := lockFile(LockFilePath(filePath))
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot use privValidator file "+filePath)
+	}
+	defer func() {
+		if err != nil {
+			lock.release()
+			pv = nil
+		}
+	}()
+
 	bytes, err := ioutil.ReadFile(filePath)
 	if err != nil {
 		return nil, err
 	}
 
-	var pv HsmPrivValidator
-	err = json.Unmarshal(bytes, &pv)
+	file, legacy, err := parsePrivValidatorFile(bytes)
+	if err != nil {
+		return nil, errors.WithMessage(err, "invalid privValidator file "+filePath)
+	}
+
+	if opts.SecurityWorld != "" && file.SecurityWorld != opts.SecurityWorld {
+		return nil, errors.Errorf("privValidator file %s is for Security World %q, not %q",
+			filePath, file.SecurityWorld, opts.SecurityWorld)
+	}
+
+	pv = &HsmPrivValidator{
+		EncryptedPrivKey:  file.EncryptedPrivKey,
+		PublicKey:         file.PublicKey,
+		Hsm:               hsm,
+		ChainID:           file.ChainID,
+		Created:           file.Created,
+		SecurityWorld:     file.SecurityWorld,
+		Audit:             opts.Audit,
+		Backups:           opts.Backups,
+		Timeout:           opts.Timeout,
+		Metrics:           opts.Metrics,
+		AllowUncheckedKey: opts.AllowUncheckedKey,
+		logger:            opts.Logger,
+		lock:              lock,
+	}
+
+	pv.signState, err = LoadSignState(SignStateFilePath(filePath))
+	if err != nil {
+		return nil, err
+	}
+	err = pv.signState.CheckPublicKey(pv.PublicKey)
 	if err != nil {
 		return nil, err
 	}
+	pv.signState.PublicKey = pv.PublicKey
+	pv.setSigned(pv.signState.Position())
+
+	_, err = pv.ensureKeysLoaded()
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to load keys from "+filePath)
+	}
+
+	if legacy {
+		err = writeFileAtomic(filePath+LegacyFileSuffix, bytes, 0600, 0)
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to keep version 1 privValidator file")
+		}
+		err = pv.SaveToFile(filePath)
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to migrate privValidator file "+filePath)
+		}
+	}
+
+	return pv, nil
+}
+
+// Close releases the lock on the privValidator file taken by LoadFromFile,
+// and closes Audit, if set. It must not be called while the validator is in
+// use.
+func (pv *HsmPrivValidator) Close() error {
+	var err error
+	if pv.lock != nil {
+		err = pv.lock.release()
+		pv.lock = nil
+	}
+
+	if pv.Audit != nil {
+		if auditErr := pv.Audit.Close(); err == nil {
+			err = auditErr
+		}
+		pv.Audit = nil
+	}
 
-	pv.Hsm = hsm
-	err = pv.loadKeys()
-	return &pv, errors.WithMessage(err, "failed to load keys")
+	return err
 }
 
-// SaveToFile persists the private validator information to disk.
+// SaveToFile persists the private validator information to disk. The file is
+// signed by the HSM, which loads the key if necessary, and replaced atomically
+// so that a failure part way through leaves the previous file intact. The previous file is kept as a backup if
+// pv.Backups is positive. Unless pv was loaded from filePath, the file is
+// locked while it is written, so a file in use by another process is not
+// overwritten.
 func (pv *HsmPrivValidator) SaveToFile(filePath string) error {
+	lockPath, err := filepath.Abs(LockFilePath(filePath))
+	if err != nil {
+		return err
+	}
+
+	if pv.lock == nil || pv.lock.path != lockPath {
+		lock, err := lockFile(lockPath)
+		if err != nil {
+			return errors.WithMessage(err, "cannot write privValidator file "+filePath)
+		}
+		defer lock.release()
+	}
+
+	if pv.Created.IsZero() {
+		pv.Created = time.Now().UTC().Truncate(time.Second)
+	}
+
+	file := privValidatorFile{
+		Version:          FileVersion,
+		ChainID:          pv.ChainID,
+		Created:          pv.Created,
+		SecurityWorld:    pv.SecurityWorld,
+		PublicKey:        pv.PublicKey,
+		EncryptedPrivKey: pv.EncryptedPrivKey,
+	}
 
-	bytes, err := json.Marshal(pv)
+	err = pv.signFile(&file)
+	if err != nil {
+		return errors.WithMessage(err, "failed to sign privValidator file")
+	}
+
+	bytes, err := json.Marshal(file)
 	if err != nil {
 		return err
 	}
 
-	return ioutil.WriteFile(filePath, bytes, 0600)
+	return writeFileAtomic(filePath, bytes, 0600, pv.Backups)
 }
 
-// loadKeys loads the private key into the HSM
+// signFile asks the HSM to sign the binding of file, setting its signature.
+// The signature is verified, so this also confirms that the key the HSM
+// unwrapped from file.EncryptedPrivKey matches file.PublicKey.
+func (pv *HsmPrivValidator) signFile(file *privValidatorFile) error {
+	chainID, heartbeat, err := file.binding()
+	if err != nil {
+		return err
+	}
+
+	sigBytes, err := pv.signHeartbeat(chainID, heartbeat)
+	if err == nil {
+		heartbeat.Signature, err = pv.verifySignature("SignFile", types.SignBytes(chainID, heartbeat), sigBytes)
+	}
+
+	err = pv.audit(heartbeatAuditEntry(AuditSignFile, chainID, heartbeat), err)
+	if err != nil {
+		return err
+	}
+
+	file.Signature = sigBytes
+	return nil
+}
+
+// SetLogger sets the logger used to report recovery from HSM failures. It
+// must be called before the validator is used.
+func (pv *HsmPrivValidator) SetLogger(logger log.Logger) {
+	pv.logger = logger
+}
+
+// LastSignState returns a copy of the last signed height, round and step
+// recorded on the host.
+func (pv *HsmPrivValidator) LastSignState() SignState {
+	pv.signMtx.Lock()
+	defer pv.signMtx.Unlock()
+
+	if pv.signState == nil {
+		return SignState{}
+	}
+	return *pv.signState
+}
+
+// checkLoadedKey asks the HSM which key it has loaded, and returns an error
+// unless its public key is pv.PublicKey. Only the HSM can unwrap the private
+// key, so this binds the key each HSM loads to the public key, as the file's
+// signature did when it was saved. An HSM that cannot report its key is
+// refused, unless pv.AllowUncheckedKey is set, in which case the binding is
+// skipped and logged.
+func (pv *HsmPrivValidator) checkLoadedKey() error {
+	var key LoadedKey
+	err := pv.withTimeout("PublicKey", func(ctx context.Context) (err error) {
+		if hsm, ok := pv.Hsm.(ContextPublicKeyHsm); ok {
+			key, err = hsm.PublicKeyContext(ctx)
+		} else if hsm, ok := pv.Hsm.(PublicKeyHsm); ok {
+			key, err = hsm.PublicKey()
+		} else {
+			err = &unsupportedError{Op: "PublicKey"}
+		}
+		return err
+	})
+	if isUnsupported(err) && pv.AllowUncheckedKey {
+		pv.log().Error("HSM cannot report its loaded key, so binding it to the public key is skipped", "err", err)
+		return nil
+	} else if isUnsupported(err) {
+		return errors.WithMessage(err, "HSM cannot report the public key of the key it has loaded")
+	} else if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(key.PublicKey[:], pv.PublicKey) {
+		return errors.Errorf("the HSM unwrapped a key with public key %X (ID %X), but the public key recorded is %X",
+			key.PublicKey, key.ID, pv.PublicKey)
+	}
+
+	return nil
+}
+
+// ensureKeysLoaded loads the private key into the HSM, unless it has already
+// been loaded. It returns the generation of the loaded key, which increases
+// each time the key is loaded.
+func (pv *HsmPrivValidator) ensureKeysLoaded() (uint64, error) {
+	pv.keyMtx.Lock()
+	defer pv.keyMtx.Unlock()
+
+	if !pv.keysLoaded {
+		err := pv.loadKeys()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return pv.keyGeneration, nil
+}
+
+// reloadKeys loads the private key into the HSM again, after an operation
+// using the given key generation found that the HSM no longer held it.
+func (pv *HsmPrivValidator) reloadKeys(generation uint64, cause error) error {
+	pv.keyMtx.Lock()
+	defer pv.keyMtx.Unlock()
+
+	// Another operation may have already reloaded the key
+	if pv.keysLoaded && pv.keyGeneration != generation {
+		return nil
+	}
+
+	pv.keysLoaded = false
+	pv.metrics().KeyReloads.Add(1)
+	pv.log().Info("HSM has no key loaded, reloading", "err", cause)
+
+	err := pv.loadKeys()
+	if err != nil {
+		pv.log().Error("Failed to reload key into HSM", "err", err)
+		return errors.WithMessage(err, "failed to reload key")
+	}
+
+	return nil
+}
+
+// loadKeys loads the private key into the HSM, and checks that the HSM holds
+// the expected key and has signed as far as the host. It must be called with
+// keyMtx held. Since it is called again whenever the HSM reports that it has
+// no key, including after a FailoverHSM switches module, no HSM is used
+// without these checks.
 func (pv *HsmPrivValidator) loadKeys() error {
-	err := pv.Hsm.LoadKeys(pv.EncryptedPrivKey)
+	err := pv.withTimeout("LoadKeys", func(ctx context.Context) error {
+		if hsm, ok := pv.Hsm.(ContextHsm); ok {
+			return hsm.LoadKeysContext(ctx, pv.EncryptedPrivKey)
+		}
+		return pv.Hsm.LoadKeys(pv.EncryptedPrivKey)
+	})
+	if err == nil {
+		err = errors.WithMessage(pv.checkLoadedKey(), "wrapped key could not be bound to its public key")
+	}
+	if err == nil {
+		err = pv.checkHsmState()
+	}
+
+	err = pv.audit(AuditEntry{Op: AuditLoadKeys, PublicKey: pv.PublicKey}, err)
 	if err != nil {
 		return err
 	}
 
 	pv.keysLoaded = true
+	pv.keyGeneration++
 	return nil
 }
 
+// checkHsmState compares the HSM's signed state with the last signed state
+// recorded on the host. The host's state is persisted before every signature
+// is released, so it is authoritative. An HSM that is behind it, e.g. because
+// it restarted or is a standby that has not yet signed, is seeded with it,
+// which is recorded in Audit, and checked again. An HSM that is ahead of it
+// has signed something the host has no record of, and is refused with a
+// *StateError, as is one that does not match it after seeding. It must be
+// called with keyMtx held, once the key is loaded. HSMs that cannot export
+// their state are not checked.
+func (pv *HsmPrivValidator) checkHsmState() error {
+	state, err := pv.exportState()
+	if isUnsupported(err) {
+		pv.log().Error("HSM cannot export its signed state, so it was not checked", "err", err)
+		return nil
+	} else if err != nil {
+		return errors.WithMessage(err, "failed to check the HSM's signed state")
+	}
+
+	signed := pv.lastSigned()
+	host := SignState{Height: signed.Height, Round: signed.Round, Step: signed.Step}
+	if signed.Before(state.Position()) {
+		pv.log().Error("HSM is ahead of the last signed state", "hsm", state.Position(), "host", signed)
+		return &StateError{HSM: state, Host: host}
+	} else if state.Position() == signed {
+		return nil
+	}
+
+	pv.log().Info("HSM is behind the last signed state, seeding it", "hsm", state.Position(), "host", signed)
+	err = pv.seedState(signed)
+	err = pv.audit(seedAuditEntry(pv.ChainID, host), err)
+	if err != nil {
+		return errors.WithMessage(err, "failed to seed the HSM with the last signed state")
+	}
+
+	state, err = pv.exportState()
+	if err != nil {
+		return errors.WithMessage(err, "failed to check the HSM's signed state")
+	}
+
+	if state.Position() != signed {
+		pv.log().Error("HSM does not match the last signed state after seeding", "hsm", state.Position(), "host", signed)
+		return &StateError{HSM: state, Host: host}
+	}
+
+	return nil
+}
+
+// seedState asks the HSM not to sign at or before p.
+func (pv *HsmPrivValidator) seedState(p Position) error {
+	return pv.withTimeout("SeedState", func(ctx context.Context) error {
+		if hsm, ok := pv.Hsm.(ContextStateHsm); ok {
+			return hsm.SeedStateContext(ctx, p.Height, p.Round, p.Step)
+		} else if hsm, ok := pv.Hsm.(StateHsm); ok {
+			return hsm.SeedState(p.Height, p.Round, p.Step)
+		}
+		return &unsupportedError{Op: "SeedState"}
+	})
+}
+
+// ExportState returns the last height, round and step signed by the HSM,
+// signed with the validator key, loading the key if necessary. The result
+// can be used to seed another HSM with StateHsm.SeedState before it replaces
+// this one. It fails if the HSM does not implement StateHsm.
+func (pv *HsmPrivValidator) ExportState() (state SignedState, err error) {
+	_, err = pv.signWithKey(func() ([]byte, error) {
+		state, err = pv.exportState()
+		return nil, err
+	})
+	return state, err
+}
+
+// exportState asks the HSM for its signed state, and checks that it was
+// signed with the validator key.
+func (pv *HsmPrivValidator) exportState() (state SignedState, err error) {
+	err = pv.withTimeout("ExportState", func(ctx context.Context) (err error) {
+		if hsm, ok := pv.Hsm.(ContextStateHsm); ok {
+			state, err = hsm.ExportStateContext(ctx)
+		} else if hsm, ok := pv.Hsm.(StateHsm); ok {
+			state, err = hsm.ExportState()
+		} else {
+			err = &unsupportedError{Op: "ExportState"}
+		}
+		return err
+	})
+	if err != nil {
+		return state, err
+	}
+
+	if !bytes.Equal(state.PublicKey, pv.PublicKey) {
+		return state, errors.Errorf("HSM exported its state with public key %X, expected %X",
+			[]byte(state.PublicKey), pv.PublicKey)
+	}
+
+	_, err = pv.verifySignature("ExportState", state.SignBytes(), state.Signature)
+	return state, err
+}
+
+// setSigned records the last signed height, round and step, and reports them
+// in Metrics.
+func (pv *HsmPrivValidator) setSigned(p Position) {
+	pv.signedMtx.Lock()
+	pv.signed = p
+	pv.signedMtx.Unlock()
+
+	metrics := pv.metrics()
+	metrics.Height.Set(float64(p.Height))
+	metrics.Round.Set(float64(p.Round))
+	metrics.Step.Set(float64(p.Step))
+}
+
+func (pv *HsmPrivValidator) lastSigned() Position {
+	pv.signedMtx.Lock()
+	defer pv.signedMtx.Unlock()
+	return pv.signed
+}
+
 // GetAddress implements PrivValidator.GetAddress by simply
 // calling GetPubKey().Address().
 func (pv *HsmPrivValidator) GetAddress() data.Bytes {
@@ -109,81 +588,309 @@ func (pv *HsmPrivValidator) GetPubKey() crypto.PubKey {
 	// We just borrow the Tendermint ed25519 type
 	var pk [32]byte
 	copy(pk[:], pv.PublicKey)
-	return crypto.PubKey{crypto.PubKeyEd25519(pk)}
+	return crypto.PubKey{PubKeyInner: crypto.PubKeyEd25519(pk)}
 }
 
 // SignVote implements PrivValidator.SignVote by sending the signing
 // operation to the Thales HSM. This method will fail if there is a regression
-// in height, round or step.
+// in height, round or step, either in the HSM or in the last signed state
+// recorded on the host. If the same vote is signed twice, the previous
+// signature is returned.
 func (pv *HsmPrivValidator) SignVote(chainID string, vote *types.Vote) error {
-	if !pv.keysLoaded {
-		err := pv.loadKeys()
-		if err != nil {
-			return err
-		}
+	pv.signMtx.Lock()
+	defer pv.signMtx.Unlock()
+
+	signed := *vote
+	err := pv.signVote(chainID, &signed)
+
+	err = pv.audit(voteAuditEntry(chainID, &signed), err)
+	if err != nil {
+		return err
 	}
 
-	bytes, err := pv.Hsm.SignVote(chainID, vote)
+	*vote = signed
+	return nil
+}
+
+// signVote implements SignVote, setting the signature in vote. It must be
+// called with signMtx held.
+func (pv *HsmPrivValidator) signVote(chainID string, vote *types.Vote) error {
+	err := pv.checkChainID(chainID)
+	if err != nil {
+		return err
+	}
+
+	step, err := VoteStep(vote)
 	if err != nil {
 		return err
 	}
 
-	sig, err := makeSignatureFromBytes(bytes)
+	sig, timestamp, err := pv.signHRS("SignVote", vote.Height, vote.Round, step,
+		types.SignBytes(chainID, vote), votesOnlyDifferByTimestamp, func() (bytes []byte, err error) {
+			err = pv.withTimeout("SignVote", func(ctx context.Context) error {
+				if hsm, ok := pv.Hsm.(ContextHsm); ok {
+					bytes, err = hsm.SignVoteContext(ctx, chainID, vote)
+				} else {
+					bytes, err = pv.Hsm.SignVote(chainID, vote)
+				}
+				return err
+			})
+			return bytes, err
+		})
 	if err != nil {
 		return err
 	}
 
+	if !timestamp.IsZero() {
+		vote.Timestamp = timestamp
+	}
 	vote.Signature = sig
 	return nil
 }
 
 // SignProposal implements PrivValidator.SignProposal by sending the signing
 // operation to the Thales HSM. This method will fail if there is a regression
-// in height, round or step.
+// in height, round or step, either in the HSM or in the last signed state
+// recorded on the host. If the same proposal is signed twice, the previous
+// signature is returned.
 func (pv *HsmPrivValidator) SignProposal(chainID string, proposal *types.Proposal) error {
-	if !pv.keysLoaded {
-		err := pv.loadKeys()
-		if err != nil {
-			return err
-		}
+	pv.signMtx.Lock()
+	defer pv.signMtx.Unlock()
+
+	signed := *proposal
+	err := pv.signProposal(chainID, &signed)
+
+	err = pv.audit(proposalAuditEntry(chainID, &signed), err)
+	if err != nil {
+		return err
 	}
 
-	bytes, err := pv.Hsm.SignProposal(chainID, proposal)
+	*proposal = signed
+	return nil
+}
+
+// signProposal implements SignProposal, setting the signature in proposal. It
+// must be called with signMtx held.
+func (pv *HsmPrivValidator) signProposal(chainID string, proposal *types.Proposal) error {
+	err := pv.checkChainID(chainID)
 	if err != nil {
 		return err
 	}
 
-	sig, err := makeSignatureFromBytes(bytes)
+	sig, timestamp, err := pv.signHRS("SignProposal", proposal.Height, proposal.Round, StepPropose,
+		types.SignBytes(chainID, proposal), proposalsOnlyDifferByTimestamp, func() (bytes []byte, err error) {
+			err = pv.withTimeout("SignProposal", func(ctx context.Context) error {
+				if hsm, ok := pv.Hsm.(ContextHsm); ok {
+					bytes, err = hsm.SignProposalContext(ctx, chainID, proposal)
+				} else {
+					bytes, err = pv.Hsm.SignProposal(chainID, proposal)
+				}
+				return err
+			})
+			return bytes, err
+		})
 	if err != nil {
 		return err
 	}
 
+	if !timestamp.IsZero() {
+		proposal.Timestamp = timestamp
+	}
 	proposal.Signature = sig
 	return nil
 }
 
+// signHRS checks height, round and step against the last signed state before
+// asking the HSM to sign. If the state matches and signBytes are identical to
+// those last signed, or differ only in their timestamp, the previous signature
+// is returned instead. In the latter case, the previous timestamp is also
+// returned and must replace the one in the signed object. New signatures are
+// verified and persisted in the sign state before being returned. It must be
+// called with signMtx held.
+func (pv *HsmPrivValidator) signHRS(op string, height int64, round int, step int8, signBytes []byte,
+	onlyDifferByTimestamp func(last, new []byte) (time.Time, bool),
+	sign func() ([]byte, error)) (crypto.Signature, time.Time, error) {
+
+	if pv.signState == nil {
+		pv.signState = &SignState{PublicKey: pv.PublicKey}
+	}
+
+	sameHRS, err := pv.signState.check(height, round, step)
+	if err != nil {
+		return crypto.Signature{}, time.Time{}, err
+	}
+
+	if sameHRS {
+		if bytes.Equal(signBytes, pv.signState.SignBytes) {
+			return pv.signState.Signature, time.Time{}, nil
+		}
+		if timestamp, ok := onlyDifferByTimestamp(pv.signState.SignBytes, signBytes); ok {
+			return pv.signState.Signature, timestamp, nil
+		}
+		return crypto.Signature{}, time.Time{}, errors.Errorf(
+			"conflicting data at height %d, round %d, step %d", height, round, step)
+	}
+
+	sigBytes, err := pv.signWithKey(sign)
+	if err != nil {
+		return crypto.Signature{}, time.Time{}, err
+	}
+
+	sig, err := pv.verifySignature(op, signBytes, sigBytes)
+	if err != nil {
+		return crypto.Signature{}, time.Time{}, err
+	}
+
+	err = pv.signState.update(height, round, step, signBytes, sig)
+	if err != nil {
+		return crypto.Signature{}, time.Time{}, err
+	}
+	pv.setSigned(pv.signState.Position())
+
+	return sig, time.Time{}, nil
+}
+
 // SignHeartbeat implements PrivValidator.SignHeartbeat by sending the signing
-// operation to the Thales HSM.
+// operation to the Thales HSM. The signature is verified before it is returned.
 func (pv *HsmPrivValidator) SignHeartbeat(chainID string, heartbeat *types.Heartbeat) error {
-	if !pv.keysLoaded {
-		err := pv.loadKeys()
-		if err != nil {
-			return err
+	signed := *heartbeat
+	err := pv.checkChainID(chainID)
+	if err == nil {
+		var bytes []byte
+		bytes, err = pv.signHeartbeat(chainID, &signed)
+		if err == nil {
+			signed.Signature, err = pv.verifySignature("SignHeartbeat", types.SignBytes(chainID, &signed), bytes)
 		}
 	}
 
-	bytes, err := pv.Hsm.SignHeartbeat(chainID, heartbeat)
+	err = pv.audit(heartbeatAuditEntry(AuditSignHeartbeat, chainID, &signed), err)
+	if err != nil {
+		return err
+	}
+
+	*heartbeat = signed
+	return nil
+}
+
+// signHeartbeat asks the HSM to sign a heartbeat, returning the raw signature.
+func (pv *HsmPrivValidator) signHeartbeat(chainID string, heartbeat *types.Heartbeat) ([]byte, error) {
+	return pv.signWithKey(func() (bytes []byte, err error) {
+		err = pv.withTimeout("SignHeartbeat", func(ctx context.Context) error {
+			if hsm, ok := pv.Hsm.(ContextHsm); ok {
+				bytes, err = hsm.SignHeartbeatContext(ctx, chainID, heartbeat)
+			} else {
+				bytes, err = pv.Hsm.SignHeartbeat(chainID, heartbeat)
+			}
+			return err
+		})
+		return bytes, err
+	})
+}
+
+// checkChainID returns an error if the validator is bound to a chain other
+// than chainID.
+func (pv *HsmPrivValidator) checkChainID(chainID string) error {
+	if pv.ChainID != "" && chainID != pv.ChainID {
+		return errors.Errorf("validator is for chain %q, not %q", pv.ChainID, chainID)
+	}
+	return nil
+}
+
+// signWithKey loads the key into the HSM if necessary, then calls sign. If the
+// HSM reports that it no longer holds the key, e.g. because it restarted, the
+// key is reloaded and sign is called once more.
+func (pv *HsmPrivValidator) signWithKey(sign func() ([]byte, error)) ([]byte, error) {
+	generation, err := pv.ensureKeysLoaded()
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := sign()
+	if err == nil || !isKeyNotLoaded(err) {
+		return sig, err
+	}
+
+	err = pv.reloadKeys(generation, err)
 	if err != nil {
+		return nil, err
+	}
+
+	return sign()
+}
+
+// withTimeout runs op with a context bounded by pv.Timeout. If the deadline passes
+// before op completes, the resulting error is a *TimeoutError.
+func (pv *HsmPrivValidator) withTimeout(name string, op func(ctx context.Context) error) error {
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if pv.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, pv.Timeout)
+	}
+	defer cancel()
+
+	err := op(ctx)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		pv.metrics().Timeouts.With("op", name).Add(1)
+		return &TimeoutError{Op: name, Limit: pv.Timeout, Err: err}
+	}
+
+	return err
+}
+
+// audit records entry, with err as its outcome, in pv.Audit if it is set, and
+// returns err. If the entry cannot be recorded, an operation that succeeded
+// fails instead, so that nothing is signed without a record.
+func (pv *HsmPrivValidator) audit(entry AuditEntry, err error) error {
+	if pv.Audit == nil {
 		return err
 	}
 
-	sig, err := makeSignatureFromBytes(bytes)
 	if err != nil {
+		entry.Error = err.Error()
+		entry.Signature = nil
+	}
+
+	auditErr := pv.Audit.Append(entry)
+	if auditErr == nil {
 		return err
 	}
 
-	heartbeat.Signature = sig
-	return nil
+	pv.log().Error("Failed to write audit log", "op", entry.Op, "err", auditErr)
+	if err != nil {
+		return err
+	}
+	return errors.WithMessage(auditErr, "failed to write audit log")
+}
+
+func (pv *HsmPrivValidator) log() log.Logger {
+	if pv.logger == nil {
+		return log.NewNopLogger()
+	}
+	return pv.logger
+}
+
+func (pv *HsmPrivValidator) metrics() *Metrics {
+	if pv.Metrics == nil {
+		return NopMetrics()
+	}
+	return pv.Metrics
+}
+
+// verifySignature checks that sig, returned by the HSM for op, is a valid
+// signature of signBytes under the validator's public key. A signature that
+// does not verify results in a *SignatureError.
+func (pv *HsmPrivValidator) verifySignature(op string, signBytes, sig []byte) (crypto.Signature, error) {
+	result, err := makeSignatureFromBytes(sig)
+	if err != nil {
+		return crypto.Signature{}, err
+	}
+
+	if !pv.GetPubKey().VerifyBytes(signBytes, result) {
+		pv.metrics().BadSignatures.With("op", op).Add(1)
+		pv.log().Error("HSM returned a signature that does not verify", "op", op)
+		return crypto.Signature{}, &SignatureError{Op: op}
+	}
+
+	return result, nil
 }
 
 // makeSignatureFromBytes validates the length of a signature, then wraps it in
@@ -198,5 +905,5 @@ func makeSignatureFromBytes(sig []byte) (crypto.Signature, error) {
 	var sigBytes [64]byte
 	copy(sigBytes[:], sig)
 
-	return crypto.Signature{crypto.SignatureEd25519(sigBytes)}, nil
+	return crypto.Signature{SignatureInner: crypto.SignatureEd25519(sigBytes)}, nil
 }
@@ -21,14 +21,20 @@
 package validator_test // in this package to avoid mocking circular dependencies
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"crypto/rand"
 
 	"github.com/golang/mock/gomock"
+	pkgerrors "github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/require"
 	"github.com/tendermint/go-crypto"
 	"github.com/tendermint/tendermint/types"
@@ -45,23 +51,35 @@ func TestSaveRestoreAndLoad(t *testing.T) {
 	mockHSM := mocks.NewMockHsm(mockCtrl)
 
 	pv := validator.HsmPrivValidator{
-		Hsm:              mockHSM,
-		PublicKey:        []byte("public key"),
+		Hsm:              signingHsm{mockHSM},
+		PublicKey:        testPublicKey(),
 		EncryptedPrivKey: []byte("private key"),
+		ChainID:          testChainID,
+		SecurityWorld:    "world-1",
 	}
 
-	pv.SaveToFile(tempfilename)
+	// Saving and loading both load the key, and saving has the HSM sign the
+	// file
+	mockHSM.EXPECT().LoadKeys(pv.EncryptedPrivKey).Return(nil).Times(2)
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{}, nil).Times(2)
+	mockHSM.EXPECT().PublicKey().Return(validator.LoadedKey{}, nil).Times(2)
+	mockHSM.EXPECT().SignHeartbeat(gomock.Any(), gomock.Any()).Return(nil, nil)
+
+	require.NoError(t, pv.SaveToFile(tempfilename))
 
 	_, err := os.Stat(tempfilename)
 	require.NoError(t, err)
 	defer os.Remove(tempfilename)
+	defer os.Remove(validator.LockFilePath(tempfilename))
 
-	mockHSM.EXPECT().LoadKeys(pv.EncryptedPrivKey).Return(nil).Times(1)
-
-	pv2, err := validator.LoadFromFile(tempfilename, mockHSM)
+	pv2, err := validator.LoadFromFile(tempfilename, signingHsm{mockHSM})
 	require.NoError(t, err)
 	require.Equal(t, pv.PublicKey, pv2.PublicKey)
 	require.Equal(t, pv.EncryptedPrivKey, pv2.EncryptedPrivKey)
+	require.Equal(t, testChainID, pv2.ChainID)
+	require.Equal(t, "world-1", pv2.SecurityWorld)
+	require.True(t, pv.Created.Equal(pv2.Created))
+	require.NoError(t, pv2.Close())
 }
 
 func TestGetPubKeyAndAddress(t *testing.T) {
@@ -105,19 +123,22 @@ func TestSignVote(t *testing.T) {
 
 	const chainID = "chainID"
 
-	vote := types.Vote{}
+	vote := types.Vote{Type: types.VoteTypePrevote}
 
 	var sig [64]byte
-	rand.Read(sig[:])
+	copy(sig[:], testSign(types.SignBytes(chainID, &vote)))
 
 	pk := []byte("private key")
 
 	mockHSM.EXPECT().SignVote(chainID, &vote).Return(sig[:], nil).Times(1)
 	mockHSM.EXPECT().LoadKeys(pk).Return(nil).Times(1)
+	mockHSM.EXPECT().PublicKey().Return(validator.LoadedKey{}, nil).Times(1)
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{}, nil).Times(1)
 
 	pv := validator.HsmPrivValidator{
 		EncryptedPrivKey: pk,
-		Hsm:              mockHSM,
+		PublicKey:        testPublicKey(),
+		Hsm:              signingHsm{mockHSM},
 	}
 
 	err := pv.SignVote(chainID, &vote)
@@ -137,16 +158,19 @@ func TestSignProposal(t *testing.T) {
 	proposal := types.Proposal{}
 
 	var sig [64]byte
-	rand.Read(sig[:])
+	copy(sig[:], testSign(types.SignBytes(chainID, &proposal)))
 
 	pk := []byte("private key")
 
 	mockHSM.EXPECT().SignProposal(chainID, &proposal).Return(sig[:], nil).Times(1)
 	mockHSM.EXPECT().LoadKeys(pk).Return(nil).Times(1)
+	mockHSM.EXPECT().PublicKey().Return(validator.LoadedKey{}, nil).Times(1)
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{}, nil).Times(1)
 
 	pv := validator.HsmPrivValidator{
 		EncryptedPrivKey: pk,
-		Hsm:              mockHSM,
+		PublicKey:        testPublicKey(),
+		Hsm:              signingHsm{mockHSM},
 	}
 
 	err := pv.SignProposal(chainID, &proposal)
@@ -166,16 +190,19 @@ func TestSignHeartbeat(t *testing.T) {
 	heartbeat := types.Heartbeat{}
 
 	var sig [64]byte
-	rand.Read(sig[:])
+	copy(sig[:], testSign(types.SignBytes(chainID, &heartbeat)))
 
 	pk := []byte("private key")
 
 	mockHSM.EXPECT().SignHeartbeat(chainID, &heartbeat).Return(sig[:], nil).Times(1)
 	mockHSM.EXPECT().LoadKeys(pk).Return(nil).Times(1)
+	mockHSM.EXPECT().PublicKey().Return(validator.LoadedKey{}, nil).Times(1)
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{}, nil).Times(1)
 
 	pv := validator.HsmPrivValidator{
 		EncryptedPrivKey: pk,
-		Hsm:              mockHSM,
+		PublicKey:        testPublicKey(),
+		Hsm:              signingHsm{mockHSM},
 	}
 
 	err := pv.SignHeartbeat(chainID, &heartbeat)
@@ -184,3 +211,392 @@ func TestSignHeartbeat(t *testing.T) {
 	result := [64]byte(heartbeat.Signature.SignatureInner.(crypto.SignatureEd25519))
 	require.Equal(t, sig, result)
 }
+
+// blockingHsm is a ContextHsm that loads keys immediately and cannot export
+// its state, but whose other operations do not complete until their context
+// is done. If publicKey is set, it reports that key as loaded immediately.
+type blockingHsm struct {
+	validator.Hsm
+	publicKey []byte
+}
+
+func (blockingHsm) LoadKeysContext(ctx context.Context, wrappedPrivKey []byte) error {
+	return nil
+}
+
+func (blockingHsm) GenerateKeyContext(ctx context.Context) (validator.Ed25519KeyPair, error) {
+	<-ctx.Done()
+	return validator.Ed25519KeyPair{}, ctx.Err()
+}
+
+func (h blockingHsm) PublicKeyContext(ctx context.Context) (validator.LoadedKey, error) {
+	var key validator.LoadedKey
+	if h.publicKey != nil {
+		copy(key.PublicKey[:], h.publicKey)
+		return key, nil
+	}
+	<-ctx.Done()
+	return key, ctx.Err()
+}
+
+func (blockingHsm) ExportStateContext(ctx context.Context) (validator.SignedState, error) {
+	return validator.SignedState{}, unsupportedError{}
+}
+
+func (blockingHsm) SeedStateContext(ctx context.Context, height int64, round int, step int8) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (blockingHsm) SignVoteContext(ctx context.Context, chainId string, vote *types.Vote) ([]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (blockingHsm) SignProposalContext(ctx context.Context, chainId string,
+	proposal *types.Proposal) ([]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (blockingHsm) SignHeartbeatContext(ctx context.Context, chainId string, hb *types.Heartbeat) ([]byte, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestSignTimeout(t *testing.T) {
+	pv := validator.HsmPrivValidator{
+		EncryptedPrivKey: []byte("private key"),
+		PublicKey:        testPublicKey(),
+		Hsm:              blockingHsm{publicKey: testPublicKey()},
+		Timeout:          50 * time.Millisecond,
+	}
+
+	err := pv.SignVote("chainID", &types.Vote{Type: types.VoteTypePrevote})
+	require.Error(t, err)
+
+	timeoutErr, ok := err.(*validator.TimeoutError)
+	require.True(t, ok, "expected *TimeoutError, got %T", err)
+	require.Equal(t, "SignVote", timeoutErr.Op)
+	require.Equal(t, pv.Timeout, timeoutErr.Limit)
+	require.Equal(t, context.DeadlineExceeded, timeoutErr.Err)
+
+	err = pv.SignProposal("chainID", &types.Proposal{})
+	require.IsType(t, &validator.TimeoutError{}, err)
+
+	err = pv.SignHeartbeat("chainID", &types.Heartbeat{})
+	require.IsType(t, &validator.TimeoutError{}, err)
+}
+
+func TestLoadTimeout(t *testing.T) {
+	pvFile, cleanup := tempPrivValidatorFile(t)
+	defer cleanup()
+
+	saveTestFile(t, pvFile)
+
+	// The HSM hangs when asked for its loaded key
+	_, err := validator.LoadFromFileWithOptions(pvFile, blockingHsm{}, validator.LoadOptions{
+		Timeout: 50 * time.Millisecond,
+	})
+	require.Error(t, err)
+
+	timeoutErr, ok := pkgerrors.Cause(err).(*validator.TimeoutError)
+	require.True(t, ok, "expected *TimeoutError, got %T", pkgerrors.Cause(err))
+	require.Equal(t, "PublicKey", timeoutErr.Op)
+}
+
+// keyNotLoadedError mimics the error returned by an HSM that has lost its key.
+type keyNotLoadedError struct{}
+
+func (keyNotLoadedError) Error() string {
+	return "no key loaded"
+}
+
+func (keyNotLoadedError) KeyNotLoaded() bool {
+	return true
+}
+
+func TestSignReloadsLostKey(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHSM := mocks.NewMockHsm(mockCtrl)
+
+	key := []byte("encrypted key")
+
+	gomock.InOrder(
+		mockHSM.EXPECT().LoadKeys(key).Return(nil),
+		mockHSM.EXPECT().PublicKey().Return(validator.LoadedKey{}, nil),
+		mockHSM.EXPECT().ExportState().Return(validator.SignedState{}, nil),
+		mockHSM.EXPECT().SignVote(testChainID, gomock.Any()).Return(nil, keyNotLoadedError{}),
+		mockHSM.EXPECT().LoadKeys(key).Return(nil),
+		mockHSM.EXPECT().PublicKey().Return(validator.LoadedKey{}, nil),
+		mockHSM.EXPECT().ExportState().Return(validator.SignedState{}, nil),
+		mockHSM.EXPECT().SignVote(testChainID, gomock.Any()).Return(nil, nil),
+		mockHSM.EXPECT().SignHeartbeat(testChainID, gomock.Any()).Return(nil, keyNotLoadedError{}),
+		mockHSM.EXPECT().LoadKeys(key).Return(nil),
+		mockHSM.EXPECT().PublicKey().Return(validator.LoadedKey{}, nil),
+		mockHSM.EXPECT().ExportState().Return(validator.SignedState{Height: 1, Step: 2}, nil),
+		mockHSM.EXPECT().SignHeartbeat(testChainID, gomock.Any()).Return(nil, nil),
+	)
+
+	pv := validator.HsmPrivValidator{Hsm: signingHsm{mockHSM}, PublicKey: testPublicKey(), EncryptedPrivKey: key}
+
+	vote := types.Vote{Height: 1, Type: types.VoteTypePrevote}
+	require.NoError(t, pv.SignVote(testChainID, &vote))
+	require.Equal(t, testSign(types.SignBytes(testChainID, &vote)), signatureBytes(vote.Signature))
+
+	heartbeat := types.Heartbeat{}
+	require.NoError(t, pv.SignHeartbeat(testChainID, &heartbeat))
+	require.Equal(t, testSign(types.SignBytes(testChainID, &heartbeat)), signatureBytes(heartbeat.Signature))
+}
+
+func TestSignRetriesLostKeyOnce(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHSM := mocks.NewMockHsm(mockCtrl)
+
+	mockHSM.EXPECT().LoadKeys(gomock.Any()).Return(nil).Times(2)
+	mockHSM.EXPECT().PublicKey().Return(validator.LoadedKey{}, nil).Times(2)
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{}, unsupportedError{}).Times(2)
+	mockHSM.EXPECT().SignVote(testChainID, gomock.Any()).Return(nil, keyNotLoadedError{}).Times(2)
+
+	pv := validator.HsmPrivValidator{Hsm: signingHsm{mockHSM}, PublicKey: testPublicKey()}
+
+	err := pv.SignVote(testChainID, &types.Vote{Height: 1, Type: types.VoteTypePrevote})
+	require.Equal(t, keyNotLoadedError{}, err)
+	require.Equal(t, int64(0), pv.LastSignState().Height)
+}
+
+func TestSignReportsFailedReload(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHSM := mocks.NewMockHsm(mockCtrl)
+
+	gomock.InOrder(
+		mockHSM.EXPECT().LoadKeys(gomock.Any()).Return(nil),
+		mockHSM.EXPECT().PublicKey().Return(validator.LoadedKey{}, nil),
+		mockHSM.EXPECT().ExportState().Return(validator.SignedState{}, unsupportedError{}),
+		mockHSM.EXPECT().SignVote(testChainID, gomock.Any()).Return(nil, keyNotLoadedError{}),
+		mockHSM.EXPECT().LoadKeys(gomock.Any()).Return(errors.New("module offline")),
+	)
+
+	pv := validator.HsmPrivValidator{Hsm: signingHsm{mockHSM}, PublicKey: testPublicKey()}
+
+	err := pv.SignVote(testChainID, &types.Vote{Height: 1, Type: types.VoteTypePrevote})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "failed to reload key")
+}
+
+func TestSignRefusesReloadedMismatchedKey(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHSM := mocks.NewMockHsm(mockCtrl)
+
+	// The module that the key is reloaded into, e.g. a standby after a
+	// failover, reports another key, so it is not used to sign
+	other := validator.LoadedKey{ID: []byte{1, 2, 3}}
+	other.PublicKey = crypto.GenPrivKeyEd25519().PubKey().Unwrap().(crypto.PubKeyEd25519)
+
+	gomock.InOrder(
+		mockHSM.EXPECT().LoadKeys(gomock.Any()).Return(nil),
+		mockHSM.EXPECT().PublicKey().Return(validator.LoadedKey{}, nil),
+		mockHSM.EXPECT().ExportState().Return(validator.SignedState{}, unsupportedError{}),
+		mockHSM.EXPECT().SignVote(testChainID, gomock.Any()).Return(nil, keyNotLoadedError{}),
+		mockHSM.EXPECT().LoadKeys(gomock.Any()).Return(nil),
+		mockHSM.EXPECT().PublicKey().Return(other, nil),
+	)
+
+	pv := validator.HsmPrivValidator{Hsm: signingHsm{mockHSM}, PublicKey: testPublicKey()}
+
+	err := pv.SignVote(testChainID, &types.Vote{Height: 1, Type: types.VoteTypePrevote})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "could not be bound to its public key")
+	require.Equal(t, int64(0), pv.LastSignState().Height)
+}
+
+func TestConcurrentSigningLoadsKeyOnce(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHSM := mocks.NewMockHsm(mockCtrl)
+
+	const signers = 10
+
+	mockHSM.EXPECT().LoadKeys(gomock.Any()).Return(nil).Times(1)
+	mockHSM.EXPECT().PublicKey().Return(validator.LoadedKey{}, nil).Times(1)
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{}, nil).Times(1)
+	mockHSM.EXPECT().SignVote(testChainID, gomock.Any()).Return(nil, nil).MaxTimes(signers)
+	mockHSM.EXPECT().SignHeartbeat(testChainID, gomock.Any()).Return(nil, nil).Times(signers)
+
+	pv := validator.HsmPrivValidator{Hsm: signingHsm{mockHSM}, PublicKey: testPublicKey()}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*signers)
+	for i := 1; i <= signers; i++ {
+		wg.Add(2)
+		go func(height int64) {
+			defer wg.Done()
+			errs <- pv.SignVote(testChainID, &types.Vote{Height: height, Type: types.VoteTypePrevote})
+		}(int64(i))
+		go func() {
+			defer wg.Done()
+			errs <- pv.SignHeartbeat(testChainID, &types.Heartbeat{})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	// Votes that arrive after a higher one are refused, but at least one
+	// vote and every heartbeat must succeed.
+	failures := 0
+	for err := range errs {
+		if err != nil {
+			require.Contains(t, err.Error(), "regression")
+			failures++
+		}
+	}
+	require.True(t, failures < signers)
+}
+
+func TestSigningIsSerialized(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHSM := mocks.NewMockHsm(mockCtrl)
+
+	const signers = 10
+
+	var inFlight, maxInFlight int32
+	track := func() {
+		n := atomic.AddInt32(&inFlight, 1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+	}
+
+	mockHSM.EXPECT().LoadKeys(gomock.Any()).Return(nil).Times(1)
+	mockHSM.EXPECT().PublicKey().Return(validator.LoadedKey{}, nil).Times(1)
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{}, nil).Times(1)
+	mockHSM.EXPECT().SignVote(testChainID, gomock.Any()).Do(
+		func(string, *types.Vote) { track() }).Return(nil, nil).MaxTimes(signers)
+	mockHSM.EXPECT().SignProposal(testChainID, gomock.Any()).Do(
+		func(string, *types.Proposal) { track() }).Return(nil, nil).MaxTimes(signers)
+
+	pv := validator.HsmPrivValidator{Hsm: signingHsm{mockHSM}, PublicKey: testPublicKey()}
+
+	var wg sync.WaitGroup
+	for i := 1; i <= signers; i++ {
+		wg.Add(2)
+		go func(height int64) {
+			defer wg.Done()
+			pv.SignVote(testChainID, &types.Vote{Height: height, Type: types.VoteTypePrevote})
+		}(int64(i))
+		go func(height int64) {
+			defer wg.Done()
+			pv.SignProposal(testChainID, &types.Proposal{Height: height})
+		}(int64(i))
+	}
+	wg.Wait()
+
+	require.Equal(t, int32(1), atomic.LoadInt32(&maxInFlight))
+}
+
+func TestHeartbeatNotBlockedBySlowVote(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHSM := mocks.NewMockHsm(mockCtrl)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	mockHSM.EXPECT().LoadKeys(gomock.Any()).Return(nil).Times(1)
+	mockHSM.EXPECT().PublicKey().Return(validator.LoadedKey{}, nil).Times(1)
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{}, nil).Times(1)
+	mockHSM.EXPECT().SignVote(testChainID, gomock.Any()).Do(func(string, *types.Vote) {
+		close(started)
+		<-release
+	}).Return(nil, nil)
+	mockHSM.EXPECT().SignHeartbeat(testChainID, gomock.Any()).Return(nil, nil)
+
+	pv := validator.HsmPrivValidator{Hsm: signingHsm{mockHSM}, PublicKey: testPublicKey()}
+
+	voteErr := make(chan error, 1)
+	go func() {
+		voteErr <- pv.SignVote(testChainID, &types.Vote{Height: 1, Type: types.VoteTypePrevote})
+	}()
+	<-started
+
+	heartbeatErr := make(chan error, 1)
+	go func() {
+		heartbeatErr <- pv.SignHeartbeat(testChainID, &types.Heartbeat{})
+	}()
+
+	select {
+	case err := <-heartbeatErr:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("heartbeat blocked behind vote")
+	}
+
+	close(release)
+	require.NoError(t, <-voteErr)
+	require.Equal(t, int64(1), pv.LastSignState().Height)
+}
+
+func TestSignRejectsBadSignature(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHSM := mocks.NewMockHsm(mockCtrl)
+
+	vote := types.Vote{Height: 1, Type: types.VoteTypePrevote}
+	otherKey := crypto.GenPrivKeyEd25519()
+
+	mockHSM.EXPECT().LoadKeys(gomock.Any()).Return(nil).Times(1)
+	mockHSM.EXPECT().PublicKey().Return(validator.LoadedKey{}, nil).Times(1)
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{}, nil).Times(1)
+	gomock.InOrder(
+		mockHSM.EXPECT().SignVote(testChainID, gomock.Any()).Return(randomSignature(), nil),
+		mockHSM.EXPECT().SignVote(testChainID, gomock.Any()).Return(
+			signatureBytes(otherKey.Sign(types.SignBytes(testChainID, &vote))), nil),
+		mockHSM.EXPECT().SignVote(testChainID, gomock.Any()).Return(nil, nil),
+	)
+	mockHSM.EXPECT().SignHeartbeat(testChainID, gomock.Any()).Return(randomSignature(), nil)
+
+	pv := validator.HsmPrivValidator{
+		Hsm:       signingHsm{mockHSM},
+		PublicKey: testPublicKey(),
+		Metrics:   validator.PrometheusMetrics("bad_signature_test"),
+	}
+
+	// Neither a corrupted signature nor one made with another key is accepted
+	err := pv.SignVote(testChainID, &vote)
+	require.Equal(t, &validator.SignatureError{Op: "SignVote"}, err)
+	require.Nil(t, vote.Signature.SignatureInner)
+
+	err = pv.SignVote(testChainID, &vote)
+	require.Equal(t, &validator.SignatureError{Op: "SignVote"}, err)
+	require.Equal(t, int64(0), pv.LastSignState().Height)
+
+	// The rejected signatures were not recorded, so the vote can be signed again
+	require.NoError(t, pv.SignVote(testChainID, &vote))
+	require.Equal(t, int64(1), pv.LastSignState().Height)
+
+	err = pv.SignHeartbeat(testChainID, &types.Heartbeat{})
+	require.Equal(t, &validator.SignatureError{Op: "SignHeartbeat"}, err)
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+
+	values := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() == "bad_signature_test_validator_bad_signatures_total" {
+			for _, metric := range family.Metric {
+				values[metric.Label[0].GetValue()] = metric.GetCounter().GetValue()
+			}
+		}
+	}
+	require.Equal(t, map[string]float64{"SignVote": 2, "SignHeartbeat": 1}, values)
+}
@@ -0,0 +1,131 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package validator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// LockFilePath returns the path of the lock file that guards the privValidator
+// file at pvFilePath, and the sign state kept alongside it.
+func LockFilePath(pvFilePath string) string {
+	return pvFilePath + ".lock"
+}
+
+// fileLock is an exclusive lock on a lock file, which records the PID of the
+// process holding it. It is an fcntl lock, or a LockFileEx lock on Windows.
+// Since fcntl locks do not conflict within a process, locks held by this
+// process are also tracked in lockedFiles.
+type fileLock struct {
+	path string
+	file *os.File
+}
+
+var (
+	lockedMtx   sync.Mutex
+	lockedFiles = make(map[string]bool)
+)
+
+// errLocked is returned by lockFd if another process holds the lock.
+var errLocked = errors.New("file is locked by another process")
+
+// lockFile takes an exclusive lock on the file at path, creating it if
+// necessary. It fails at once if the lock is held by another process, or
+// elsewhere in this one. The lock is held until it is released or the process
+// exits. The lock file is never removed, as a process could then lock a file
+// that no longer exists.
+func lockFile(path string) (*fileLock, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	lockedMtx.Lock()
+	defer lockedMtx.Unlock()
+
+	if lockedFiles[path] {
+		return nil, errors.Errorf("%s is locked by this process (PID %d)", path, os.Getpid())
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = lockFd(f)
+	if err == errLocked {
+		holder := lockHolder(f)
+		f.Close()
+		return nil, errors.Errorf("%s is locked by process %s, which may be using the same validator key",
+			path, holder)
+	} else if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "failed to lock "+path)
+	}
+
+	err = f.Truncate(0)
+	if err == nil {
+		_, err = f.WriteAt([]byte(fmt.Sprintf("%d\n", os.Getpid())), 0)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "failed to record PID in "+path)
+	}
+
+	lockedFiles[path] = true
+	return &fileLock{path: path, file: f}, nil
+}
+
+// release gives up the lock.
+func (l *fileLock) release() error {
+	lockedMtx.Lock()
+	defer lockedMtx.Unlock()
+
+	delete(lockedFiles, l.path)
+	l.file.Truncate(0)
+	return l.file.Close()
+}
+
+// lockHolder returns the PID of the process holding the lock on f, as
+// recorded in the file or, failing that, as reported by the kernel.
+func lockHolder(f *os.File) string {
+	contents, err := ioutil.ReadAll(f)
+	if pid := strings.TrimSpace(string(contents)); err == nil && pid != "" {
+		return pid
+	}
+
+	if pid := lockingPid(f); pid > 0 {
+		return strconv.Itoa(pid)
+	}
+
+	return "unknown"
+}
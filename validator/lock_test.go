@@ -0,0 +1,104 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package validator
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// lockHelperEnv names the lock file taken by TestLockHelperProcess, when it
+// is run as a separate process.
+const lockHelperEnv = "HSM_VALIDATOR_LOCK_HELPER"
+
+// TestLockHelperProcess is not a real test. It takes the lock named in its
+// environment, reports that it holds it, and then holds it until its stdin
+// is closed.
+func TestLockHelperProcess(t *testing.T) {
+	path := os.Getenv(lockHelperEnv)
+	if path == "" {
+		return
+	}
+
+	_, err := lockFile(path)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Println("locked")
+	bufio.NewReader(os.Stdin).ReadString('\n')
+	os.Exit(0)
+}
+
+func TestLockFileHeldByAnotherProcess(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "hsm-priv-validator.json.lock")
+
+	cmd := exec.Command(os.Args[0], "-test.run=TestLockHelperProcess")
+	cmd.Env = append(os.Environ(), lockHelperEnv+"="+path)
+	stdin, err := cmd.StdinPipe()
+	require.NoError(t, err)
+	stdout, err := cmd.StdoutPipe()
+	require.NoError(t, err)
+	require.NoError(t, cmd.Start())
+
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	require.NoError(t, err)
+	require.Equal(t, "locked\n", line)
+
+	_, err = lockFile(path)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), fmt.Sprintf("locked by process %d", cmd.Process.Pid))
+
+	// The lock is released when the holder exits
+	stdin.Close()
+	require.NoError(t, cmd.Wait())
+
+	lock, err := lockFile(path)
+	require.NoError(t, err)
+	require.NoError(t, lock.release())
+}
+
+func TestLockFileInProcess(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "hsm-priv-validator.json.lock")
+
+	lock, err := lockFile(path)
+	require.NoError(t, err)
+
+	_, err = lockFile(path)
+	require.Error(t, err)
+
+	require.NoError(t, lock.release())
+
+	lock, err = lockFile(path)
+	require.NoError(t, err)
+	require.NoError(t, lock.release())
+}
@@ -0,0 +1,104 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+package validator
+
+import (
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricsSubsystem is the Prometheus subsystem for metrics from this package.
+const MetricsSubsystem = "validator"
+
+// Metrics contains the metrics exposed by HsmPrivValidator.
+type Metrics struct {
+	// Height, Round and Step are the last signed height, round and step.
+	Height metrics.Gauge
+	Round  metrics.Gauge
+	Step   metrics.Gauge
+
+	// Timeouts counts HSM operations that exceeded the timeout, labelled
+	// by op.
+	Timeouts metrics.Counter
+
+	// KeyReloads counts keys reloaded after the HSM reported it had none.
+	KeyReloads metrics.Counter
+
+	// BadSignatures counts signatures from the HSM that failed verification,
+	// labelled by op.
+	BadSignatures metrics.Counter
+}
+
+// PrometheusMetrics returns Metrics that are registered with the default
+// Prometheus registry, in the given namespace.
+func PrometheusMetrics(namespace string) *Metrics {
+	return &Metrics{
+		Height: prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "last_signed_height",
+			Help:      "Height of the last signed vote or proposal.",
+		}, []string{}),
+		Round: prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "last_signed_round",
+			Help:      "Round of the last signed vote or proposal.",
+		}, []string{}),
+		Step: prometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "last_signed_step",
+			Help:      "Step of the last signed vote or proposal: 1 propose, 2 prevote, 3 precommit.",
+		}, []string{}),
+		Timeouts: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "timeouts_total",
+			Help:      "HSM operations that exceeded the timeout.",
+		}, []string{"op"}),
+		KeyReloads: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "key_reloads_total",
+			Help:      "Keys reloaded after the HSM reported it had none.",
+		}, []string{}),
+		BadSignatures: prometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: MetricsSubsystem,
+			Name:      "bad_signatures_total",
+			Help:      "Signatures from the HSM that failed verification.",
+		}, []string{"op"}),
+	}
+}
+
+// NopMetrics returns Metrics that discard all observations.
+func NopMetrics() *Metrics {
+	return &Metrics{
+		Height:        discard.NewGauge(),
+		Round:         discard.NewGauge(),
+		Step:          discard.NewGauge(),
+		Timeouts:      discard.NewCounter(),
+		KeyReloads:    discard.NewCounter(),
+		BadSignatures: discard.NewCounter(),
+	}
+}
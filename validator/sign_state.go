@@ -0,0 +1,248 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package validator
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"github.com/tendermint/go-crypto"
+	"github.com/tendermint/go-wire"
+	"github.com/tendermint/go-wire/data"
+	"github.com/tendermint/tendermint/types"
+)
+
+// Steps within a round, ordered as they occur in the consensus protocol.
+const (
+	stepNone      int8 = 0 // Used to distinguish the initial state
+	StepPropose   int8 = 1
+	StepPrevote   int8 = 2
+	StepPrecommit int8 = 3
+)
+
+// SignState records the last height, round and step signed by the validator,
+// along with the signature produced. It is persisted before every signature
+// is released, so that a reset or replaced module cannot be used to double
+// sign.
+type SignState struct {
+	Height    int64            `json:"height"`
+	Round     int              `json:"round"`
+	Step      int8             `json:"step"`
+	Signature crypto.Signature `json:"signature,omitempty"`
+	SignBytes data.Bytes       `json:"signbytes,omitempty"`
+
+	// PublicKey is the key of the validator that recorded the state. It is
+	// missing from states written by earlier versions, and is then added
+	// when the state is next saved.
+	PublicKey data.Bytes `json:"pub_key,omitempty"`
+
+	// filePath is where the state is persisted. If empty, the state is
+	// held in memory only.
+	filePath string
+}
+
+// SignStateFilePath returns the path of the sign state file kept alongside
+// the privValidator file at pvFilePath.
+func SignStateFilePath(pvFilePath string) string {
+	return strings.TrimSuffix(pvFilePath, filepath.Ext(pvFilePath)) + "-state.json"
+}
+
+// LoadSignState reads the sign state from filePath. If the file does not
+// exist, an empty state is returned which will be written to filePath
+// after the first signature.
+func LoadSignState(filePath string) (*SignState, error) {
+	state := &SignState{filePath: filePath}
+
+	bytes, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(bytes, state)
+	if err != nil {
+		return nil, errors.WithMessage(err, "failed to parse sign state "+filePath)
+	}
+
+	return state, nil
+}
+
+// CheckPublicKey returns an error if the state was recorded by a validator
+// with a key other than publicKey, e.g. because hsm-validator-init generated
+// a new key beside it. Such a state says nothing about what publicKey has
+// signed.
+func (s *SignState) CheckPublicKey(publicKey []byte) error {
+	if len(s.PublicKey) == 0 || bytes.Equal(s.PublicKey, publicKey) {
+		return nil
+	}
+	return errors.Errorf("sign state %s was recorded for public key %X, not %X; "+
+		"if the validator key was replaced deliberately, move the sign state aside",
+		s.filePath, []byte(s.PublicKey), publicKey)
+}
+
+// RaiseSignState raises the last signed state kept alongside the
+// privValidator file at pvFilePath to p, if p is later, so that the validator
+// will not sign at or before p. Nothing can then be signed at p itself, since
+// what was signed there is unknown. The privValidator file is locked while the
+// state is changed, so this fails while a validator is using it. It returns
+// the resulting state.
+func RaiseSignState(pvFilePath string, p Position) (*SignState, error) {
+	lock, err := lockFile(LockFilePath(pvFilePath))
+	if err != nil {
+		return nil, errors.WithMessage(err, "cannot change the sign state of "+pvFilePath)
+	}
+	defer lock.release()
+
+	publicKey, err := ReadPublicKey(pvFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := LoadSignState(SignStateFilePath(pvFilePath))
+	if err != nil {
+		return nil, err
+	}
+	err = state.CheckPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if !state.Position().Before(p) {
+		return state, nil
+	}
+
+	state.PublicKey = publicKey
+	return state, state.update(p.Height, p.Round, p.Step, nil, crypto.Signature{})
+}
+
+// check returns an error if height, round and step are a regression from
+// the last signed state. It returns true if they match the last signed
+// state exactly, in which case the caller must compare sign bytes.
+func (s *SignState) check(height int64, round int, step int8) (bool, error) {
+	if s.Height > height {
+		return false, errors.Errorf("height regression: last signed %d, requested %d", s.Height, height)
+	}
+
+	if s.Height == height {
+		if s.Round > round {
+			return false, errors.Errorf("round regression at height %d: last signed %d, requested %d",
+				height, s.Round, round)
+		}
+
+		if s.Round == round {
+			if s.Step > step {
+				return false, errors.Errorf("step regression at height %d, round %d: last signed %d, requested %d",
+					height, round, s.Step, step)
+			} else if s.Step == step {
+				if s.SignBytes == nil {
+					return false, errors.Errorf("no signature recorded for height %d, round %d, step %d",
+						height, round, step)
+				}
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// update records a new signature and persists the state.
+func (s *SignState) update(height int64, round int, step int8, signBytes []byte, sig crypto.Signature) error {
+	s.Height = height
+	s.Round = round
+	s.Step = step
+	s.Signature = sig
+	s.SignBytes = signBytes
+
+	if s.filePath == "" {
+		return nil
+	}
+
+	bytes, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	return errors.WithMessage(writeFileAtomic(s.filePath, bytes, 0600, 0), "failed to save sign state")
+}
+
+// VoteStep returns the consensus step at which a vote is signed.
+func VoteStep(vote *types.Vote) (int8, error) {
+	switch vote.Type {
+	case types.VoteTypePrevote:
+		return StepPrevote, nil
+	case types.VoteTypePrecommit:
+		return StepPrecommit, nil
+	default:
+		return stepNone, errors.Errorf("unknown vote type: %d", vote.Type)
+	}
+}
+
+// votesOnlyDifferByTimestamp returns true, along with the timestamp from
+// lastSignBytes, if the only difference between two signed votes is their
+// timestamp.
+func votesOnlyDifferByTimestamp(lastSignBytes, newSignBytes []byte) (time.Time, bool) {
+	var lastVote, newVote types.CanonicalJSONOnceVote
+	if json.Unmarshal(lastSignBytes, &lastVote) != nil || json.Unmarshal(newSignBytes, &newVote) != nil {
+		return time.Time{}, false
+	}
+
+	lastTime, err := time.Parse(wire.RFC3339Millis, lastVote.Vote.Timestamp)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	newVote.Vote.Timestamp = lastVote.Vote.Timestamp
+	return lastTime, canonicalEqual(lastVote, newVote)
+}
+
+// proposalsOnlyDifferByTimestamp returns true, along with the timestamp from
+// lastSignBytes, if the only difference between two signed proposals is their
+// timestamp.
+func proposalsOnlyDifferByTimestamp(lastSignBytes, newSignBytes []byte) (time.Time, bool) {
+	var lastProposal, newProposal types.CanonicalJSONOnceProposal
+	if json.Unmarshal(lastSignBytes, &lastProposal) != nil || json.Unmarshal(newSignBytes, &newProposal) != nil {
+		return time.Time{}, false
+	}
+
+	lastTime, err := time.Parse(wire.RFC3339Millis, lastProposal.Proposal.Timestamp)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	newProposal.Proposal.Timestamp = lastProposal.Proposal.Timestamp
+	return lastTime, canonicalEqual(lastProposal, newProposal)
+}
+
+// canonicalEqual compares the JSON encodings of a and b.
+func canonicalEqual(a, b interface{}) bool {
+	aBytes, errA := json.Marshal(a)
+	bBytes, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(aBytes, bBytes)
+}
@@ -0,0 +1,584 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package validator_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"github.com/tendermint/go-crypto"
+	"github.com/tendermint/tendermint/types"
+	"github.com/thales-e-security/tendermint-hsm-validator/mocks"
+	"github.com/thales-e-security/tendermint-hsm-validator/validator"
+)
+
+const testChainID = "chainID"
+
+func randomSignature() []byte {
+	var sig [64]byte
+	rand.Read(sig[:])
+	return sig[:]
+}
+
+func signatureBytes(sig crypto.Signature) []byte {
+	result := [64]byte(sig.SignatureInner.(crypto.SignatureEd25519))
+	return result[:]
+}
+
+// testKey stands in for the key held by mocked HSMs, so that their signatures
+// verify against testPublicKey.
+var testKey = crypto.GenPrivKeyEd25519()
+
+func testPublicKey() []byte {
+	pk := testKey.PubKey().Unwrap().(crypto.PubKeyEd25519)
+	return pk[:]
+}
+
+func testSign(signBytes []byte) []byte {
+	return signatureBytes(testKey.Sign(signBytes))
+}
+
+// signingHsm wraps a MockHsm. When a signing call is expected to return
+// neither a signature nor an error, a valid signature is made with testKey.
+// Likewise, PublicKey returns the public half of testKey, and ExportState
+// signs the state it is expected to return with testKey.
+type signingHsm struct {
+	*mocks.MockHsm
+}
+
+func (h signingHsm) PublicKey() (validator.LoadedKey, error) {
+	key, err := h.MockHsm.PublicKey()
+	if key.PublicKey == [32]byte{} && err == nil {
+		copy(key.PublicKey[:], testPublicKey())
+	}
+	return key, err
+}
+
+func (h signingHsm) ExportState() (validator.SignedState, error) {
+	state, err := h.MockHsm.ExportState()
+	if state.Signature == nil && err == nil {
+		state.PublicKey = testPublicKey()
+		state.Signature = testSign(state.SignBytes())
+	}
+	return state, err
+}
+
+func (h signingHsm) SignVote(chainID string, vote *types.Vote) ([]byte, error) {
+	sig, err := h.MockHsm.SignVote(chainID, vote)
+	if sig == nil && err == nil {
+		sig = testSign(types.SignBytes(chainID, vote))
+	}
+	return sig, err
+}
+
+func (h signingHsm) SignProposal(chainID string, proposal *types.Proposal) ([]byte, error) {
+	sig, err := h.MockHsm.SignProposal(chainID, proposal)
+	if sig == nil && err == nil {
+		sig = testSign(types.SignBytes(chainID, proposal))
+	}
+	return sig, err
+}
+
+func (h signingHsm) SignHeartbeat(chainID string, heartbeat *types.Heartbeat) ([]byte, error) {
+	sig, err := h.MockHsm.SignHeartbeat(chainID, heartbeat)
+	if sig == nil && err == nil {
+		sig = testSign(types.SignBytes(chainID, heartbeat))
+	}
+	return sig, err
+}
+
+func TestSignVoteRegression(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHSM := mocks.NewMockHsm(mockCtrl)
+
+	mockHSM.EXPECT().LoadKeys(gomock.Any()).Return(nil).Times(1)
+	mockHSM.EXPECT().PublicKey().Return(validator.LoadedKey{}, nil).Times(1)
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{}, nil).Times(1)
+	mockHSM.EXPECT().SignVote(testChainID, gomock.Any()).Return(nil, nil).Times(1)
+
+	pv := validator.HsmPrivValidator{Hsm: signingHsm{mockHSM}, PublicKey: testPublicKey()}
+
+	err := pv.SignVote(testChainID, &types.Vote{Height: 2, Round: 1, Type: types.VoteTypePrecommit})
+	require.NoError(t, err)
+
+	err = pv.SignVote(testChainID, &types.Vote{Height: 2, Round: 1, Type: types.VoteTypePrevote})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "step regression")
+
+	err = pv.SignVote(testChainID, &types.Vote{Height: 2, Round: 0, Type: types.VoteTypePrecommit})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "round regression")
+
+	err = pv.SignVote(testChainID, &types.Vote{Height: 1, Round: 5, Type: types.VoteTypePrecommit})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "height regression")
+
+	err = pv.SignProposal(testChainID, &types.Proposal{Height: 2, Round: 1})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "step regression")
+
+	state := pv.LastSignState()
+	require.Equal(t, int64(2), state.Height)
+	require.Equal(t, 1, state.Round)
+}
+
+func TestSignVoteTwiceReturnsPreviousSignature(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHSM := mocks.NewMockHsm(mockCtrl)
+
+	mockHSM.EXPECT().LoadKeys(gomock.Any()).Return(nil).Times(1)
+	mockHSM.EXPECT().PublicKey().Return(validator.LoadedKey{}, nil).Times(1)
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{}, nil).Times(1)
+	mockHSM.EXPECT().SignVote(testChainID, gomock.Any()).Return(nil, nil).Times(1)
+
+	pv := validator.HsmPrivValidator{Hsm: signingHsm{mockHSM}, PublicKey: testPublicKey()}
+	timestamp := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	vote := types.Vote{Height: 3, Type: types.VoteTypePrevote, Timestamp: timestamp}
+	require.NoError(t, pv.SignVote(testChainID, &vote))
+	sig := signatureBytes(vote.Signature)
+
+	again := types.Vote{Height: 3, Type: types.VoteTypePrevote, Timestamp: timestamp}
+	require.NoError(t, pv.SignVote(testChainID, &again))
+	require.Equal(t, sig, signatureBytes(again.Signature))
+
+	later := types.Vote{Height: 3, Type: types.VoteTypePrevote, Timestamp: timestamp.Add(time.Second)}
+	require.NoError(t, pv.SignVote(testChainID, &later))
+	require.Equal(t, sig, signatureBytes(later.Signature))
+	require.True(t, timestamp.Equal(later.Timestamp))
+}
+
+func TestSignVoteConflictingData(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHSM := mocks.NewMockHsm(mockCtrl)
+
+	mockHSM.EXPECT().LoadKeys(gomock.Any()).Return(nil).Times(1)
+	mockHSM.EXPECT().PublicKey().Return(validator.LoadedKey{}, nil).Times(1)
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{}, nil).Times(1)
+	mockHSM.EXPECT().SignVote(testChainID, gomock.Any()).Return(nil, nil).Times(1)
+
+	pv := validator.HsmPrivValidator{Hsm: signingHsm{mockHSM}, PublicKey: testPublicKey()}
+
+	vote := types.Vote{Height: 3, Type: types.VoteTypePrevote}
+	require.NoError(t, pv.SignVote(testChainID, &vote))
+
+	conflicting := types.Vote{Height: 3, Type: types.VoteTypePrevote}
+	conflicting.BlockID.Hash = []byte("another block")
+
+	err := pv.SignVote(testChainID, &conflicting)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "conflicting data")
+}
+
+func TestSignProposalTwiceReturnsPreviousSignature(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHSM := mocks.NewMockHsm(mockCtrl)
+
+	mockHSM.EXPECT().LoadKeys(gomock.Any()).Return(nil).Times(1)
+	mockHSM.EXPECT().PublicKey().Return(validator.LoadedKey{}, nil).Times(1)
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{}, nil).Times(1)
+	mockHSM.EXPECT().SignProposal(testChainID, gomock.Any()).Return(nil, nil).Times(1)
+
+	pv := validator.HsmPrivValidator{Hsm: signingHsm{mockHSM}, PublicKey: testPublicKey()}
+
+	proposal := types.Proposal{Height: 3, Round: 2, POLRound: -1}
+	require.NoError(t, pv.SignProposal(testChainID, &proposal))
+	sig := signatureBytes(proposal.Signature)
+
+	again := types.Proposal{Height: 3, Round: 2, POLRound: -1}
+	require.NoError(t, pv.SignProposal(testChainID, &again))
+	require.Equal(t, sig, signatureBytes(again.Signature))
+}
+
+func TestSignStatePersisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestSignStatePersisted")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	pvFile := filepath.Join(dir, "hsm-priv-validator.json")
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHSM := mocks.NewMockHsm(mockCtrl)
+
+	pv := validator.HsmPrivValidator{
+		Hsm:              fileSigningHsm{},
+		EncryptedPrivKey: []byte("private key"),
+		PublicKey:        testPublicKey(),
+	}
+
+	mockHSM.EXPECT().LoadKeys(pv.EncryptedPrivKey).Return(nil).Times(2)
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{}, nil)
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{Height: 5, Step: 3}, nil)
+	mockHSM.EXPECT().PublicKey().Return(validator.LoadedKey{}, nil).Times(2)
+	mockHSM.EXPECT().SignVote(testChainID, gomock.Any()).Return(nil, nil).Times(1)
+
+	require.NoError(t, pv.SaveToFile(pvFile))
+
+	pv1, err := validator.LoadFromFile(pvFile, signingHsm{mockHSM})
+	require.NoError(t, err)
+	require.NoError(t, pv1.SignVote(testChainID, &types.Vote{Height: 5, Type: types.VoteTypePrecommit}))
+
+	_, err = os.Stat(validator.SignStateFilePath(pvFile))
+	require.NoError(t, err)
+
+	// A fresh process, perhaps talking to a module seeded with the last
+	// signed state, must not sign at a lower height
+	require.NoError(t, pv1.Close())
+	pv2, err := validator.LoadFromFile(pvFile, signingHsm{mockHSM})
+	require.NoError(t, err)
+	require.Equal(t, pv1.LastSignState().SignBytes, pv2.LastSignState().SignBytes)
+
+	err = pv2.SignVote(testChainID, &types.Vote{Height: 4, Type: types.VoteTypePrecommit})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "height regression")
+}
+
+func TestLoadRefusesHsmAheadOfSignState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestLoadRefusesHsmAheadOfSignState")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	pvFile := filepath.Join(dir, "hsm-priv-validator.json")
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHSM := mocks.NewMockHsm(mockCtrl)
+
+	pv := validator.HsmPrivValidator{
+		Hsm:              fileSigningHsm{},
+		EncryptedPrivKey: []byte("private key"),
+		PublicKey:        testPublicKey(),
+	}
+
+	mockHSM.EXPECT().LoadKeys(pv.EncryptedPrivKey).Return(nil).Times(3)
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{}, nil)
+	mockHSM.EXPECT().PublicKey().Return(validator.LoadedKey{}, nil).Times(3)
+	mockHSM.EXPECT().SignVote(testChainID, gomock.Any()).Return(nil, nil)
+
+	require.NoError(t, pv.SaveToFile(pvFile))
+
+	pv1, err := validator.LoadFromFile(pvFile, signingHsm{mockHSM})
+	require.NoError(t, err)
+	require.NoError(t, pv1.SignVote(testChainID, &types.Vote{Height: 5, Type: types.VoteTypePrecommit}))
+	require.NoError(t, pv1.Close())
+
+	// The module has signed something this host has no record of, so it
+	// is refused rather than seeded
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{Height: 6, Step: 3}, nil)
+
+	_, err = validator.LoadFromFile(pvFile, signingHsm{mockHSM})
+	require.Error(t, err)
+
+	stateErr, ok := errors.Cause(err).(*validator.StateError)
+	require.True(t, ok, "expected *StateError, got %T", err)
+	require.Equal(t, int64(6), stateErr.HSM.Height)
+	require.Equal(t, int64(5), stateErr.Host.Height)
+	require.Contains(t, err.Error(), "hsm-validator import-state")
+
+	// A state signed with another key is rejected outright
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{
+		Height:    5,
+		Step:      3,
+		PublicKey: testPublicKey(),
+		Signature: randomSignature(),
+	}, nil)
+
+	_, err = validator.LoadFromFile(pvFile, signingHsm{mockHSM})
+	require.IsType(t, &validator.SignatureError{}, errors.Cause(err))
+}
+
+func TestLoadSeedsHsmBehindSignState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestLoadSeedsHsmBehindSignState")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	pvFile := filepath.Join(dir, "hsm-priv-validator.json")
+	logFile := filepath.Join(dir, "audit.jsonl")
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHSM := mocks.NewMockHsm(mockCtrl)
+
+	pv := validator.HsmPrivValidator{
+		Hsm:              fileSigningHsm{},
+		EncryptedPrivKey: []byte("private key"),
+		PublicKey:        testPublicKey(),
+	}
+	require.NoError(t, pv.SaveToFile(pvFile))
+
+	writeJSON(t, validator.SignStateFilePath(pvFile), validator.SignState{Height: 5, Step: 3})
+
+	// The module is behind, e.g. because it restarted, so it is seeded
+	// with the host's state
+	mockHSM.EXPECT().LoadKeys(pv.EncryptedPrivKey).Return(nil).Times(2)
+	mockHSM.EXPECT().PublicKey().Return(validator.LoadedKey{}, nil).Times(2)
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{Height: 4, Step: 3}, nil)
+	mockHSM.EXPECT().SeedState(int64(5), 0, int8(3)).Return(nil)
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{Height: 5, Step: 3}, nil)
+
+	audit, err := validator.OpenAuditLog(logFile, nil)
+	require.NoError(t, err)
+	pv1, err := validator.LoadFromFileWithOptions(pvFile, signingHsm{mockHSM}, validator.LoadOptions{Audit: audit})
+	require.NoError(t, err)
+	require.NoError(t, pv1.Close())
+
+	entries := readAuditLog(t, logFile)
+	require.Len(t, entries, 2)
+	require.Equal(t, validator.AuditSeedState, entries[0].Op)
+	require.Equal(t, int64(5), entries[0].Height)
+	require.Equal(t, int8(3), entries[0].Step)
+	require.Empty(t, entries[0].Error)
+	require.Equal(t, validator.AuditLoadKeys, entries[1].Op)
+
+	// A module that is still behind after seeding is refused
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{Height: 4, Step: 3}, nil)
+	mockHSM.EXPECT().SeedState(int64(5), 0, int8(3)).Return(nil)
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{Height: 4, Step: 3}, nil)
+
+	_, err = validator.LoadFromFile(pvFile, signingHsm{mockHSM})
+	require.IsType(t, &validator.StateError{}, errors.Cause(err))
+}
+
+func TestReloadSeedsRestartedHsm(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHSM := mocks.NewMockHsm(mockCtrl)
+
+	pv := validator.HsmPrivValidator{
+		Hsm:              signingHsm{mockHSM},
+		EncryptedPrivKey: []byte("private key"),
+		PublicKey:        testPublicKey(),
+	}
+
+	mockHSM.EXPECT().LoadKeys(pv.EncryptedPrivKey).Return(nil)
+	mockHSM.EXPECT().PublicKey().Return(validator.LoadedKey{}, nil)
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{}, nil)
+	mockHSM.EXPECT().SignVote(testChainID, gomock.Any()).Return(nil, nil)
+	require.NoError(t, pv.SignVote(testChainID, &types.Vote{Height: 5, Type: types.VoteTypePrecommit}))
+
+	// The module restarts, losing the key and its state. The key is reloaded
+	// and the module seeded with the host's state before the vote is retried.
+	mockHSM.EXPECT().SignVote(testChainID, gomock.Any()).Return(nil, keyNotLoadedError{})
+	mockHSM.EXPECT().LoadKeys(pv.EncryptedPrivKey).Return(nil)
+	mockHSM.EXPECT().PublicKey().Return(validator.LoadedKey{}, nil)
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{}, nil)
+	mockHSM.EXPECT().SeedState(int64(5), 0, int8(3)).Return(nil)
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{Height: 5, Step: 3}, nil)
+	mockHSM.EXPECT().SignVote(testChainID, gomock.Any()).Return(nil, nil)
+
+	require.NoError(t, pv.SignVote(testChainID, &types.Vote{Height: 6, Type: types.VoteTypePrevote}))
+}
+
+func TestExportState(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHSM := mocks.NewMockHsm(mockCtrl)
+
+	pv := validator.HsmPrivValidator{
+		Hsm:              signingHsm{mockHSM},
+		EncryptedPrivKey: []byte("private key"),
+		PublicKey:        testPublicKey(),
+	}
+
+	mockHSM.EXPECT().LoadKeys(pv.EncryptedPrivKey).Return(nil)
+	mockHSM.EXPECT().PublicKey().Return(validator.LoadedKey{}, nil)
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{}, nil)
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{Height: 3, Round: 1, Step: 2}, nil)
+
+	state, err := pv.ExportState()
+	require.NoError(t, err)
+	require.Equal(t, int64(3), state.Height)
+	require.Equal(t, 1, state.Round)
+	require.Equal(t, int8(2), state.Step)
+	require.NoError(t, state.Verify(pv.PublicKey))
+}
+
+func TestSignedStateVerify(t *testing.T) {
+	state := validator.SignedState{Height: 7, Round: 2, Step: 1, PublicKey: testPublicKey()}
+	state.Signature = testSign(state.SignBytes())
+	require.Equal(t, "hsm-validator-state:7/2/1", string(state.SignBytes()))
+	require.NoError(t, state.Verify(testPublicKey()))
+
+	other := crypto.GenPrivKeyEd25519().PubKey().Unwrap().(crypto.PubKeyEd25519)
+	require.Error(t, state.Verify(other[:]))
+
+	state.Height++
+	require.Error(t, state.Verify(testPublicKey()))
+}
+
+func TestSignStateFilePath(t *testing.T) {
+	require.Equal(t, "/home/tm/hsm-priv-validator-state.json",
+		validator.SignStateFilePath("/home/tm/hsm-priv-validator.json"))
+}
+
+func TestRaiseSignState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestRaiseSignState")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	pvFile := filepath.Join(dir, "hsm-priv-validator.json")
+
+	pv := validator.HsmPrivValidator{
+		Hsm:              fileSigningHsm{},
+		EncryptedPrivKey: []byte("private key"),
+		PublicKey:        testPublicKey(),
+	}
+	require.NoError(t, pv.SaveToFile(pvFile))
+	writeJSON(t, validator.SignStateFilePath(pvFile), validator.SignState{Height: 5, Step: 3})
+
+	// An earlier position leaves the state as it is
+	state, err := validator.RaiseSignState(pvFile, validator.Position{Height: 4, Step: 3})
+	require.NoError(t, err)
+	require.Equal(t, int64(5), state.Height)
+
+	state, err = validator.RaiseSignState(pvFile, validator.Position{Height: 6, Step: 2})
+	require.NoError(t, err)
+	require.Equal(t, int64(6), state.Height)
+	require.Equal(t, int8(2), state.Step)
+	require.Equal(t, testPublicKey(), []byte(state.PublicKey))
+
+	loaded, err := validator.LoadSignState(validator.SignStateFilePath(pvFile))
+	require.NoError(t, err)
+	require.Equal(t, state.Position(), loaded.Position())
+}
+
+func TestSignStateMetrics(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHSM := mocks.NewMockHsm(mockCtrl)
+
+	mockHSM.EXPECT().LoadKeys(gomock.Any()).Return(nil).Times(1)
+	mockHSM.EXPECT().PublicKey().Return(validator.LoadedKey{}, nil).Times(1)
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{}, nil).Times(1)
+	mockHSM.EXPECT().SignProposal(testChainID, gomock.Any()).Return(nil, nil).Times(1)
+
+	pv := validator.HsmPrivValidator{
+		Hsm:       signingHsm{mockHSM},
+		PublicKey: testPublicKey(),
+		Metrics:   validator.PrometheusMetrics("sign_state_test"),
+	}
+
+	err := pv.SignProposal(testChainID, &types.Proposal{Height: 7, Round: 2})
+	require.NoError(t, err)
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+
+	values := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			values[family.GetName()] = metric.GetGauge().GetValue()
+		}
+	}
+
+	require.Equal(t, 7.0, values["sign_state_test_validator_last_signed_height"])
+	require.Equal(t, 2.0, values["sign_state_test_validator_last_signed_round"])
+	require.Equal(t, 1.0, values["sign_state_test_validator_last_signed_step"])
+}
+
+func TestLoadReportsSignStateMetrics(t *testing.T) {
+	pvFile, cleanup := tempPrivValidatorFile(t)
+	defer cleanup()
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHSM := mocks.NewMockHsm(mockCtrl)
+
+	saveTestFile(t, pvFile)
+	writeJSON(t, validator.SignStateFilePath(pvFile), validator.SignState{Height: 9, Round: 1, Step: 3})
+
+	mockHSM.EXPECT().LoadKeys(gomock.Any()).Return(nil)
+	mockHSM.EXPECT().PublicKey().Return(validator.LoadedKey{}, nil)
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{}, unsupportedError{})
+
+	// The gauges show the persisted state before anything is signed
+	pv, err := validator.LoadFromFileWithOptions(pvFile, signingHsm{mockHSM},
+		validator.LoadOptions{Metrics: validator.PrometheusMetrics("load_metrics_test")})
+	require.NoError(t, err)
+	defer pv.Close()
+
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+
+	values := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			values[family.GetName()] = metric.GetGauge().GetValue()
+		}
+	}
+
+	require.Equal(t, 9.0, values["load_metrics_test_validator_last_signed_height"])
+	require.Equal(t, 1.0, values["load_metrics_test_validator_last_signed_round"])
+	require.Equal(t, 3.0, values["load_metrics_test_validator_last_signed_step"])
+}
+
+func TestLoadRefusesSignStateForAnotherKey(t *testing.T) {
+	pvFile, cleanup := tempPrivValidatorFile(t)
+	defer cleanup()
+
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockHSM := mocks.NewMockHsm(mockCtrl)
+
+	// The file is replaced by one for a new key, as by running init again
+	saveTestFile(t, pvFile)
+	writeJSON(t, validator.SignStateFilePath(pvFile), validator.SignState{
+		Height:    9,
+		Step:      3,
+		PublicKey: bytes.Repeat([]byte{7}, 32),
+	})
+
+	_, err := validator.LoadFromFile(pvFile, signingHsm{mockHSM})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "move the sign state aside")
+
+	// A state recorded before the key was kept is adopted, and the key is
+	// saved with it
+	writeJSON(t, validator.SignStateFilePath(pvFile), validator.SignState{Height: 9, Step: 3})
+
+	mockHSM.EXPECT().LoadKeys(gomock.Any()).Return(nil)
+	mockHSM.EXPECT().PublicKey().Return(validator.LoadedKey{}, nil)
+	mockHSM.EXPECT().ExportState().Return(validator.SignedState{}, unsupportedError{})
+	mockHSM.EXPECT().SignVote(testChainID, gomock.Any()).Return(nil, nil)
+
+	pv, err := validator.LoadFromFile(pvFile, signingHsm{mockHSM})
+	require.NoError(t, err)
+	require.NoError(t, pv.SignVote(testChainID, &types.Vote{Height: 10, Type: types.VoteTypePrevote}))
+	require.NoError(t, pv.Close())
+
+	state, err := validator.LoadSignState(validator.SignStateFilePath(pvFile))
+	require.NoError(t, err)
+	require.Equal(t, testPublicKey(), []byte(state.PublicKey))
+}
@@ -0,0 +1,106 @@
+// Copyright 2017 Thales e-Security
+//
+// Permission is hereby granted, free of charge, to any person obtaining a
+// copy of this software and associated documentation files (the "Software"),
+// to deal in the Software without restriction, including without limitation
+// the rights to use, copy, modify, merge, publish, distribute, sublicense,
+// and/or sell copies of the Software, and to permit persons to whom the
+// Software is furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included
+// in all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS
+// OR IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF
+// MERCHANTABILITY, FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT.
+// IN NO EVENT SHALL THE AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY
+// CLAIM, DAMAGES OR OTHER LIABILITY, WHETHER IN AN ACTION OF CONTRACT,
+// TORT OR OTHERWISE, ARISING FROM, OUT OF OR IN CONNECTION WITH THE SOFTWARE
+// OR THE USE OR OTHER DEALINGS IN THE SOFTWARE.
+
+package validator
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/tendermint/go-crypto"
+	"github.com/tendermint/go-wire/data"
+)
+
+// stateSignPrefix starts the bytes signed by the HSM when it exports its
+// state, so that they cannot be mistaken for a vote, proposal or heartbeat.
+const stateSignPrefix = "hsm-validator-state:"
+
+// SignedState is the last height, round and step signed by an HSM, signed by
+// the HSM with the validator key. It is exported from one HSM so that another
+// holding the same key can be seeded with it, and will then not sign at or
+// before that height, round and step.
+type SignedState struct {
+	Height    int64      `json:"height"`
+	Round     int        `json:"round"`
+	Step      int8       `json:"step"`
+	PublicKey data.Bytes `json:"public_key"`
+	Signature data.Bytes `json:"signature"`
+}
+
+// SignBytes returns the bytes signed by the HSM: stateSignPrefix followed by
+// the height, round and step in decimal, separated by slashes.
+func (s SignedState) SignBytes() []byte {
+	return []byte(fmt.Sprintf("%s%d/%d/%d", stateSignPrefix, s.Height, s.Round, s.Step))
+}
+
+// Verify returns an error unless s was signed by the key with the given
+// public key.
+func (s SignedState) Verify(publicKey []byte) error {
+	if !bytes.Equal(s.PublicKey, publicKey) {
+		return errors.Errorf("state is for public key %X, expected %X", []byte(s.PublicKey), publicKey)
+	}
+
+	var pk crypto.PubKeyEd25519
+	var sig crypto.SignatureEd25519
+	if len(publicKey) != len(pk) || len(s.Signature) != len(sig) {
+		return errors.New("state signature is malformed")
+	}
+	copy(pk[:], publicKey)
+	copy(sig[:], s.Signature)
+
+	if !pk.VerifyBytes(s.SignBytes(), crypto.Signature{SignatureInner: sig}) {
+		return errors.New("state signature does not verify against the public key")
+	}
+	return nil
+}
+
+// Position is a height, round and step, ordered as consensus progresses. It
+// is the order in which the validator, and the HSM, refuse to sign again.
+type Position struct {
+	Height int64
+	Round  int
+	Step   int8
+}
+
+// Before reports whether p comes strictly before other.
+func (p Position) Before(other Position) bool {
+	if p.Height != other.Height {
+		return p.Height < other.Height
+	}
+	if p.Round != other.Round {
+		return p.Round < other.Round
+	}
+	return p.Step < other.Step
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("height %d, round %d, step %d", p.Height, p.Round, p.Step)
+}
+
+// Position returns the height, round and step of s.
+func (s SignedState) Position() Position {
+	return Position{s.Height, s.Round, s.Step}
+}
+
+// Position returns the height, round and step of s.
+func (s *SignState) Position() Position {
+	return Position{s.Height, s.Round, s.Step}
+}